@@ -0,0 +1,90 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/MarouaneBouaricha/cube/worker"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	rootCmd.AddCommand(execCmd)
+	execCmd.Flags().StringP("manager", "m", "localhost:5555", "Manager to talk to")
+	execCmd.Flags().BoolP("tty", "t", false, "Allocate a terminal for the command")
+}
+
+var execCmd = &cobra.Command{
+	Use:   "exec <taskID> -- <cmd> [args...]",
+	Short: "Run a command in a running task.",
+	Long: `cube exec command.
+
+The exec command runs a command inside the container of a running task,
+connected to the local stdin, stdout and stderr through the manager. Use -t
+for interactive programs such as shells.`,
+	Args: cobra.MinimumNArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		manager, _ := cmd.Flags().GetString("manager")
+		tty, _ := cmd.Flags().GetBool("tty")
+
+		req := worker.ExecRequest{Cmd: args[1:], Tty: tty}
+		restore := func() {}
+		if tty && isTerminal(os.Stdin) {
+			req.Height, req.Width = terminalSize()
+			var err error
+			if restore, err = makeRaw(); err != nil {
+				log.Fatalf("Error setting up the terminal: %v", err)
+			}
+		}
+
+		code, err := worker.ExecTask(context.Background(), manager, args[0], req, os.Stdin, os.Stdout, os.Stderr)
+		restore()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			if code == 0 {
+				code = 1
+			}
+		}
+		os.Exit(code)
+	},
+}
+
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// stty runs stty on the terminal connected to stdin.
+func stty(args ...string) (string, error) {
+	c := exec.Command("stty", args...)
+	c.Stdin = os.Stdin
+	out, err := c.Output()
+	return strings.TrimSpace(string(out)), err
+}
+
+// makeRaw puts the terminal in raw mode, so that keys are sent to the
+// command as they are typed, and returns a function restoring it.
+func makeRaw() (func(), error) {
+	state, err := stty("-g")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := stty("raw", "-echo"); err != nil {
+		return nil, err
+	}
+	return func() { stty(state) }, nil
+}
+
+func terminalSize() (uint, uint) {
+	out, err := stty("size")
+	if err != nil {
+		return 0, 0
+	}
+	var height, width uint
+	fmt.Sscanf(out, "%d %d", &height, &width)
+	return height, width
+}
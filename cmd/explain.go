@@ -0,0 +1,89 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/MarouaneBouaricha/cube/manager"
+	"github.com/docker/go-units"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	rootCmd.AddCommand(explainCmd)
+	explainCmd.Flags().StringP("manager", "m", "localhost:5555", "Manager to talk to")
+	explainCmd.Flags().BoolP("all", "a", false, "Show every recorded scheduling attempt, not only the latest")
+}
+
+var explainCmd = &cobra.Command{
+	Use:   "explain <taskID>",
+	Short: "Explain where a task was scheduled, or why it could not be.",
+	Long: `cube explain command.
+
+The explain command shows the latest scheduling attempt of a task: the worker
+it was placed on, why workers were left out and what the candidates scored.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		mgr, _ := cmd.Flags().GetString("manager")
+		all, _ := cmd.Flags().GetBool("all")
+
+		url := fmt.Sprintf("http://%s/tasks/%s/scheduling", mgr, args[0])
+		resp, err := http.Get(url)
+		if err != nil {
+			log.Fatalf("Error connecting to %v: %v", mgr, err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			e := manager.ErrResponse{}
+			if err := json.NewDecoder(resp.Body).Decode(&e); err != nil || e.Message == "" {
+				log.Fatalf("Error getting scheduling attempts of task %v: %s", args[0], resp.Status)
+			}
+			log.Fatalf("Error getting scheduling attempts of task %v: %s", args[0], e.Message)
+		}
+
+		var attempts []manager.SchedulingAttempt
+		if err := json.NewDecoder(resp.Body).Decode(&attempts); err != nil {
+			log.Fatal(err)
+		}
+		if len(attempts) == 0 {
+			fmt.Printf("No scheduling attempts recorded for task %s.\n", args[0])
+			return
+		}
+		if !all {
+			attempts = attempts[len(attempts)-1:]
+		}
+
+		for i, a := range attempts {
+			if i > 0 {
+				fmt.Println()
+			}
+			ago := units.HumanDuration(time.Now().UTC().Sub(a.Time))
+			if a.Worker != "" {
+				fmt.Printf("Scheduled on %s %s ago.\n", a.Worker, ago)
+			} else {
+				fmt.Printf("Not scheduled %s ago: %s\n", ago, a.Error)
+			}
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 5, ' ', tabwriter.TabIndent)
+			fmt.Fprintln(w, "NODE\tSCORE\tREASON\t")
+			for _, d := range a.Nodes {
+				score := "-"
+				if d.Candidate {
+					score = fmt.Sprintf("%.3f", d.Score)
+				}
+				reason := d.Reason
+				if d.Candidate && d.Node == a.Worker {
+					reason = "picked"
+				}
+				fmt.Fprintf(w, "%s\t%s\t%s\t\n", d.Node, score, reason)
+			}
+			w.Flush()
+		}
+	},
+}
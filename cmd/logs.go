@@ -0,0 +1,67 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+
+	"github.com/MarouaneBouaricha/cube/manager"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	rootCmd.AddCommand(logsCmd)
+	logsCmd.Flags().StringP("manager", "m", "localhost:5555", "Manager to talk to")
+	logsCmd.Flags().BoolP("follow", "f", false, "Keep streaming new output")
+	logsCmd.Flags().String("tail", "all", "Number of lines to show from the end of the logs")
+	logsCmd.Flags().String("since", "", "Show logs since a time (e.g. 2024-01-02T15:04:05Z) or for a duration (e.g. 10m)")
+	logsCmd.Flags().BoolP("timestamps", "t", false, "Show the time each line was written")
+}
+
+var logsCmd = &cobra.Command{
+	Use:   "logs <taskID>",
+	Short: "Print the logs of a task.",
+	Long: `cube logs command.
+
+The logs command prints the output of a task's container, fetched through the
+manager from the worker running it.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		mgr, _ := cmd.Flags().GetString("manager")
+		follow, _ := cmd.Flags().GetBool("follow")
+		tail, _ := cmd.Flags().GetString("tail")
+		since, _ := cmd.Flags().GetString("since")
+		timestamps, _ := cmd.Flags().GetBool("timestamps")
+
+		q := url.Values{}
+		q.Set("follow", fmt.Sprint(follow))
+		q.Set("tail", tail)
+		q.Set("timestamps", fmt.Sprint(timestamps))
+		if since != "" {
+			q.Set("since", since)
+		}
+
+		u := fmt.Sprintf("http://%s/tasks/%s/logs?%s", mgr, args[0], q.Encode())
+		resp, err := http.Get(u)
+		if err != nil {
+			log.Fatalf("Error connecting to %v: %v", mgr, err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			e := manager.ErrResponse{}
+			if err := json.NewDecoder(resp.Body).Decode(&e); err != nil || e.Message == "" {
+				log.Fatalf("Error getting logs of task %v: %s", args[0], resp.Status)
+			}
+			log.Fatalf("Error getting logs of task %v: %s", args[0], e.Message)
+		}
+
+		if _, err := io.Copy(os.Stdout, resp.Body); err != nil {
+			log.Fatalf("Error reading logs of task %v: %v", args[0], err)
+		}
+	},
+}
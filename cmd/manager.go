@@ -1,7 +1,12 @@
 package cmd
 
 import (
+	"context"
 	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 
 	"github.com/MarouaneBouaricha/cube/manager"
 	"github.com/spf13/cobra"
@@ -11,9 +16,17 @@ func init() {
 	rootCmd.AddCommand(managerCmd)
 	managerCmd.Flags().StringP("host", "H", "0.0.0.0", "Hostname or IP address")
 	managerCmd.Flags().IntP("port", "p", 5555, "Port on which to listen")
-	managerCmd.Flags().StringSliceP("workers", "w", []string{"localhost:5556"}, "List of workers on which the manager will schedule tasks.")
-	managerCmd.Flags().StringP("scheduler", "s", "epvm", "Name of scheduler to use.")
+	managerCmd.Flags().StringSliceP("workers", "w", []string{"localhost:5556"}, "List of workers on which the manager will schedule tasks, in addition to the ones that register.")
+	managerCmd.Flags().StringP("scheduler", "s", "epvm", "Name of scheduler to use (\"epvm\", \"roundrobin\", \"binpack\", \"spread\" or \"framework\").")
+	managerCmd.Flags().StringP("config", "c", "", "Manager config file, whose scheduler plugins replace --scheduler")
 	managerCmd.Flags().StringP("dbType", "d", "memory", "Type of datastore to use for events and tasks (\"memory\" or \"persistent\")")
+	managerCmd.Flags().Int("dispatchers", manager.DefaultDispatchers, "Number of task events to send to workers concurrently")
+	managerCmd.Flags().Int("max-missed-heartbeats", manager.DefaultMaxMissedHeartbeats, "Consecutive failed task updates after which a worker is marked unhealthy and its tasks are rescheduled")
+	managerCmd.Flags().Int("max-retries", manager.DefaultMaxRetries, "Consecutive restarts of a task that does not set MaxRetries (negative for no limit)")
+	managerCmd.Flags().Duration("restart-backoff", manager.DefaultRestartBackoff, "First delay before restarting a crash-looping task that does not set RestartBackoff")
+	managerCmd.Flags().Duration("pending-backoff", manager.DefaultPendingBackoff, "First delay before retrying a task that could not be scheduled")
+	managerCmd.Flags().Duration("pending-timeout", manager.DefaultPendingTimeout, "How long to retry a task that cannot be scheduled before failing it (0 for no limit)")
+	managerCmd.Flags().Bool("preemption", false, "Let tasks no worker has room for stop tasks of a lower priority")
 }
 
 var managerCmd = &cobra.Command{
@@ -25,6 +38,7 @@ The manager controls the orchestration system and is responsible for:
 - Accepting tasks from users
 - Scheduling tasks onto worker nodes
 - Rescheduling tasks in the event of a node failure
+- Restarting tasks according to their restart policy
 - Periodically polling workers to get task updates`,
 	Run: func(cmd *cobra.Command, args []string) {
 		host, _ := cmd.Flags().GetString("host")
@@ -32,15 +46,53 @@ The manager controls the orchestration system and is responsible for:
 		workers, _ := cmd.Flags().GetStringSlice("workers")
 		scheduler, _ := cmd.Flags().GetString("scheduler")
 		dbType, _ := cmd.Flags().GetString("dbType")
+		dispatchers, _ := cmd.Flags().GetInt("dispatchers")
+		maxMissedHeartbeats, _ := cmd.Flags().GetInt("max-missed-heartbeats")
+		maxRetries, _ := cmd.Flags().GetInt("max-retries")
+		restartBackoff, _ := cmd.Flags().GetDuration("restart-backoff")
+		pendingBackoff, _ := cmd.Flags().GetDuration("pending-backoff")
+		pendingTimeout, _ := cmd.Flags().GetDuration("pending-timeout")
+		preemption, _ := cmd.Flags().GetBool("preemption")
+		configFile, _ := cmd.Flags().GetString("config")
 
 		log.Println("Starting manager.")
 		m := manager.New(workers, scheduler, dbType)
+		m.Dispatchers = dispatchers
+		m.MaxMissedHeartbeats = maxMissedHeartbeats
+		m.MaxRetries = maxRetries
+		m.RestartBackoff = restartBackoff
+		m.PendingBackoff = pendingBackoff
+		m.PendingTimeout = pendingTimeout
+		m.Preemption = preemption
+		if configFile != "" {
+			config, err := manager.LoadConfig(configFile)
+			if err != nil {
+				log.Fatal(err)
+			}
+			if err := m.Configure(config); err != nil {
+				log.Fatalf("invalid config file %s: %v", configFile, err)
+			}
+		}
+		m.Recover()
+		defer m.Close()
 		api := manager.Api{Address: host, Port: port, Manager: m}
-		go m.ProcessTasks()
-		go m.UpdateTasks()
-		go m.DoHealthChecks()
-		go m.UpdateNodeStats()
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
+		var wg sync.WaitGroup
+		for _, loop := range []func(context.Context){m.ProcessTasks, m.UpdateTasks, m.DoHealthChecks, m.RestartTasks, m.UpdateNodeStats} {
+			wg.Add(1)
+			go func(loop func(context.Context)) {
+				defer wg.Done()
+				loop(ctx)
+			}(loop)
+		}
 		log.Printf("Starting manager API on http://%s:%d", host, port)
-		api.Start()
+		go api.Start()
+
+		<-ctx.Done()
+		log.Println("Shutting down manager, waiting for in-flight task events.")
+		wg.Wait()
 	},
 }
@@ -8,14 +8,19 @@ import (
 	"net/http"
 	"os"
 	"text/tabwriter"
+	"time"
 
+	"github.com/MarouaneBouaricha/cube/manager"
 	"github.com/MarouaneBouaricha/cube/node"
+	"github.com/docker/go-units"
 	"github.com/spf13/cobra"
 )
 
 func init() {
 	rootCmd.AddCommand(nodeCmd)
-	nodeCmd.Flags().StringP("manager", "m", "localhost:5555", "Manager to talk to")
+	nodeCmd.PersistentFlags().StringP("manager", "m", "localhost:5555", "Manager to talk to")
+	nodeCmd.AddCommand(cordonCmd, uncordonCmd, drainCmd)
+	drainCmd.Flags().DurationP("timeout", "t", manager.DefaultDrainTimeout, "How long to wait for the tasks of the node to stop")
 }
 
 var nodeCmd = &cobra.Command{
@@ -43,10 +48,86 @@ The node command allows a user to get the information about the nodes in the clu
 		var nodes []*node.Node
 		json.Unmarshal(body, &nodes)
 		w := tabwriter.NewWriter(os.Stdout, 0, 0, 5, ' ', tabwriter.TabIndent)
-		fmt.Fprintln(w, "NAME\tMEMORY (MiB)\tDISK (GiB)\tROLE\tTASKS\t")
+		fmt.Fprintln(w, "NAME\tCPUS\tCPU USAGE\tMEMORY (MiB)\tDISK (GiB)\tROLE\tTASKS\tSTATUS\tLAST SEEN\t")
 		for _, node := range nodes {
-			fmt.Fprintf(w, "%s\t%d\t%d\t%s\t%d\t\n", node.Name, node.Memory/1024, node.Disk/1024/1024/1024, node.Role, node.TaskCount)
+			status := node.Status.String()
+			if node.Cordoned {
+				status += ",Cordoned"
+			}
+			lastSeen := "never"
+			if !node.LastSeen.IsZero() {
+				lastSeen = fmt.Sprintf("%s ago", units.HumanDuration(time.Now().UTC().Sub(node.LastSeen)))
+			}
+			cpus := fmt.Sprintf("%.2f/%d", node.CpuAllocated, node.Cpus)
+			memory := fmt.Sprintf("%d/%d", node.MemoryAllocated/1024, node.Memory/1024)
+			disk := fmt.Sprintf("%d/%d", node.DiskAllocated/1024/1024/1024, node.Disk/1024/1024/1024)
+			fmt.Fprintf(w, "%s\t%s\t%.0f%%\t%s\t%s\t%s\t%d\t%s\t%s\t\n", node.Name, cpus, node.CpuUsage*100, memory, disk, node.Role, node.TaskCount, status, lastSeen)
 		}
 		w.Flush()
 	},
 }
+
+var cordonCmd = &cobra.Command{
+	Use:   "cordon <name>",
+	Short: "Stop scheduling new tasks on a node.",
+	Long: `cube node cordon command.
+
+The cordon command marks a node as unschedulable. Tasks already running on it keep running.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		postNodeAction(cmd, args[0], "cordon", 0)
+		log.Printf("Node %v cordoned.", args[0])
+	},
+}
+
+var uncordonCmd = &cobra.Command{
+	Use:   "uncordon <name>",
+	Short: "Resume scheduling new tasks on a node.",
+	Long: `cube node uncordon command.
+
+The uncordon command marks a cordoned node as schedulable again.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		postNodeAction(cmd, args[0], "uncordon", 0)
+		log.Printf("Node %v uncordoned.", args[0])
+	},
+}
+
+var drainCmd = &cobra.Command{
+	Use:   "drain <name>",
+	Short: "Move all tasks off a node.",
+	Long: `cube node drain command.
+
+The drain command cordons a node, reschedules its tasks onto other nodes and
+waits up to --timeout for them to stop on the drained node.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		timeout, _ := cmd.Flags().GetDuration("timeout")
+		postNodeAction(cmd, args[0], fmt.Sprintf("drain?timeout=%s", timeout), timeout)
+		log.Printf("Node %v drained.", args[0])
+	},
+}
+
+// postNodeAction sends an action for the named node to the manager, exiting
+// if the manager does not accept it. wait is how long the manager may take
+// to act in addition to the usual request time.
+func postNodeAction(cmd *cobra.Command, name string, action string, wait time.Duration) {
+	manager, _ := cmd.Flags().GetString("manager")
+	url := fmt.Sprintf("http://%s/nodes/%s/%s", manager, name, action)
+	client := &http.Client{Timeout: wait + 30*time.Second}
+	resp, err := client.Post(url, "application/json", nil)
+	if err != nil {
+		log.Fatalf("Error connecting to %v: %v", url, err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNoContent:
+	case http.StatusNotFound:
+		log.Fatalf("Node %v not found.", name)
+	default:
+		e := struct{ Message string }{}
+		json.NewDecoder(resp.Body).Decode(&e)
+		log.Fatalf("Error from manager: %v %v", resp.Status, e.Message)
+	}
+}
@@ -44,18 +44,30 @@ The status command allows a user to get the status of tasks from the Cube manage
 		}
 
 		w := tabwriter.NewWriter(os.Stdout, 0, 0, 5, ' ', tabwriter.TabIndent)
-		fmt.Fprintln(w, "ID\tNAME\tCREATED\tSTATE\tCONTAINERNAME\tIMAGE\t")
-		for _, task := range tasks {
+		fmt.Fprintln(w, "ID\tNAME\tCREATED\tSTATE\tCONTAINERNAME\tIMAGE\tHEALTH\tRESTART POLICY\tRESTARTS\tCPU\tMEMORY\tDISK\t")
+		for _, t := range tasks {
 			var start string
-			if task.StartTime.IsZero() {
+			if t.StartTime.IsZero() {
 				start = fmt.Sprintf("%s ago", units.HumanDuration(time.Now().UTC().Sub(time.Now().UTC())))
 			} else {
-				start = fmt.Sprintf("%s ago", units.HumanDuration(time.Now().UTC().Sub(task.StartTime)))
+				start = fmt.Sprintf("%s ago", units.HumanDuration(time.Now().UTC().Sub(t.StartTime)))
 			}
 
-			// TODO: there is a bug here, state for stopped jobs is showing as Running
-			state := task.State.String()[task.State]
-			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t\n", task.ID, task.Name, start, state, task.Name, task.Image)
+			restarts := fmt.Sprintf("%d", t.RestartCount)
+			if t.MaxRetries > 0 {
+				restarts = fmt.Sprintf("%d/%d", t.RestartCount, t.MaxRetries)
+			}
+			health := string(t.HealthStatus.Status)
+			if health == "" {
+				health = "-"
+			}
+			cpu, memory, disk := "-", "-", "-"
+			if t.State == task.Running && !t.Usage.UpdatedAt.IsZero() {
+				cpu = fmt.Sprintf("%.2f", t.Usage.Cpu)
+				memory = units.BytesSize(float64(t.Usage.Memory))
+				disk = units.BytesSize(float64(t.Usage.Disk))
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t\n", t.ID, t.Name, start, t.State, t.Name, t.Image, health, t.RestartPolicy, restarts, cpu, memory, disk)
 		}
 		w.Flush()
 	},
@@ -1,9 +1,16 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
 	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
 
+	"github.com/MarouaneBouaricha/cube/task"
 	"github.com/MarouaneBouaricha/cube/worker"
 	"github.com/google/uuid"
 	"github.com/spf13/cobra"
@@ -16,6 +23,12 @@ func init() {
 	workerCmd.Flags().StringP("name", "n", fmt.Sprintf("worker-%s", uuid.New().String()), "Name of the worker")
 	workerCmd.Flags().StringP("dbtype", "d", "memory", "Type of datastore to use for tasks (\"memory\" or \"persistent\")")
 	workerCmd.Flags().StringP("runtime", "r", "docker", "Container Runtime to use for tasks (\"docker\" or \"podman\")")
+	workerCmd.Flags().IntP("executors", "e", worker.DefaultExecutors, "Number of tasks to run concurrently")
+	workerCmd.Flags().StringP("manager", "m", "", "Manager to register with (e.g. \"localhost:5555\")")
+	workerCmd.Flags().StringToString("label", nil, "Label advertised to the manager in key=value form, for tasks to select the worker by (repeatable)")
+	workerCmd.Flags().StringSlice("taint", nil, "Taint in key[=value] form keeping tasks that do not tolerate it off the worker (repeatable)")
+	workerCmd.Flags().StringSlice("allow-bind", nil, "Host path tasks may bind mount, along with the paths below it (repeatable)")
+	workerCmd.Flags().StringP("advertise", "a", "", "Address the manager should reach this worker at (defaults to <hostname>:<port>)")
 }
 
 var workerCmd = &cobra.Command{
@@ -30,14 +43,58 @@ The worker runs tasks and responds to the manager's requests about task state.`,
 		name, _ := cmd.Flags().GetString("name")
 		dbType, _ := cmd.Flags().GetString("dbtype")
 		container_runtime, _ := cmd.Flags().GetString("runtime")
+		executors, _ := cmd.Flags().GetInt("executors")
+		managerAddr, _ := cmd.Flags().GetString("manager")
+		advertise, _ := cmd.Flags().GetString("advertise")
+		bindPaths, _ := cmd.Flags().GetStringSlice("allow-bind")
+		labels, _ := cmd.Flags().GetStringToString("label")
+		taints, _ := cmd.Flags().GetStringSlice("taint")
+		for _, taint := range taints {
+			if key, _, _ := strings.Cut(taint, "="); key == "" {
+				log.Fatalf("invalid taint %q: missing key", taint)
+			}
+		}
 
 		log.Println("Starting worker.")
-		w := worker.New(name, dbType, container_runtime)
+		runtime, err := task.NewContainerRuntime(container_runtime)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Using %s container runtime", container_runtime)
+		w := worker.New(name, dbType, runtime)
+		w.Executors = executors
+		w.BindPaths = bindPaths
+		w.Labels = labels
+		w.Taints = taints
 		api := worker.Api{Address: host, Port: port, Worker: w}
-		go w.RunTasks()
-		go w.CollectStats()
-		go w.UpdateTasks()
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
+		var wg sync.WaitGroup
+		for _, loop := range []func(context.Context){w.RunTasks, w.CollectStats, w.UpdateTasks, w.CheckHealth} {
+			wg.Add(1)
+			go func(loop func(context.Context)) {
+				defer wg.Done()
+				loop(ctx)
+			}(loop)
+		}
 		log.Printf("Starting worker API on http://%s:%d", host, port)
-		api.Start()
+		go api.Start()
+
+		if managerAddr != "" {
+			if advertise == "" {
+				hostname, err := os.Hostname()
+				if err != nil {
+					log.Fatalf("unable to determine address to advertise: %v", err)
+				}
+				advertise = fmt.Sprintf("%s:%d", hostname, port)
+			}
+			go w.Register(ctx, managerAddr, advertise)
+		}
+
+		<-ctx.Done()
+		log.Println("Shutting down worker, waiting for running tasks to finish.")
+		wg.Wait()
 	},
 }
@@ -0,0 +1,137 @@
+package manager
+
+import (
+	"sort"
+
+	"github.com/MarouaneBouaricha/cube/node"
+	"github.com/MarouaneBouaricha/cube/task"
+	"github.com/google/uuid"
+)
+
+// allocation is what a task holds on the worker it is assigned to.
+type allocation struct {
+	worker string
+	cpu    float64
+	// memory in KiB, the unit nodes report their memory in.
+	memory int64
+	// disk in bytes.
+	disk int64
+	// ports are the host ports the task maps, in port/protocol form.
+	ports []string
+	// labels are the labels of the task.
+	labels map[string]string
+	// priority and state are those of the task.
+	priority int
+	state    task.State
+}
+
+// placeTask selects a worker for t and assigns t to it. Both happen under
+// m.mu, so that tasks placed concurrently see each other's allocations.
+func (m *Manager) placeTask(t *task.Task) (*node.Node, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	n, err := m.selectWorkerLocked(*t)
+	if err != nil {
+		return nil, err
+	}
+	m.assignLocked(t, n.Name)
+	return n, nil
+}
+
+// holdsResources reports whether t keeps its allocation on its worker. Tasks
+// that exited keep it for as long as they may be restarted there.
+func (m *Manager) holdsResources(t *task.Task) bool {
+	switch t.State {
+	case task.Pending, task.Completed:
+		return false
+	case task.Succeeded, task.Failed:
+		return t.RestartPolicy.Restarts(t.State) && !m.retriesExhausted(t)
+	}
+	return true
+}
+
+// syncAllocation allocates or releases what t holds on the worker it is
+// assigned to, after a change of its state.
+func (m *Manager) syncAllocation(t *task.Task) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if w, ok := m.TaskWorkerMap[t.ID]; ok && m.holdsResources(t) {
+		m.allocateLocked(t, w)
+	} else {
+		m.releaseLocked(t.ID)
+	}
+}
+
+// allocateLocked records that t holds resources on worker. The caller must
+// hold m.mu.
+func (m *Manager) allocateLocked(t *task.Task, worker string) {
+	if a, ok := m.allocations[t.ID]; ok && a.worker != worker {
+		m.releaseLocked(t.ID)
+	}
+	m.allocations[t.ID] = allocation{
+		worker:   worker,
+		cpu:      t.Cpu,
+		memory:   t.Memory / 1024,
+		disk:     t.Disk,
+		ports:    t.HostPortKeys(),
+		labels:   t.Labels,
+		priority: t.Priority,
+		state:    t.State,
+	}
+	m.refreshAllocatedLocked(worker)
+}
+
+// releaseLocked frees what the task holds on its worker. The caller must
+// hold m.mu.
+func (m *Manager) releaseLocked(id uuid.UUID) {
+	a, ok := m.allocations[id]
+	if !ok {
+		return
+	}
+	delete(m.allocations, id)
+	m.refreshAllocatedLocked(a.worker)
+	m.capacityChanged()
+}
+
+// refreshAllocatedLocked recomputes the allocated resources, the task count
+// and the task labels of the worker's node. The caller must hold m.mu.
+func (m *Manager) refreshAllocatedLocked(worker string) {
+	n := m.nodeByName(worker)
+	if n == nil {
+		return
+	}
+	m.setAllocatedLocked(n, nil)
+}
+
+// setAllocatedLocked sets the allocated resources, the task count and the
+// task labels of n from the allocations on its worker, leaving out the
+// tasks in skip. The node gets new slices rather than updated ones, since
+// copies of it may be in use outside of m.mu. The caller must hold m.mu.
+func (m *Manager) setAllocatedLocked(n *node.Node, skip map[uuid.UUID]bool) {
+	var cpu float64
+	var memory, disk int64
+	var ports []string
+	var tasks int
+	labels := make(map[string]map[string]string)
+	for id, a := range m.allocations {
+		if a.worker == n.Name && !skip[id] {
+			tasks++
+			cpu += a.cpu
+			memory += a.memory
+			disk += a.disk
+			ports = append(ports, a.ports...)
+			if len(a.labels) > 0 {
+				labels[id.String()] = a.labels
+			}
+		}
+	}
+	sort.Strings(ports)
+	n.CpuAllocated = cpu
+	n.MemoryAllocated = memory
+	n.DiskAllocated = disk
+	n.PortsAllocated = ports
+	n.TaskLabels = labels
+	n.TaskCount = tasks
+}
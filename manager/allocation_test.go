@@ -0,0 +1,247 @@
+package manager
+
+import (
+	"context"
+	"io"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/MarouaneBouaricha/cube/task"
+	"github.com/google/uuid"
+)
+
+func TestManagerSchedulesHostPorts(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	fa := task.NewFake()
+	wa, addrA := startWorker(t, fa)
+	go wa.RunTasks(ctx)
+	fb := task.NewFake()
+	wb, addrB := startWorker(t, fb)
+	go wb.RunTasks(ctx)
+
+	m := New([]string{addrA, addrB}, "roundrobin", "memory")
+	ports := []task.PortMapping{{ContainerPort: 80, HostPort: 8080}}
+	run := func(tk task.Task) {
+		m.AddTask(task.TaskEvent{ID: uuid.New(), State: task.Running, Timestamp: time.Now(), Task: tk})
+		m.SendWork()
+	}
+	allocated := func(worker string) []string {
+		for _, n := range m.GetNodes() {
+			if n.Name == worker {
+				return n.PortsAllocated
+			}
+		}
+		return nil
+	}
+
+	var tasks []task.Task
+	for i := 0; i < 3; i++ {
+		tk := task.Task{ID: uuid.New(), Name: "web", Image: "server", State: task.Scheduled, Ports: ports}
+		tasks = append(tasks, tk)
+		run(tk)
+	}
+
+	// Both workers get one task each, and there is none left for the third.
+	first, _ := m.workerFor(tasks[0].ID)
+	second, _ := m.workerFor(tasks[1].ID)
+	if first == "" || second == "" || first == second {
+		t.Fatalf("tasks mapping the same host port assigned to %q and %q; want different workers", first, second)
+	}
+	if w, ok := m.workerFor(tasks[2].ID); ok {
+		t.Fatalf("third task assigned to %s; want it unscheduled", w)
+	}
+	for _, w := range []string{addrA, addrB} {
+		if got := allocated(w); len(got) != 1 || got[0] != "8080/tcp" {
+			t.Errorf("ports allocated on %s = %v; want [8080/tcp]", w, got)
+		}
+	}
+
+	// Tasks mapping other host ports still fit.
+	other := task.Task{ID: uuid.New(), Name: "dns", Image: "server", State: task.Scheduled,
+		Ports: []task.PortMapping{{ContainerPort: 53, HostPort: 8080, Protocol: "udp"}}}
+	run(other)
+	if _, ok := m.workerFor(other.ID); !ok {
+		t.Error("task mapping a free host port was not scheduled")
+	}
+
+	// Stopping a task frees its port for the one that did not fit.
+	waitFor(t, func() bool { return len(fa.Containers()) == 2 || len(fb.Containers()) == 2 })
+	m.updateTasks()
+	m.AddTask(task.TaskEvent{ID: uuid.New(), State: task.Completed, Timestamp: time.Now(), Task: *getTask(t, m, tasks[0].ID)})
+	m.SendWork()
+	waitFor(t, func() bool {
+		m.updateTasks()
+		return getTask(t, m, tasks[0].ID).State == task.Completed
+	})
+	for _, p := range allocated(first) {
+		if p == "8080/tcp" {
+			t.Fatalf("port of stopped task still allocated on %s: %v", first, allocated(first))
+		}
+	}
+
+	run(tasks[2])
+	if w, _ := m.workerFor(tasks[2].ID); w != first {
+		t.Errorf("task assigned to %q once the port was freed; want %q", w, first)
+	}
+}
+
+func TestManagerAllocatesResources(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	f := task.NewFake()
+	f.Script("job", task.FakeBehavior{ExitAfter: 10 * time.Millisecond})
+	f.Script("server", task.FakeBehavior{Memory: 32 << 20, Disk: 4096})
+	w, addr := startWorker(t, f)
+	w.UpdateInterval = 5 * time.Millisecond
+	go w.RunTasks(ctx)
+	go w.UpdateTasks(ctx)
+	m := New([]string{addr}, "roundrobin", "memory")
+
+	allocated := func() (float64, int64, int64) {
+		n := m.GetNodes()[0]
+		return n.CpuAllocated, n.MemoryAllocated, n.DiskAllocated
+	}
+	run := func(tk task.Task) {
+		m.AddTask(task.TaskEvent{ID: uuid.New(), State: task.Running, Timestamp: time.Now(), Task: tk})
+		m.SendWork()
+	}
+
+	web := task.Task{ID: uuid.New(), Name: "web", Image: "server", State: task.Scheduled,
+		Cpu: 0.5, Memory: 64 << 20, Disk: 1 << 30}
+	job := task.Task{ID: uuid.New(), Name: "job", Image: "job", State: task.Scheduled, RestartPolicy: task.RestartNever,
+		Cpu: 1, Memory: 128 << 20, Disk: 2 << 30}
+	run(web)
+	run(job)
+	if cpu, mem, disk := allocated(); cpu != 1.5 || mem != 192<<10 || disk != 3<<30 {
+		t.Errorf("allocated %v CPUs, %d KiB, %d bytes; want 1.5 CPUs, %d KiB, %d bytes", cpu, mem, disk, 192<<10, 3<<30)
+	}
+
+	// A task that exits for good frees what it held.
+	waitFor(t, func() bool {
+		m.updateTasks()
+		return getTask(t, m, job.ID).State == task.Succeeded
+	})
+	if cpu, mem, disk := allocated(); cpu != 0.5 || mem != 64<<10 || disk != 1<<30 {
+		t.Errorf("allocated %v CPUs, %d KiB, %d bytes once the job exited; want only the web task", cpu, mem, disk)
+	}
+
+	// Workers report what running tasks actually use.
+	waitFor(t, func() bool {
+		m.updateTasks()
+		return !getTask(t, m, web.ID).Usage.UpdatedAt.IsZero()
+	})
+	if u := getTask(t, m, web.ID).Usage; u.Memory != 32<<20 || u.Disk != 4096 {
+		t.Errorf("usage of web task = %+v; want 32 MiB of memory and 4096 bytes of disk", u)
+	}
+
+	m.AddTask(task.TaskEvent{ID: uuid.New(), State: task.Completed, Timestamp: time.Now(), Task: *getTask(t, m, web.ID)})
+	m.SendWork()
+	waitFor(t, func() bool {
+		m.updateTasks()
+		return getTask(t, m, web.ID).State == task.Completed
+	})
+	if cpu, mem, disk := allocated(); cpu != 0 || mem != 0 || disk != 0 {
+		t.Errorf("allocated %v CPUs, %d KiB, %d bytes once all tasks stopped; want nothing", cpu, mem, disk)
+	}
+}
+
+func TestManagerEpvmFiltersOnResources(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	w, addr := startWorker(t, task.NewFake())
+	go w.RunTasks(ctx)
+	m := New([]string{addr}, "epvm", "memory")
+
+	// Nodes only have a capacity once their stats were collected.
+	m.updateNodeStats()
+	n := m.GetNodes()[0]
+	if n.Cpus == 0 || n.Memory == 0 {
+		t.Fatalf("node has %d CPUs and %d KiB of memory after collecting stats; want both set", n.Cpus, n.Memory)
+	}
+
+	tests := []struct {
+		name string
+		cpu  float64
+		mem  int64
+		want bool
+	}{
+		{"fits", 0.5, 1 << 20, true},
+		{"more cpus than the node has", float64(n.Cpus) + 1, 1 << 20, false},
+		{"more memory than the node has", 0.5, (n.Memory + 1) << 10, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tk := task.Task{ID: uuid.New(), Name: "web", Image: "server", State: task.Scheduled, Cpu: tt.cpu, Memory: tt.mem}
+			m.AddTask(task.TaskEvent{ID: uuid.New(), State: task.Running, Timestamp: time.Now(), Task: tk})
+			m.SendWork()
+			if _, ok := m.workerFor(tk.ID); ok != tt.want {
+				t.Errorf("task scheduled = %v; want %v", ok, tt.want)
+			}
+		})
+	}
+}
+
+func TestManagerPlacementRules(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	wa, addrA := startWorker(t, task.NewFake())
+	wa.Labels = map[string]string{"pool": "build"}
+	go wa.RunTasks(ctx)
+	wb, addrB := startWorker(t, task.NewFake())
+	go wb.RunTasks(ctx)
+	m := New([]string{addrA, addrB}, "roundrobin", "memory")
+
+	// Workers listed on the command line report their labels with their
+	// stats.
+	m.updateNodeStats()
+	for _, n := range m.GetNodes() {
+		if n.Name == addrA && n.Labels["pool"] != "build" {
+			t.Fatalf("labels of %s = %v; want pool=build", n.Name, n.Labels)
+		}
+	}
+	run := func(tk task.Task) (string, bool) {
+		m.AddTask(task.TaskEvent{ID: uuid.New(), State: task.Running, Timestamp: time.Now(), Task: tk})
+		m.SendWork()
+		return m.workerFor(tk.ID)
+	}
+
+	for i := 0; i < 3; i++ {
+		build := task.Task{ID: uuid.New(), Name: "build", Image: "server", State: task.Scheduled,
+			NodeSelector: task.LabelSelector{"pool": "build"}}
+		if w, _ := run(build); w != addrA {
+			t.Fatalf("build task assigned to %q; want %q", w, addrA)
+		}
+	}
+
+	// Replicas keeping away from each other are spread over the workers.
+	seen := make(map[string]bool)
+	for i := 0; i < 3; i++ {
+		replica := task.Task{ID: uuid.New(), Name: "web", Image: "server", State: task.Scheduled,
+			Labels: map[string]string{"app": "web"}, AntiAffinity: []task.LabelSelector{{"app": "web"}}}
+		w, ok := run(replica)
+		if i == 2 {
+			if ok {
+				t.Errorf("third replica assigned to %s; want it unscheduled", w)
+			}
+			continue
+		}
+		if !ok || seen[w] {
+			t.Fatalf("replica %d assigned to %q; want a worker without a replica", i, w)
+		}
+		seen[w] = true
+	}
+}
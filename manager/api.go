@@ -26,13 +26,32 @@ func (a *Api) initRouter() {
 		r.Get("/", a.GetTasksHandler)
 		r.Route("/{taskID}", func(r chi.Router) {
 			r.Delete("/", a.StopTaskHandler)
+			r.Get("/logs", a.GetTaskLogsHandler)
+			r.Get("/scheduling", a.GetTaskSchedulingHandler)
+			r.Post("/exec", a.ExecTaskHandler)
 		})
 	})
 	a.Router.Route("/nodes", func(r chi.Router) {
 		r.Get("/", a.GetNodesHandler)
+		r.Post("/", a.RegisterNodeHandler)
+		r.Route("/{name}", func(r chi.Router) {
+			r.Delete("/", a.DeregisterNodeHandler)
+			r.Post("/cordon", a.CordonNodeHandler)
+			r.Post("/uncordon", a.UncordonNodeHandler)
+			r.Post("/drain", a.DrainNodeHandler)
+		})
+	})
+	a.Router.Route("/stats", func(r chi.Router) {
+		r.Get("/", a.GetStatsHandler)
 	})
 }
 
+// Handler returns the manager API routes without starting a listener.
+func (a *Api) Handler() http.Handler {
+	a.initRouter()
+	return a.Router
+}
+
 func (a *Api) Start() {
 	a.initRouter()
 	http.ListenAndServe(fmt.Sprintf("%s:%d", a.Address, a.Port), a.Router)
@@ -0,0 +1,368 @@
+package manager
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/MarouaneBouaricha/cube/task"
+	"github.com/MarouaneBouaricha/cube/worker"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/uuid"
+)
+
+// TestManagerApiConcurrentWithLoops drives the manager API while the manager
+// and worker background loops are running. It is most useful with -race.
+func TestManagerApiConcurrentWithLoops(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	f := task.NewFake()
+	w, addr := startWorker(t, f)
+	w.UpdateInterval = 5 * time.Millisecond
+	w.StatsInterval = 5 * time.Millisecond
+	w.HealthCheckInterval = 5 * time.Millisecond
+
+	m := New([]string{addr}, "roundrobin", "memory")
+	m.UpdateInterval = 5 * time.Millisecond
+	m.StatsInterval = 5 * time.Millisecond
+	m.HealthCheckInterval = 5 * time.Millisecond
+	m.RestartInterval = 5 * time.Millisecond
+
+	api := Api{Manager: m}
+	srv := httptest.NewServer(api.Handler())
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var loops sync.WaitGroup
+	for _, loop := range []func(context.Context){
+		w.RunTasks, w.UpdateTasks, w.CollectStats, w.CheckHealth,
+		m.ProcessTasks, m.UpdateTasks, m.DoHealthChecks, m.RestartTasks, m.UpdateNodeStats,
+	} {
+		loops.Add(1)
+		go func(loop func(context.Context)) {
+			defer loops.Done()
+			loop(ctx)
+		}(loop)
+	}
+
+	var ids []uuid.UUID
+	for i := 0; i < 20; i++ {
+		ids = append(ids, uuid.New())
+	}
+
+	var clients sync.WaitGroup
+	for i, id := range ids {
+		clients.Add(2)
+		go func(id uuid.UUID) {
+			defer clients.Done()
+			te := task.TaskEvent{ID: uuid.New(), State: task.Running, Task: task.Task{ID: id, Name: "web", Image: "server", State: task.Scheduled}}
+			data, _ := json.Marshal(te)
+			resp, err := http.Post(srv.URL+"/tasks", "application/json", bytes.NewBuffer(data))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusCreated {
+				t.Errorf("POST /tasks returned %d", resp.StatusCode)
+			}
+		}(id)
+		go func(path string) {
+			defer clients.Done()
+			resp, err := http.Get(srv.URL + path)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			resp.Body.Close()
+		}([]string{"/tasks", "/nodes", "/stats"}[i%3])
+	}
+	clients.Wait()
+
+	inState := func(state task.State, n int) func() bool {
+		return func() bool {
+			count := 0
+			for _, tk := range m.GetTasks() {
+				if tk.State == state {
+					count++
+				}
+			}
+			return count == n
+		}
+	}
+	waitFor(t, inState(task.Running, len(ids)))
+
+	for _, id := range ids[:5] {
+		req, _ := http.NewRequest(http.MethodDelete, fmt.Sprintf("%s/tasks/%s", srv.URL, id), nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	waitFor(t, inState(task.Completed, 5))
+
+	cancel()
+	loops.Wait()
+
+	if len(f.Containers()) != len(ids)-5 {
+		t.Errorf("expected %d containers, got %d", len(ids)-5, len(f.Containers()))
+	}
+}
+
+func TestManagerTaskLogs(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	f := task.NewFake()
+	f.Script("server", task.FakeBehavior{Logs: []string{"starting", "listening"}})
+	w, addr := startWorker(t, f)
+	go w.RunTasks(ctx)
+
+	m := New([]string{addr}, "roundrobin", "memory")
+	api := Api{Manager: m}
+	srv := httptest.NewServer(api.Handler())
+	defer srv.Close()
+
+	tk := task.Task{ID: uuid.New(), Name: "web", Image: "server", State: task.Scheduled}
+	m.AddTask(task.TaskEvent{ID: uuid.New(), State: task.Running, Timestamp: time.Now(), Task: tk})
+	m.SendWork()
+	waitFor(t, func() bool { return len(f.Containers()) == 1 })
+	containerID := f.Containers()[0]
+
+	tests := []struct {
+		name  string
+		path  string
+		code  int
+		lines string
+	}{
+		{"all", fmt.Sprintf("/tasks/%s/logs", tk.ID), http.StatusOK, "starting\nlistening\n"},
+		{"tail", fmt.Sprintf("/tasks/%s/logs?tail=1", tk.ID), http.StatusOK, "listening\n"},
+		{"invalid tail", fmt.Sprintf("/tasks/%s/logs?tail=last", tk.ID), http.StatusBadRequest, ""},
+		{"unknown task", fmt.Sprintf("/tasks/%s/logs", uuid.New()), http.StatusNotFound, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := http.Get(srv.URL + tt.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+			if resp.StatusCode != tt.code {
+				t.Fatalf("GET %s returned %d: %s", tt.path, resp.StatusCode, body)
+			}
+			if tt.code == http.StatusOK && string(body) != tt.lines {
+				t.Errorf("logs = %q; want %q", body, tt.lines)
+			}
+		})
+	}
+
+	// Followed logs are streamed through the manager as they are written.
+	resp, err := http.Get(fmt.Sprintf("%s/tasks/%s/logs?follow=true&tail=0", srv.URL, tk.ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	lines := make(chan string)
+	go func() {
+		buf := make([]byte, 64)
+		n, _ := resp.Body.Read(buf)
+		lines <- string(buf[:n])
+	}()
+	f.Log(containerID, "request")
+	select {
+	case got := <-lines:
+		if got != "request\n" {
+			t.Errorf("followed logs = %q; want %q", got, "request\n")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for followed logs")
+	}
+}
+
+func TestManagerExecTask(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	f := task.NewFake()
+	w, addr := startWorker(t, f)
+	go w.RunTasks(ctx)
+
+	m := New([]string{addr}, "roundrobin", "memory")
+	api := Api{Manager: m}
+	srv := httptest.NewServer(api.Handler())
+	defer srv.Close()
+	managerAddr := strings.TrimPrefix(srv.URL, "http://")
+
+	tk := task.Task{ID: uuid.New(), Name: "web", Image: "server", State: task.Scheduled}
+	m.AddTask(task.TaskEvent{ID: uuid.New(), State: task.Running, Timestamp: time.Now(), Task: tk})
+	m.SendWork()
+	waitFor(t, func() bool { return len(f.Containers()) == 1 })
+
+	// The fake runtime's commands copy their stdin to stdout; the session is
+	// relayed both ways by the manager.
+	var stdout strings.Builder
+	req := worker.ExecRequest{Cmd: []string{"cat"}}
+	code, err := worker.ExecTask(ctx, managerAddr, tk.ID.String(), req, strings.NewReader("ping\n"), &stdout, io.Discard)
+	if err != nil || code != 0 || stdout.String() != "ping\n" {
+		t.Errorf("ExecTask() = %d, %v with output %q; want 0 with %q", code, err, stdout.String(), "ping\n")
+	}
+
+	if _, err := worker.ExecTask(ctx, managerAddr, uuid.New().String(), req, nil, io.Discard, io.Discard); err == nil {
+		t.Error("expected exec in an unknown task to fail")
+	}
+}
+
+func TestManagerTaskScheduling(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	wa, addrA := startWorker(t, task.NewFake())
+	go wa.RunTasks(ctx)
+	_, addrB := startWorker(t, task.NewFake())
+
+	m := New([]string{addrA, addrB}, "roundrobin", "memory")
+	if _, err := m.CordonWorker(addrB, true); err != nil {
+		t.Fatal(err)
+	}
+	api := Api{Manager: m}
+	srv := httptest.NewServer(api.Handler())
+	defer srv.Close()
+
+	placed := task.Task{ID: uuid.New(), Name: "web", Image: "server", State: task.Scheduled}
+	pinned := task.Task{ID: uuid.New(), Name: "build", Image: "server", State: task.Scheduled,
+		NodeSelector: task.LabelSelector{"pool": "build"}}
+	for _, tk := range []task.Task{placed, pinned} {
+		m.AddTask(task.TaskEvent{ID: uuid.New(), State: task.Running, Timestamp: time.Now(), Task: tk})
+		m.SendWork()
+	}
+
+	tests := []struct {
+		name   string
+		id     string
+		code   int
+		want   []NodeDecision
+		worker string
+	}{
+		{
+			name: "placed task",
+			id:   placed.ID.String(),
+			code: http.StatusOK,
+			want: []NodeDecision{
+				{Node: addrA, Candidate: true, Score: 0.1},
+				{Node: addrB, Reason: "node is cordoned"},
+			},
+			worker: addrA,
+		},
+		{
+			name: "task no worker can take",
+			id:   pinned.ID.String(),
+			code: http.StatusOK,
+			want: []NodeDecision{
+				{Node: addrA, Reason: "labels do not match node selector pool=build"},
+				{Node: addrB, Reason: "node is cordoned"},
+			},
+		},
+		{name: "unknown task", id: uuid.NewString(), code: http.StatusNotFound},
+		{name: "invalid task ID", id: "web", code: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := http.Get(fmt.Sprintf("%s/tasks/%s/scheduling", srv.URL, tt.id))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != tt.code {
+				t.Fatalf("GET returned %d; want %d", resp.StatusCode, tt.code)
+			}
+			if tt.code != http.StatusOK {
+				return
+			}
+
+			var attempts []SchedulingAttempt
+			if err := json.NewDecoder(resp.Body).Decode(&attempts); err != nil {
+				t.Fatal(err)
+			}
+			if len(attempts) != 1 {
+				t.Fatalf("got %d scheduling attempts; want 1", len(attempts))
+			}
+			a := attempts[0]
+			if a.Worker != tt.worker || (tt.worker == "") != (a.Error != "") {
+				t.Errorf("attempt placed the task on %q with error %q; want %q", a.Worker, a.Error, tt.worker)
+			}
+			if diff := cmp.Diff(tt.want, a.Nodes); diff != "" {
+				t.Errorf("node decisions mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+
+	// Attempts explain where a task runs, and are dropped once it is done.
+	waitFor(t, func() bool {
+		m.updateTasks()
+		return getTask(t, m, placed.ID).State == task.Running
+	})
+	if got := m.SchedulingAttempts(placed.ID); len(got) != 1 {
+		t.Errorf("%d scheduling attempts kept for a running task; want 1", len(got))
+	}
+	m.AddTask(task.TaskEvent{ID: uuid.New(), State: task.Completed, Timestamp: time.Now(), Task: *getTask(t, m, placed.ID)})
+	m.SendWork()
+	waitFor(t, func() bool {
+		m.updateTasks()
+		return getTask(t, m, placed.ID).State == task.Completed
+	})
+	if got := m.SchedulingAttempts(placed.ID); len(got) != 0 {
+		t.Errorf("%d scheduling attempts kept for a completed task; want none", len(got))
+	}
+	if got := m.SchedulingAttempts(pinned.ID); len(got) != 1 {
+		t.Errorf("%d scheduling attempts kept for an unplaced task; want 1", len(got))
+	}
+}
+
+func TestManagerStartTaskErrors(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	m := New(nil, "roundrobin", "memory")
+	srv := httptest.NewServer((&Api{Manager: m}).Handler())
+	defer srv.Close()
+
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		{"malformed body", `{"Task": `, "Error unmarshalling body"},
+		{"unknown field", `{"Task": {"Colour": "red"}}`, "Error unmarshalling body"},
+		{"invalid task", `{"Task": {"Name": "web", "Image": "server", "Tolerations": [{"Key": ""}]}}`, "Invalid task"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := http.Post(srv.URL+"/tasks", "application/json", strings.NewReader(tt.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			var e ErrResponse
+			json.NewDecoder(resp.Body).Decode(&e)
+			if resp.StatusCode != http.StatusBadRequest || !strings.HasPrefix(e.Message, tt.want) {
+				t.Errorf("POST /tasks returned %d %q; want 400 %q", resp.StatusCode, e.Message, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,49 @@
+package manager
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/MarouaneBouaricha/cube/scheduler"
+)
+
+// Config is the configuration of a manager, read from a JSON file.
+type Config struct {
+	// Scheduler configures the plugins of a scheduler framework, which
+	// replaces the scheduler the manager was created with.
+	Scheduler *scheduler.FrameworkConfig `json:",omitempty"`
+}
+
+// LoadConfig reads the manager configuration in the file at path.
+func LoadConfig(path string) (Config, error) {
+	var c Config
+	f, err := os.Open(path)
+	if err != nil {
+		return c, err
+	}
+	defer f.Close()
+
+	d := json.NewDecoder(f)
+	d.DisallowUnknownFields()
+	if err := d.Decode(&c); err != nil {
+		return c, fmt.Errorf("error reading config file %s: %v", path, err)
+	}
+	return c, nil
+}
+
+// Configure applies c to the manager.
+func (m *Manager) Configure(c Config) error {
+	if c.Scheduler == nil {
+		return nil
+	}
+	s, err := scheduler.NewFramework("framework", *c.Scheduler)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.Scheduler = s
+	return nil
+}
@@ -0,0 +1,46 @@
+package manager
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/MarouaneBouaricha/cube/scheduler"
+)
+
+func TestManagerConfigure(t *testing.T) {
+	tests := []struct {
+		name      string
+		config    string
+		wantErr   bool
+		framework bool
+	}{
+		{"empty", `{}`, false, false},
+		{"scheduler plugins", `{"Scheduler": {"Filters": ["resources", "taints"], "Scores": [{"Name": "binpack", "Weight": 2}]}}`, false, true},
+		{"default plugins", `{"Scheduler": {}}`, false, true},
+		{"unknown plugin", `{"Scheduler": {"Filters": ["gpu"]}}`, true, false},
+		{"unknown field", `{"Schedulers": {}}`, true, false},
+		{"invalid json", `{`, true, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "manager.json")
+			if err := os.WriteFile(path, []byte(tt.config), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			m := New(nil, "roundrobin", "memory")
+			c, err := LoadConfig(path)
+			if err == nil {
+				err = m.Configure(c)
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v; want error %v", err, tt.wantErr)
+			}
+			if _, ok := m.Scheduler.(*scheduler.Framework); ok != tt.framework {
+				t.Errorf("scheduler is %T; want framework %v", m.Scheduler, tt.framework)
+			}
+		})
+	}
+}
@@ -2,11 +2,15 @@ package manager
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"net/http/httputil"
+	"net/url"
 	"time"
 
+	"github.com/MarouaneBouaricha/cube/node"
 	"github.com/MarouaneBouaricha/cube/task"
 	"github.com/go-chi/chi/v5"
 	"github.com/google/uuid"
@@ -17,9 +21,13 @@ func (a *Api) StartTaskHandler(w http.ResponseWriter, r *http.Request) {
 	d.DisallowUnknownFields()
 
 	te := task.TaskEvent{}
-	err := d.Decode(&te)
-	if err != nil {
-		msg := fmt.Sprintf("Error unmarshalling body: %v\n", err)
+	var msg string
+	if err := d.Decode(&te); err != nil {
+		msg = fmt.Sprintf("Error unmarshalling body: %v\n", err)
+	} else if err := te.Task.Validate(); err != nil {
+		msg = fmt.Sprintf("Invalid task: %v\n", err)
+	}
+	if msg != "" {
 		log.Println(msg)
 		w.WriteHeader(400)
 		e := ErrResponse{
@@ -70,8 +78,193 @@ func (a *Api) StopTaskHandler(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(204)
 }
 
+// GetTaskSchedulingHandler returns the latest scheduling attempts of a
+// task, which tell why it was placed where it runs or why it could not be
+// placed.
+func (a *Api) GetTaskSchedulingHandler(w http.ResponseWriter, r *http.Request) {
+	fail := func(code int, msg string) {
+		log.Println(msg)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(ErrResponse{HTTPStatusCode: code, Message: msg})
+	}
+
+	tID, err := uuid.Parse(chi.URLParam(r, "taskID"))
+	if err != nil {
+		fail(400, fmt.Sprintf("Invalid task ID: %v", err))
+		return
+	}
+	// Tasks that could never be placed are not in TaskDb.
+	attempts := a.Manager.SchedulingAttempts(tID)
+	if _, err := a.Manager.TaskDb.Get(tID.String()); err != nil && len(attempts) == 0 {
+		fail(404, fmt.Sprintf("No task with ID %v found", tID))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	json.NewEncoder(w).Encode(attempts)
+}
+
 func (a *Api) GetNodesHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(200)
-	json.NewEncoder(w).Encode(a.Manager.WorkerNodes)
+	json.NewEncoder(w).Encode(a.Manager.GetNodes())
+}
+
+func (a *Api) RegisterNodeHandler(w http.ResponseWriter, r *http.Request) {
+	d := json.NewDecoder(r.Body)
+	d.DisallowUnknownFields()
+
+	reg := node.Registration{}
+	err := d.Decode(&reg)
+	if err == nil && reg.Address == "" {
+		err = errors.New("missing worker address")
+	}
+	if err != nil {
+		msg := fmt.Sprintf("Error unmarshalling body: %v\n", err)
+		log.Println(msg)
+		w.WriteHeader(400)
+		e := ErrResponse{
+			HTTPStatusCode: 400,
+			Message:        msg,
+		}
+		json.NewEncoder(w).Encode(e)
+		return
+	}
+
+	n, created, err := a.Manager.RegisterWorker(reg)
+	if err != nil {
+		log.Printf("%v\n", err)
+		w.WriteHeader(410)
+		json.NewEncoder(w).Encode(ErrResponse{HTTPStatusCode: 410, Message: err.Error()})
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if created {
+		w.WriteHeader(201)
+	} else {
+		w.WriteHeader(200)
+	}
+	json.NewEncoder(w).Encode(n)
+}
+
+func (a *Api) DeregisterNodeHandler(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+	err := a.Manager.DeregisterWorker(name)
+	if err != nil {
+		log.Printf("%v\n", err)
+		w.WriteHeader(404)
+		return
+	}
+
+	log.Printf("Deregistered worker %v\n", name)
+	w.WriteHeader(204)
+}
+
+func (a *Api) CordonNodeHandler(w http.ResponseWriter, r *http.Request) {
+	a.setCordoned(w, r, true)
+}
+
+func (a *Api) UncordonNodeHandler(w http.ResponseWriter, r *http.Request) {
+	a.setCordoned(w, r, false)
+}
+
+func (a *Api) setCordoned(w http.ResponseWriter, r *http.Request, cordoned bool) {
+	name := chi.URLParam(r, "name")
+	n, err := a.Manager.CordonWorker(name, cordoned)
+	if err != nil {
+		log.Printf("%v\n", err)
+		w.WriteHeader(404)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	json.NewEncoder(w).Encode(n)
+}
+
+func (a *Api) DrainNodeHandler(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+	timeout := DefaultDrainTimeout
+	if v := r.URL.Query().Get("timeout"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			msg := fmt.Sprintf("Invalid timeout %q: %v\n", v, err)
+			log.Println(msg)
+			w.WriteHeader(400)
+			json.NewEncoder(w).Encode(ErrResponse{HTTPStatusCode: 400, Message: msg})
+			return
+		}
+		timeout = d
+	}
+
+	err := a.Manager.DrainWorker(name, timeout)
+	switch {
+	case errors.Is(err, ErrNodeNotFound):
+		log.Printf("%v\n", err)
+		w.WriteHeader(404)
+	case err != nil:
+		log.Printf("%v\n", err)
+		w.WriteHeader(504)
+		json.NewEncoder(w).Encode(ErrResponse{HTTPStatusCode: 504, Message: err.Error()})
+	default:
+		log.Printf("Drained worker %v\n", name)
+		w.WriteHeader(204)
+	}
+}
+
+func (a *Api) GetStatsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	json.NewEncoder(w).Encode(a.Manager.GetSchedulingStats())
+}
+
+// GetTaskLogsHandler streams the logs of a task from the worker it is
+// assigned to.
+func (a *Api) GetTaskLogsHandler(w http.ResponseWriter, r *http.Request) {
+	a.proxyToWorker(w, r)
+}
+
+// ExecTaskHandler runs a command in a task's container on the worker it is
+// assigned to. The upgraded connection is relayed between the client and
+// the worker.
+func (a *Api) ExecTaskHandler(w http.ResponseWriter, r *http.Request) {
+	a.proxyToWorker(w, r)
+}
+
+// proxyToWorker forwards the request as is to the worker the task in its
+// path is assigned to, streaming the response back.
+func (a *Api) proxyToWorker(w http.ResponseWriter, r *http.Request) {
+	fail := func(code int, msg string) {
+		log.Println(msg)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(ErrResponse{HTTPStatusCode: code, Message: msg})
+	}
+
+	tID, err := uuid.Parse(chi.URLParam(r, "taskID"))
+	if err != nil {
+		fail(400, fmt.Sprintf("Invalid task ID: %v", err))
+		return
+	}
+	if _, err := a.Manager.TaskDb.Get(tID.String()); err != nil {
+		fail(404, fmt.Sprintf("No task with ID %v found", tID))
+		return
+	}
+	worker, ok := a.Manager.workerFor(tID)
+	if !ok {
+		fail(409, fmt.Sprintf("Task %v is not assigned to a worker", tID))
+		return
+	}
+
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(&url.URL{Scheme: "http", Host: worker})
+		},
+		ErrorHandler: func(_ http.ResponseWriter, _ *http.Request, err error) {
+			fail(502, fmt.Sprintf("Error forwarding request to worker %v: %v", worker, err))
+		},
+	}
+	proxy.ServeHTTP(w, r)
 }
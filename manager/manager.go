@@ -2,12 +2,13 @@ package manager
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
 	"net/http"
-	"strings"
+	"sync"
 	"time"
 
 	"github.com/MarouaneBouaricha/cube/node"
@@ -15,21 +16,89 @@ import (
 	"github.com/MarouaneBouaricha/cube/store"
 	"github.com/MarouaneBouaricha/cube/task"
 	"github.com/MarouaneBouaricha/cube/worker"
-	"github.com/docker/go-connections/nat"
-	"github.com/golang-collections/collections/queue"
 	"github.com/google/uuid"
 )
 
+const (
+	// DefaultDispatchers is the number of task events the manager sends to
+	// workers concurrently unless configured otherwise.
+	DefaultDispatchers = 4
+	// DefaultUpdateInterval is how often the manager polls workers for
+	// task updates.
+	DefaultUpdateInterval = 15 * time.Second
+	// DefaultStatsInterval is how often the manager collects node stats.
+	DefaultStatsInterval = 15 * time.Second
+	// DefaultHealthCheckInterval is how often the manager acts on the
+	// health of running tasks reported by workers.
+	DefaultHealthCheckInterval = 10 * time.Second
+)
+
 type Manager struct {
-	Pending       queue.Queue
-	TaskDb        store.Store
-	EventDb       store.Store
+	Pending PendingQueue
+	TaskDb  store.Store
+	EventDb store.Store
+	// PendingDb holds the events that are in Pending, so that they survive
+	// a restart of the manager.
+	PendingDb     store.Store
 	Workers       []string
 	WorkerTaskMap map[string][]uuid.UUID
 	TaskWorkerMap map[uuid.UUID]string
 	LastWorker    int
 	WorkerNodes   []*node.Node
 	Scheduler     scheduler.Scheduler
+	// Dispatchers is the number of task events ProcessTasks sends to
+	// workers concurrently.
+	Dispatchers         int
+	UpdateInterval      time.Duration
+	StatsInterval       time.Duration
+	HealthCheckInterval time.Duration
+	// MaxMissedHeartbeats is the number of consecutive failed checks after
+	// which a worker is marked unhealthy and its tasks are rescheduled.
+	MaxMissedHeartbeats int
+	// RestartInterval is how often RestartTasks looks for tasks to restart.
+	RestartInterval time.Duration
+	// MaxRetries and RestartBackoff apply to tasks that do not set their
+	// own.
+	MaxRetries     int
+	RestartBackoff time.Duration
+	// PendingBackoff is the delay before an event that could not be sent,
+	// for lack of a worker with room for its task or because the worker
+	// could not be reached, is retried. It doubles with every further
+	// retry.
+	PendingBackoff time.Duration
+	// PendingTimeout is how long an event is retried before its task is
+	// marked Failed. Zero or less retries it forever.
+	PendingTimeout time.Duration
+	// Preemption lets a task no worker has room for stop tasks of a lower
+	// priority to take their place.
+	Preemption bool
+
+	// mu guards Workers, WorkerTaskMap, TaskWorkerMap, WorkerNodes,
+	// allocations, attempts and deregistered, including the fields of the nodes
+	// themselves. It is held for writing while the Scheduler runs, since
+	// schedulers keep state between calls.
+	mu sync.RWMutex
+	// taskMu serializes read-modify-write cycles on TaskDb.
+	taskMu sync.Mutex
+	// pendingMu guards Pending, enqueuedAt, backoff and retries.
+	pendingMu sync.Mutex
+	// enqueuedAt records when each pending event was added, to measure
+	// scheduling latency and to time out events that cannot be sent.
+	enqueuedAt map[uuid.UUID]time.Time
+	// backoff holds the pending events waiting to be sent again.
+	backoff []backoffEvent
+	// retries counts the retries of each pending event.
+	retries map[uuid.UUID]int
+	// allocations records what each assigned task holds on its worker.
+	allocations map[uuid.UUID]allocation
+	// attempts holds the latest scheduling attempts of each task.
+	attempts map[uuid.UUID][]SchedulingAttempt
+	// deregistered holds the boot ID of each deregistered worker, by
+	// address, to keep it from registering again until it restarts.
+	deregistered map[string]string
+	// queued is signalled by AddTask to wake up ProcessTasks.
+	queued chan struct{}
+	stats  schedulingStats
 }
 
 func New(workers []string, schedulerType string, dbType string) *Manager {
@@ -51,164 +120,392 @@ func New(workers []string, schedulerType string, dbType string) *Manager {
 		s = &scheduler.Epvm{Name: "epvm"}
 	case "roundrobin":
 		s = &scheduler.RoundRobin{Name: "roundrobin"}
+	case "binpack":
+		s = &scheduler.BinPack{Name: "binpack"}
+	case "spread":
+		s = &scheduler.Spread{Name: "spread"}
+	case "framework":
+		f, err := scheduler.NewFramework("framework", scheduler.FrameworkConfig{})
+		if err != nil {
+			log.Printf("unable to create scheduler framework, falling back to epvm: %v", err)
+			s = &scheduler.Epvm{Name: "epvm"}
+			break
+		}
+		s = f
 	default:
 		s = &scheduler.Epvm{Name: "epvm"}
 	}
 
 	m := Manager{
-		Pending:       *queue.New(),
-		Workers:       workers,
-		WorkerTaskMap: workerTaskMap,
-		TaskWorkerMap: taskWorkerMap,
-		WorkerNodes:   nodes,
-		Scheduler:     s,
+		Workers:             workers,
+		WorkerTaskMap:       workerTaskMap,
+		TaskWorkerMap:       taskWorkerMap,
+		WorkerNodes:         nodes,
+		Scheduler:           s,
+		Dispatchers:         DefaultDispatchers,
+		UpdateInterval:      DefaultUpdateInterval,
+		StatsInterval:       DefaultStatsInterval,
+		HealthCheckInterval: DefaultHealthCheckInterval,
+		MaxMissedHeartbeats: DefaultMaxMissedHeartbeats,
+		RestartInterval:     DefaultRestartInterval,
+		MaxRetries:          DefaultMaxRetries,
+		RestartBackoff:      DefaultRestartBackoff,
+		PendingBackoff:      DefaultPendingBackoff,
+		PendingTimeout:      DefaultPendingTimeout,
+		enqueuedAt:          make(map[uuid.UUID]time.Time),
+		retries:             make(map[uuid.UUID]int),
+		allocations:         make(map[uuid.UUID]allocation),
+		attempts:            make(map[uuid.UUID][]SchedulingAttempt),
+		deregistered:        make(map[string]string),
+		queued:              make(chan struct{}, 1),
 	}
 
 	var ts store.Store
 	var es store.Store
-	var err error
+	var ps store.Store
 	switch dbType {
 	case "memory":
 		ts = store.NewInMemoryTaskStore()
 		es = store.NewInMemoryTaskEventStore()
+		ps = store.NewInMemoryTaskEventStore()
 	case "persistent":
+		var err error
 		ts, err = store.NewTaskStore("tasks.db", 0600, "tasks")
+		if err != nil {
+			log.Fatalf("unable to create task store: %v", err)
+		}
 		es, err = store.NewEventStore("events.db", 0600, "events")
-	}
-
-	if err != nil {
-		log.Fatalf("unable to create task store: %v", err)
-	}
-
-	if err != nil {
-		log.Fatalf("unable to create task event store: %v", err)
+		if err != nil {
+			log.Fatalf("unable to create task event store: %v", err)
+		}
+		ps, err = store.NewEventStore("pending.db", 0600, "pending")
+		if err != nil {
+			log.Fatalf("unable to create pending event store: %v", err)
+		}
 	}
 
 	m.TaskDb = ts
 	m.EventDb = es
+	m.PendingDb = ps
 	return &m
 }
 
+// Close closes the manager's stores.
+func (m *Manager) Close() {
+	for _, s := range []store.Store{m.TaskDb, m.EventDb, m.PendingDb} {
+		if c, ok := s.(interface{ Close() }); ok {
+			c.Close()
+		}
+	}
+}
+
 func (m *Manager) SelectWorker(t task.Task) (*node.Node, error) {
-	candidates := m.Scheduler.SelectCandidateNodes(t, m.WorkerNodes)
-	if candidates == nil {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.selectWorkerLocked(t)
+}
+
+// selectWorkerLocked runs the scheduler for t, recording the attempt. The
+// caller must hold m.mu.
+func (m *Manager) selectWorkerLocked(t task.Task) (*node.Node, error) {
+	candidates := m.Scheduler.SelectCandidateNodes(t, m.availableNodes())
+	attempt := m.newSchedulingAttempt(t, candidates)
+	defer m.recordSchedulingAttemptLocked(t.ID, attempt)
+
+	if len(candidates) == 0 {
 		msg := fmt.Sprintf("No available candidates match resource request for task %v", t.ID)
 		err := errors.New(msg)
+		attempt.Error = err.Error()
 		return nil, err
 	}
 	scores := m.Scheduler.Score(t, candidates)
 	if scores == nil {
-		return nil, fmt.Errorf("no scores returned to task %v", t)
+		err := fmt.Errorf("no scores returned to task %v", t.ID)
+		attempt.Error = err.Error()
+		return nil, err
+	}
+	for i, d := range attempt.Nodes {
+		if d.Candidate {
+			attempt.Nodes[i].Score = scores[d.Node]
+		}
 	}
 	selectedNode := m.Scheduler.Pick(scores, candidates)
+	attempt.Worker = selectedNode.Name
 
 	return selectedNode, nil
 }
 
-func (m *Manager) UpdateTasks() {
+// workerFor returns the worker a task has been assigned to.
+func (m *Manager) workerFor(id uuid.UUID) (string, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	w, ok := m.TaskWorkerMap[id]
+	return w, ok
+}
+
+func (m *Manager) assign(t *task.Task, worker string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.assignLocked(t, worker)
+}
+
+// assignLocked assigns t to worker, allocating what t holds there. The
+// caller must hold m.mu.
+func (m *Manager) assignLocked(t *task.Task, worker string) {
+	m.WorkerTaskMap[worker] = append(m.WorkerTaskMap[worker], t.ID)
+	m.TaskWorkerMap[t.ID] = worker
+	if m.holdsResources(t) {
+		m.allocateLocked(t, worker)
+	}
+}
+
+func (m *Manager) workers() []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return append([]string(nil), m.Workers...)
+}
+
+// GetNodes returns a snapshot of the worker nodes.
+func (m *Manager) GetNodes() []node.Node {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	nodes := make([]node.Node, 0, len(m.WorkerNodes))
+	for _, n := range m.WorkerNodes {
+		nodes = append(nodes, *n)
+	}
+	return nodes
+}
+
+// updateTask applies f to the stored task with the given ID and saves it,
+// unless f returns an error.
+func (m *Manager) updateTask(id uuid.UUID, f func(t *task.Task) error) (*task.Task, error) {
+	m.taskMu.Lock()
+	defer m.taskMu.Unlock()
+
+	result, err := m.TaskDb.Get(id.String())
+	if err != nil {
+		return nil, err
+	}
+	t, ok := result.(*task.Task)
+	if !ok {
+		return nil, fmt.Errorf("cannot convert result %v to task.Task type", result)
+	}
+	if err := f(t); err != nil {
+		return nil, err
+	}
+	if err := m.TaskDb.Put(id.String(), t); err != nil {
+		return nil, err
+	}
+	m.syncAllocation(t)
+	m.forgetSchedulingAttempts(t)
+	return t, nil
+}
+
+func (m *Manager) UpdateTasks(ctx context.Context) {
+	ticker := time.NewTicker(m.UpdateInterval)
+	defer ticker.Stop()
 	for {
 		log.Println("Checking for task updates from workers")
 		m.updateTasks()
 		log.Println("Task updates completed")
-		log.Println("Sleeping for 15 seconds")
-		time.Sleep(15 * time.Second)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
 	}
 }
 
 func (m *Manager) updateTasks() {
-	for _, worker := range m.Workers {
+	for _, worker := range m.workers() {
 		log.Printf("Checking worker %v for task updates", worker)
-		url := fmt.Sprintf("http://%s/tasks", worker)
-		resp, err := http.Get(url)
+		tasks, err := getWorkerTasks(worker)
 		if err != nil {
-			log.Printf("[manager] Error connecting to %v: %v", worker, err)
-			continue
-		}
-
-		if resp.StatusCode != http.StatusOK {
-			log.Printf("[manager] Error sending request: %v", err)
+			log.Printf("[manager] %v", err)
+			m.missedHeartbeat(worker)
 			continue
 		}
-
-		d := json.NewDecoder(resp.Body)
-		var tasks []*task.Task
-		err = d.Decode(&tasks)
-		if err != nil {
-			log.Printf("[manager] Error unmarshalling tasks: %s", err.Error())
-		}
+		m.heartbeat(worker)
 
 		for _, t := range tasks {
 			log.Printf("[manager] Attempting to update task %v", t.ID)
 
-			result, err := m.TaskDb.Get(t.ID.String())
-			if err != nil {
-				log.Printf("[manager] %s\n", err)
-				continue
-			}
-			taskPersisted, ok := result.(*task.Task)
-			if !ok {
-				log.Printf("cannot convert result %v to task.Task type\n", result)
+			// A task that was rescheduled while its worker was unreachable
+			// is still running there; stop that copy.
+			if assigned, ok := m.workerFor(t.ID); ok && assigned != worker {
+				if t.State == task.Running {
+					log.Printf("[manager] task %s was moved to %s, stopping it on %s", t.ID, assigned, worker)
+					m.stopTask(worker, t.ID.String())
+				}
 				continue
 			}
 
-			if taskPersisted.State != t.State {
-				taskPersisted.State = t.State
+			_, err := m.updateTask(t.ID, func(taskPersisted *task.Task) error {
+				return mergeWorkerTask(taskPersisted, t)
+			})
+			// Stale reports are expected while the worker catches up.
+			if err != nil && !errors.Is(err, task.ErrInvalidTransition) {
+				log.Printf("[manager] %s\n", err)
 			}
+		}
+	}
+}
 
-			taskPersisted.StartTime = t.StartTime
-			taskPersisted.FinishTime = t.FinishTime
-			taskPersisted.ContainerID = t.ContainerID
-			taskPersisted.HostPorts = t.HostPorts
+// getWorkerTasks returns the tasks known to worker.
+func getWorkerTasks(worker string) ([]*task.Task, error) {
+	url := fmt.Sprintf("http://%s/tasks", worker)
+	resp, err := http.Get(url)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to %v: %v", worker, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error getting tasks from %v: %s", worker, resp.Status)
+	}
 
-			m.TaskDb.Put(taskPersisted.ID.String(), taskPersisted)
+	var tasks []*task.Task
+	err = json.NewDecoder(resp.Body).Decode(&tasks)
+	if err != nil {
+		return nil, fmt.Errorf("error unmarshalling tasks: %v", err)
+	}
+	return tasks, nil
+}
+
+// mergeWorkerTask copies the fields a worker is authoritative for from t. A
+// report the state of taskPersisted cannot move to is stale, for instance
+// a task reported running after it was asked to stop, and is ignored.
+func mergeWorkerTask(taskPersisted *task.Task, t *task.Task) error {
+	// Until the worker replaces the container of a restarting task, it
+	// still reports how the old one ended.
+	if taskPersisted.State == task.Restarting && t.ContainerID != "" && t.ContainerID == taskPersisted.ContainerID {
+		return fmt.Errorf("%w: task %s has not been restarted yet", task.ErrInvalidTransition, t.ID)
+	}
+	if taskPersisted.State != t.State {
+		if err := taskPersisted.Transition(t.State); err != nil {
+			return err
 		}
 	}
+
+	taskPersisted.StartTime = t.StartTime
+	taskPersisted.FinishTime = t.FinishTime
+	taskPersisted.ContainerID = t.ContainerID
+	taskPersisted.HostPorts = t.HostPorts
+	taskPersisted.HealthStatus = t.HealthStatus
+	taskPersisted.Usage = t.Usage
+	return nil
 }
 
-func (m *Manager) UpdateNodeStats() {
+func (m *Manager) UpdateNodeStats(ctx context.Context) {
+	ticker := time.NewTicker(m.StatsInterval)
+	defer ticker.Stop()
 	for {
-		for _, node := range m.WorkerNodes {
-			log.Printf("Collecting stats for node %v", node.Name)
-			_, err := node.GetStats()
-			if err != nil {
-				log.Printf("error updating node stats: %v", err)
-			}
+		m.updateNodeStats()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (m *Manager) updateNodeStats() {
+	m.mu.RLock()
+	nodes := append([]*node.Node(nil), m.WorkerNodes...)
+	m.mu.RUnlock()
+
+	for _, n := range nodes {
+		log.Printf("Collecting stats for node %v", n.Name)
+
+		// Fetch the stats on a copy so the lock is not held during the
+		// request.
+		m.mu.RLock()
+		c := *n
+		m.mu.RUnlock()
+		_, err := c.GetStats()
+		if err != nil {
+			// Heartbeats are only counted by updateTasks.
+			log.Printf("error updating node stats: %v", err)
+			continue
 		}
-		time.Sleep(15 * time.Second)
+
+		m.mu.Lock()
+		grown := c.Cpus > n.Cpus || c.Memory > n.Memory || c.Disk > n.Disk
+		n.Memory = c.Memory
+		n.Disk = c.Disk
+		n.Cpus = c.Cpus
+		n.CpuUsage = c.CpuUsage
+		n.Labels = c.Labels
+		n.Taints = c.Taints
+		n.Stats = c.Stats
+		if grown {
+			// Nodes have no capacity until their stats are first collected.
+			m.capacityChanged()
+		}
+		m.mu.Unlock()
 	}
 }
 
-func (m *Manager) DoHealthChecks() {
+func (m *Manager) DoHealthChecks(ctx context.Context) {
+	ticker := time.NewTicker(m.HealthCheckInterval)
+	defer ticker.Stop()
 	for {
 		log.Println("Performing task health check")
 		m.doHealthChecks()
 		log.Println("Task health checks completed")
-		log.Println("Sleeping for 60 seconds")
-		time.Sleep(60 * time.Second)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
 	}
 }
 
+// doHealthChecks restarts running tasks that workers report unhealthy, as
+// their restart policy allows. Tasks that exited are restarted by
+// RestartTasks.
 func (m *Manager) doHealthChecks() {
 	tasks := m.GetTasks()
 	for _, t := range tasks {
-		if t.State == task.Running && t.RestartCount < 3 {
-			err := m.checkTaskHealth(*t)
-			if err != nil {
-				if t.RestartCount < 3 {
-					m.restartTask(t)
-				}
-			}
-		} else if t.State == task.Failed && t.RestartCount < 3 {
-			m.restartTask(t)
+		if t.State != task.Running || t.HealthStatus.Status != task.HealthUnhealthy {
+			continue
+		}
+		if t.RestartPolicy == task.RestartNever || m.retriesExhausted(t) {
+			log.Printf("[manager] not restarting unhealthy task %s (policy %s, %d restarts)\n", t.ID, t.RestartPolicy, t.RestartCount)
+			continue
 		}
+		m.restartTask(t)
 	}
 }
 
+// restartTask restarts t where it ran, or on another worker if its worker
+// is gone or unhealthy.
 func (m *Manager) restartTask(t *task.Task) {
-	w := m.TaskWorkerMap[t.ID]
-	t.State = task.Scheduled
-	t.RestartCount++
-	m.TaskDb.Put(t.ID.String(), t)
+	w, _ := m.workerFor(t.ID)
+	healthy := m.isHealthy(w)
+	t, err := m.updateTask(t.ID, func(t *task.Task) error {
+		t.RestartCount++
+		t.HealthStatus = task.HealthStatus{}
+		if err := t.Transition(task.Restarting); err != nil || healthy {
+			return err
+		}
+		t.Worker = ""
+		t.ContainerID = ""
+		t.HostPorts = nil
+		return t.Transition(task.Scheduled)
+	})
+	if err != nil {
+		log.Printf("[manager] unable to restart task: %v\n", err)
+		return
+	}
+	if !healthy {
+		log.Printf("[manager] worker %s of task %s is unhealthy, rescheduling it\n", w, t.ID)
+		m.placeAgain(t)
+		return
+	}
 
 	te := task.TaskEvent{
 		ID:        uuid.New(),
@@ -224,76 +521,133 @@ func (m *Manager) restartTask(t *task.Task) {
 	url := fmt.Sprintf("http://%s/tasks", w)
 	resp, err := http.Post(url, "application/json", bytes.NewBuffer(data))
 	if err != nil {
-		log.Printf("[manager] Error connecting to %v: %v", w, err)
-		m.Pending.Enqueue(t)
+		log.Printf("[manager] Error connecting to %v: %v, rescheduling task %s", w, err, t.ID)
+		m.rescheduleTask(t.ID)
 		return
 	}
+	defer resp.Body.Close()
 
 	d := json.NewDecoder(resp.Body)
 	if resp.StatusCode != http.StatusCreated {
 		e := worker.ErrResponse{}
-		err := d.Decode(&e)
-		if err != nil {
-			fmt.Printf("Error decoding response: %s\n", err.Error())
-			return
+		if err := d.Decode(&e); err != nil {
+			e.Message = resp.Status
 		}
-		log.Printf("Response error (%d): %s", e.HTTPStatusCode, e.Message)
+		log.Printf("Response error (%d): %s\n", resp.StatusCode, e.Message)
+		m.failRestart(t.ID, fmt.Sprintf("restart rejected by worker %s: %s", w, e.Message))
 		return
 	}
 
 	newTask := task.Task{}
 	err = d.Decode(&newTask)
 	if err != nil {
-		fmt.Printf("Error decoding response: %s\n", err.Error())
+		log.Printf("Error decoding response: %s\n", err.Error())
 		return
 	}
 	log.Printf("[manager] response from worker: %#v\n", t)
 }
 
-func getHostPort(ports nat.PortMap) *string {
-	for k, _ := range ports {
-		return &ports[k][0].HostPort
+// failRestart marks the task with the given ID, whose worker did not take
+// its restart, as Failed with reason. Its restart policy then decides
+// whether it is restarted again after a backoff.
+func (m *Manager) failRestart(id uuid.UUID, reason string) {
+	_, err := m.updateTask(id, func(t *task.Task) error {
+		if err := t.Transition(task.Failed); err != nil {
+			return err
+		}
+		t.Error = reason
+		t.FinishTime = time.Now().UTC()
+		return nil
+	})
+	if err != nil {
+		log.Printf("[manager] unable to fail task %s: %v\n", id, err)
+		return
 	}
-	return nil
+	log.Printf("[manager] task %s failed: %s\n", id, reason)
 }
 
-func (m *Manager) checkTaskHealth(t task.Task) error {
-	log.Printf("Calling health check for task %s: %s\n", t.ID, t.HealthCheck)
-
-	w := m.TaskWorkerMap[t.ID]
-	hostPort := getHostPort(t.HostPorts)
-	worker := strings.Split(w, ":")
-	if hostPort == nil {
-		log.Printf("Have not collected task %s host port yet. Skipping.\n", t.ID)
-		return nil
-	}
-	url := fmt.Sprintf("http://%s:%s%s", worker[0], *hostPort, t.HealthCheck)
-	log.Printf("Calling health check for task %s: %s\n", t.ID, url)
-	resp, err := http.Get(url)
-	if err != nil {
-		msg := fmt.Sprintf("[manager] Error connecting to health check %s", url)
-		log.Println(msg)
-		return errors.New(msg)
+// ProcessTasks sends pending task events to workers as soon as they are
+// added, or once their backoff is over if they could not be sent, using up
+// to m.Dispatchers goroutines. Events for the same task are always sent by
+// the same dispatcher so that workers receive them in order. ProcessTasks
+// returns once ctx is cancelled and in-flight events are sent.
+func (m *Manager) ProcessTasks(ctx context.Context) {
+	n := m.Dispatchers
+	if n < 1 {
+		n = 1
 	}
 
-	if resp.StatusCode != http.StatusOK {
-		msg := fmt.Sprintf("Error health check for task %s did not return 200\n", t.ID)
-		log.Println(msg)
-		return errors.New(msg)
+	var wg sync.WaitGroup
+	dispatchers := make([]chan task.TaskEvent, n)
+	for i := range dispatchers {
+		dispatchers[i] = make(chan task.TaskEvent, 16)
+		wg.Add(1)
+		go func(events <-chan task.TaskEvent) {
+			defer wg.Done()
+			for te := range events {
+				m.sendWork(te)
+			}
+		}(dispatchers[i])
 	}
+	defer func() {
+		for _, d := range dispatchers {
+			close(d)
+		}
+		wg.Wait()
+	}()
 
-	log.Printf("Task %s health check response: %v\n", t.ID, resp.StatusCode)
+	for {
+		for te, ok := m.nextEvent(); ok; te, ok = m.nextEvent() {
+			select {
+			case dispatchers[dispatcherFor(te.Task, n)] <- te:
+			case <-ctx.Done():
+				log.Printf("[manager] Shutting down, leaving event %v pending\n", te.ID)
+				m.requeue(te)
+				return
+			}
+		}
 
-	return nil
+		// Events waiting for a backoff are sent once it is over, unless a
+		// change of capacity ends it sooner.
+		var retry <-chan time.Time
+		var timer *time.Timer
+		if d, ok := m.nextRetry(); ok {
+			timer = time.NewTimer(d)
+			retry = timer.C
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-m.queued:
+		case <-retry:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
 }
 
-func (m *Manager) ProcessTasks() {
-	for {
-		log.Println("Processing any tasks in the queue")
-		m.SendWork()
-		log.Println("Sleeping for 10 seconds")
-		time.Sleep(10 * time.Second)
+func dispatcherFor(t task.Task, n int) int {
+	sum := 0
+	for _, b := range t.ID {
+		sum += int(b)
 	}
+	return sum % n
+}
+
+func (m *Manager) nextEvent() (task.TaskEvent, bool) {
+	m.pendingMu.Lock()
+	defer m.pendingMu.Unlock()
+	m.promoteDueLocked(time.Now())
+	return m.Pending.Dequeue()
+}
+
+// requeue puts an event back on the pending queue without resetting the
+// time it was first added.
+func (m *Manager) requeue(te task.TaskEvent) {
+	m.pendingMu.Lock()
+	defer m.pendingMu.Unlock()
+	m.Pending.Enqueue(te)
 }
 
 func (m *Manager) stopTask(worker string, taskID string) {
@@ -319,89 +673,136 @@ func (m *Manager) stopTask(worker string, taskID string) {
 	log.Printf("task %s has been scheduled to be stopped", taskID)
 }
 
+// SendWork sends the next pending task event, if any, to a worker.
 func (m *Manager) SendWork() {
-	if m.Pending.Len() > 0 {
-		e := m.Pending.Dequeue()
-		te := e.(task.TaskEvent)
-		err := m.EventDb.Put(te.ID.String(), &te)
+	if te, ok := m.nextEvent(); ok {
+		m.sendWork(te)
+	} else {
+		log.Println("No work in the queue")
+	}
+}
+
+func (m *Manager) sendWork(te task.TaskEvent) {
+	err := m.EventDb.Put(te.ID.String(), &te)
+	if err != nil {
+		log.Printf("error attempting to store task event %s: %s\n", te.ID.String(), err)
+	}
+	log.Printf("Pulled %v off pending queue\n", te)
+
+	taskWorker, ok := m.workerFor(te.Task.ID)
+	if ok {
+		result, err := m.TaskDb.Get(te.Task.ID.String())
 		if err != nil {
-			log.Printf("error attempting to store task event %s: %s\n", te.ID.String(), err)
+			log.Printf("unable to schedule task: %s\n", err)
+			m.dispatched(te, false)
+			return
 		}
-		log.Printf("Pulled %v off pending queue\n", te)
 
-		taskWorker, ok := m.TaskWorkerMap[te.Task.ID]
-		if ok {
-			result, err := m.TaskDb.Get(te.Task.ID.String())
-			if err != nil {
-				log.Printf("unable to schedule task: %s\n", err)
-				return
-			}
-
-			persistedTask, ok := result.(*task.Task)
-			if !ok {
-				log.Printf("unable to convert task to task.Task type\n")
-				return
-			}
+		persistedTask, ok := result.(*task.Task)
+		if !ok {
+			log.Printf("unable to convert task to task.Task type\n")
+			m.dispatched(te, false)
+			return
+		}
 
-			if te.State == task.Completed && task.ValidStateTransition(persistedTask.State, te.State) {
-				m.stopTask(taskWorker, te.Task.ID.String())
+		if te.State == task.Completed {
+			_, err := m.updateTask(persistedTask.ID, func(t *task.Task) error {
+				return t.Transition(task.Stopping)
+			})
+			if err != nil {
+				log.Printf("invalid request: %v\n", err)
+				m.dispatched(te, false)
 				return
 			}
-
-			log.Printf("invalid request: existing task %s is in state %v and cannot transition to the completed state\n", persistedTask.ID.String(), persistedTask.State)
+			m.stopTask(taskWorker, te.Task.ID.String())
+			m.dispatched(te, true)
 			return
 		}
 
-		t := te.Task
-		w, err := m.SelectWorker(t)
-		if err != nil {
-			log.Printf("error selecting worker for task %s: %v\n", t.ID, err)
-			return
-		}
+		log.Printf("invalid request: existing task %s is in state %v and cannot transition to the completed state\n", persistedTask.ID.String(), persistedTask.State)
+		m.dispatched(te, false)
+		return
+	}
 
-		log.Printf("[manager] selected worker %s for task %s\n", w.Name, t.ID)
+	if te.State == task.Completed {
+		log.Printf("invalid request: task %s is not running on any worker\n", te.Task.ID)
+		m.cancelRetries(te.Task.ID)
+		m.dispatched(te, false)
+		return
+	}
+	if result, err := m.TaskDb.Get(te.Task.ID.String()); err == nil && !task.ValidStateTransition(result.(*task.Task).State, task.Scheduled) {
+		log.Printf("invalid request: task %s is %v and cannot be scheduled again\n", te.Task.ID, result.(*task.Task).State)
+		m.dispatched(te, false)
+		return
+	}
 
-		m.WorkerTaskMap[w.Name] = append(m.WorkerTaskMap[w.Name], te.Task.ID)
-		m.TaskWorkerMap[t.ID] = w.Name
+	t := te.Task
+	t.State = task.Scheduled
+	w, err := m.placeTask(&t)
+	if err != nil && m.Preemption {
+		w, err = m.placeByPreemption(&t, err)
+	}
+	if err != nil {
+		log.Printf("error selecting worker for task %s: %v\n", t.ID, err)
+		m.retryLater(te, err)
+		return
+	}
 
-		t.State = task.Scheduled
-		m.TaskDb.Put(t.ID.String(), &t)
+	log.Printf("[manager] selected worker %s for task %s\n", w.Name, t.ID)
 
-		data, err := json.Marshal(te)
-		if err != nil {
-			log.Printf("Unable to marshal task object: %v.\n", t)
-		}
+	t.Worker = w.Name
+	m.taskMu.Lock()
+	m.TaskDb.Put(t.ID.String(), &t)
+	m.taskMu.Unlock()
+	te.Task = t
 
-		url := fmt.Sprintf("http://%s/tasks", w.Name)
-		resp, err := http.Post(url, "application/json", bytes.NewBuffer(data))
-		if err != nil {
-			log.Printf("[manager] Error connecting to %v: %v\n", w, err)
-			m.Pending.Enqueue(t)
-			return
-		}
+	data, err := json.Marshal(te)
+	if err != nil {
+		log.Printf("Unable to marshal task object: %v.\n", t)
+	}
 
-		d := json.NewDecoder(resp.Body)
-		if resp.StatusCode != http.StatusCreated {
-			e := worker.ErrResponse{}
-			err := d.Decode(&e)
-			if err != nil {
-				fmt.Printf("Error decoding response: %s\n\n", err.Error())
-				return
-			}
-			log.Printf("Response error (%d): %s\n", e.HTTPStatusCode, e.Message)
-			return
-		}
+	url := fmt.Sprintf("http://%s/tasks", w.Name)
+	resp, err := http.Post(url, "application/json", bytes.NewBuffer(data))
+	if err != nil {
+		log.Printf("[manager] Error connecting to %v: %v\n", w.Name, err)
+		m.unplace(t.ID)
+		m.retryLater(te, fmt.Errorf("unable to reach worker %s", w.Name))
+		return
+	}
+	defer resp.Body.Close()
 
-		t = task.Task{}
-		err = d.Decode(&t)
-		if err != nil {
-			fmt.Printf("Error decoding response: %s\n", err.Error())
-			return
+	d := json.NewDecoder(resp.Body)
+	if resp.StatusCode != http.StatusCreated {
+		e := worker.ErrResponse{}
+		if err := d.Decode(&e); err != nil {
+			e.Message = resp.Status
 		}
-		w.TaskCount++
-		log.Printf("[manager] received response from worker: %#v\n", t)
-	} else {
-		log.Println("No work in the queue")
+		log.Printf("Response error (%d): %s\n", resp.StatusCode, e.Message)
+		m.unplace(t.ID)
+		m.failPending(te, fmt.Sprintf("rejected by worker %s: %s", w.Name, e.Message))
+		return
+	}
+
+	m.dispatched(te, true)
+	t = task.Task{}
+	err = d.Decode(&t)
+	if err != nil {
+		fmt.Printf("Error decoding response: %s\n", err.Error())
+		return
+	}
+	log.Printf("[manager] received response from worker: %#v\n", t)
+}
+
+// unplace undoes the assignment of a task its worker did not accept,
+// releasing what it holds there.
+func (m *Manager) unplace(id uuid.UUID) {
+	m.unassign(id)
+	_, err := m.updateTask(id, func(t *task.Task) error {
+		t.Worker = ""
+		return nil
+	})
+	if err != nil {
+		log.Printf("[manager] %v\n", err)
 	}
 }
 
@@ -417,5 +818,24 @@ func (m *Manager) GetTasks() []*task.Task {
 
 func (m *Manager) AddTask(te task.TaskEvent) {
 	log.Printf("Add event %v to pending queue", te)
+	err := m.PendingDb.Put(te.ID.String(), &te)
+	if err != nil {
+		log.Printf("error attempting to store pending event %s: %s\n", te.ID, err)
+	}
+
+	m.pendingMu.Lock()
 	m.Pending.Enqueue(te)
+	if _, ok := m.enqueuedAt[te.ID]; !ok {
+		m.enqueuedAt[te.ID] = time.Now()
+	}
+	m.pendingMu.Unlock()
+	m.signalQueued()
+}
+
+// signalQueued wakes up ProcessTasks.
+func (m *Manager) signalQueued() {
+	select {
+	case m.queued <- struct{}{}:
+	default:
+	}
 }
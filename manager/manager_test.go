@@ -0,0 +1,189 @@
+package manager
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/MarouaneBouaricha/cube/task"
+	"github.com/MarouaneBouaricha/cube/worker"
+	"github.com/docker/go-connections/nat"
+	"github.com/google/uuid"
+)
+
+// startWorker serves a worker backed by a fake container runtime and returns
+// it along with the address the manager should use to reach it.
+func startWorker(t *testing.T, f *task.Fake) (*worker.Worker, string) {
+	w := worker.New("test-worker", "memory", f)
+	api := worker.Api{Worker: w}
+	srv := httptest.NewServer(api.Handler())
+	t.Cleanup(srv.Close)
+
+	return w, strings.TrimPrefix(srv.URL, "http://")
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for condition")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func getTask(t *testing.T, m *Manager, id uuid.UUID) *task.Task {
+	result, err := m.TaskDb.Get(id.String())
+	if err != nil {
+		t.Fatalf("task %s not found: %v", id, err)
+	}
+	return result.(*task.Task)
+}
+
+func TestManagerRunsTaskOnWorker(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	f := task.NewFake()
+	w, addr := startWorker(t, f)
+	m := New([]string{addr}, "roundrobin", "memory")
+
+	tk := task.Task{
+		ID:           uuid.New(),
+		Name:         "web",
+		Image:        "server",
+		State:        task.Scheduled,
+		ExposedPorts: nat.PortSet{"80/tcp": struct{}{}},
+	}
+	m.AddTask(task.TaskEvent{ID: uuid.New(), State: task.Running, Timestamp: time.Now(), Task: tk})
+	m.SendWork()
+
+	if got := m.TaskWorkerMap[tk.ID]; got != addr {
+		t.Fatalf("task assigned to %q; want %q", got, addr)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go w.RunTasks(ctx)
+	waitFor(t, func() bool {
+		result, err := w.Db.Get(tk.ID.String())
+		return err == nil && result.(*task.Task).State == task.Running
+	})
+	go w.UpdateTasks(ctx)
+	waitFor(t, func() bool {
+		result, _ := w.Db.Get(tk.ID.String())
+		return len(result.(*task.Task).HostPorts) > 0
+	})
+
+	m.updateTasks()
+	result, err := m.TaskDb.Get(tk.ID.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := result.(*task.Task)
+	if got.State != task.Running {
+		t.Errorf("task state = %v; want %v", got.State, task.Running)
+	}
+	if got.ContainerID == "" || len(f.Containers()) != 1 {
+		t.Errorf("expected one container for the task, got %q and %v", got.ContainerID, f.Containers())
+	}
+	if len(got.HostPorts["80/tcp"]) != 1 {
+		t.Errorf("expected manager to learn host port for 80/tcp, got %v", got.HostPorts)
+	}
+}
+
+func TestManagerProcessTasks(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	f := task.NewFake()
+	w, addr := startWorker(t, f)
+	m := New([]string{addr}, "roundrobin", "memory")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go w.RunTasks(ctx)
+
+	done := make(chan struct{})
+	go func() {
+		m.ProcessTasks(ctx)
+		close(done)
+	}()
+
+	for i := 0; i < 50; i++ {
+		tk := task.Task{ID: uuid.New(), Name: "burst", Image: "server", State: task.Scheduled}
+		m.AddTask(task.TaskEvent{ID: uuid.New(), State: task.Running, Timestamp: time.Now(), Task: tk})
+	}
+
+	// Workers may start a container before the manager has processed their
+	// response, so wait for both.
+	waitFor(t, func() bool {
+		return len(f.Containers()) == 50 && m.GetSchedulingStats().Dispatched == 50
+	})
+
+	stats := m.GetSchedulingStats()
+	if stats.QueueDepth != 0 || stats.Dispatched != 50 || stats.Dropped != 0 {
+		t.Errorf("unexpected scheduling stats %+v", stats)
+	}
+	if stats.MaxLatency < stats.AverageLatency || stats.AverageLatency <= 0 {
+		t.Errorf("expected latencies to be recorded, got %+v", stats)
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("ProcessTasks did not return after the context was cancelled")
+	}
+}
+
+func TestManagerStopTask(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	f := task.NewFake()
+	w, addr := startWorker(t, f)
+	go w.RunTasks(ctx)
+	m := New([]string{addr}, "roundrobin", "memory")
+
+	tk := task.Task{ID: uuid.New(), Name: "web", Image: "server", State: task.Scheduled}
+	m.AddTask(task.TaskEvent{ID: uuid.New(), State: task.Running, Timestamp: time.Now(), Task: tk})
+	m.SendWork()
+	waitFor(t, func() bool { return len(f.Containers()) == 1 })
+	m.updateTasks()
+	running := *getTask(t, m, tk.ID)
+	if running.State != task.Running {
+		t.Fatalf("task state = %v; want %v", running.State, task.Running)
+	}
+
+	m.AddTask(task.TaskEvent{ID: uuid.New(), State: task.Completed, Timestamp: time.Now(), Task: running})
+	m.SendWork()
+	if got := getTask(t, m, tk.ID).State; got != task.Stopping {
+		t.Errorf("task state = %v after requesting a stop; want %v", got, task.Stopping)
+	}
+
+	// A report sent before the worker stopped the task is ignored.
+	if err := mergeWorkerTask(getTask(t, m, tk.ID), &running); !errors.Is(err, task.ErrInvalidTransition) {
+		t.Errorf("merging a stale report: error = %v; want ErrInvalidTransition", err)
+	}
+
+	waitFor(t, func() bool { return len(f.Containers()) == 0 })
+	m.updateTasks()
+	if got := getTask(t, m, tk.ID).State; got != task.Completed {
+		t.Errorf("task state = %v; want %v", got, task.Completed)
+	}
+
+	// A stopped task is not started again.
+	m.AddTask(task.TaskEvent{ID: uuid.New(), State: task.Running, Timestamp: time.Now(), Task: tk})
+	m.SendWork()
+	time.Sleep(20 * time.Millisecond)
+	if containers := f.Containers(); len(containers) != 0 {
+		t.Errorf("stopped task was started again in %v", containers)
+	}
+}
@@ -0,0 +1,361 @@
+package manager
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/MarouaneBouaricha/cube/node"
+	"github.com/MarouaneBouaricha/cube/task"
+	"github.com/google/uuid"
+)
+
+const (
+	// DefaultMaxMissedHeartbeats is the number of consecutive failed checks
+	// after which a worker is considered unhealthy unless configured
+	// otherwise.
+	DefaultMaxMissedHeartbeats = 3
+	// DefaultDrainTimeout is how long a drain waits for the tasks of a
+	// worker to stop unless configured otherwise.
+	DefaultDrainTimeout = 30 * time.Second
+
+	drainCheckInterval = 200 * time.Millisecond
+	// lostAfterMissedHeartbeats is the number of consecutive failed checks
+	// after which the tasks of a worker are marked Lost, so that a single
+	// transient failure does not.
+	lostAfterMissedHeartbeats = 2
+)
+
+// ErrNodeNotFound is returned for operations on a worker the manager does
+// not know about.
+var ErrNodeNotFound = errors.New("node not found")
+
+// ErrNodeDeregistered is returned when a deregistered worker renews its
+// registration.
+var ErrNodeDeregistered = errors.New("node deregistered")
+
+// errSkip is returned by updateTask callbacks to leave a task unchanged.
+var errSkip = errors.New("task left unchanged")
+
+// nodeByName returns the worker node with the given name. The caller must
+// hold m.mu.
+func (m *Manager) nodeByName(name string) *node.Node {
+	for _, n := range m.WorkerNodes {
+		if n.Name == name {
+			return n
+		}
+	}
+	return nil
+}
+
+// availableNodes returns the nodes new tasks may be placed on. The caller
+// must hold m.mu.
+func (m *Manager) availableNodes() []*node.Node {
+	var nodes []*node.Node
+	for _, n := range m.WorkerNodes {
+		if n.Status == node.Healthy {
+			nodes = append(nodes, n)
+		}
+	}
+	return nodes
+}
+
+func (m *Manager) isHealthy(worker string) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	n := m.nodeByName(worker)
+	return n != nil && n.Status == node.Healthy
+}
+
+// heartbeat records that worker answered a check.
+func (m *Manager) heartbeat(worker string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	n := m.nodeByName(worker)
+	if n == nil {
+		return
+	}
+	if n.Status == node.Unhealthy {
+		log.Printf("[manager] worker %s is reachable again, marking it healthy\n", worker)
+		m.capacityChanged()
+	}
+	n.Status = node.Healthy
+	n.LastSeen = time.Now().UTC()
+	n.MissedHeartbeats = 0
+}
+
+// missedHeartbeat records that worker failed to answer a check. Its tasks
+// are marked Lost once it has missed lostAfterMissedHeartbeats checks in a
+// row, and once it has missed m.MaxMissedHeartbeats it is marked unhealthy
+// and its tasks are rescheduled onto the remaining workers.
+func (m *Manager) missedHeartbeat(worker string) {
+	m.mu.Lock()
+	n := m.nodeByName(worker)
+	if n == nil {
+		m.mu.Unlock()
+		return
+	}
+	n.MissedHeartbeats++
+	failed := n.Status == node.Healthy && n.MissedHeartbeats >= m.MaxMissedHeartbeats
+	lost := !failed && n.MissedHeartbeats == lostAfterMissedHeartbeats
+	if failed {
+		n.Status = node.Unhealthy
+	}
+	m.mu.Unlock()
+
+	if lost {
+		m.markLost(worker)
+	}
+	if failed {
+		log.Printf("[manager] worker %s missed %d heartbeats, marking it unhealthy\n", worker, m.MaxMissedHeartbeats)
+		m.rescheduleTasks(worker)
+	}
+}
+
+// markLost marks the active tasks of worker as Lost until the worker can be
+// reached again and reports them.
+func (m *Manager) markLost(worker string) {
+	m.mu.RLock()
+	ids := append([]uuid.UUID(nil), m.WorkerTaskMap[worker]...)
+	m.mu.RUnlock()
+
+	for _, id := range ids {
+		_, err := m.updateTask(id, func(t *task.Task) error {
+			if t.State != task.Scheduled && t.State != task.Running && t.State != task.Restarting {
+				return errSkip
+			}
+			return t.Transition(task.Lost)
+		})
+		if err != nil && err != errSkip {
+			log.Printf("[manager] %v\n", err)
+		}
+	}
+}
+
+// rescheduleTasks moves the tasks of worker back to the pending queue so
+// that they are placed on another worker.
+func (m *Manager) rescheduleTasks(worker string) {
+	m.mu.RLock()
+	ids := append([]uuid.UUID(nil), m.WorkerTaskMap[worker]...)
+	m.mu.RUnlock()
+
+	for _, id := range ids {
+		m.rescheduleTask(id)
+	}
+}
+
+// rescheduleTask moves the task with the given ID off its worker and back
+// to the pending queue if it is active. Tasks that exited are left to their
+// restart policy, and tasks that were never placed or are being stopped
+// stay where they are.
+func (m *Manager) rescheduleTask(id uuid.UUID) {
+	t, err := m.updateTask(id, func(t *task.Task) error {
+		switch t.State {
+		case task.Scheduled, task.Running, task.Restarting, task.Lost:
+		default:
+			return errSkip
+		}
+		log.Printf("[manager] rescheduling task %s away from worker %s\n", t.ID, t.Worker)
+		t.Worker = ""
+		t.ContainerID = ""
+		t.HostPorts = nil
+		return t.Transition(task.Scheduled)
+	})
+	if err == errSkip {
+		return
+	}
+	if err != nil {
+		log.Printf("[manager] unable to reschedule task %s: %v\n", id, err)
+		return
+	}
+
+	m.placeAgain(t)
+}
+
+// placeAgain moves t, which was taken off its worker, back to the pending
+// queue to be placed again.
+func (m *Manager) placeAgain(t *task.Task) {
+	m.unassign(t.ID)
+	m.AddTask(task.TaskEvent{
+		ID:        uuid.New(),
+		State:     task.Running,
+		Timestamp: time.Now().UTC(),
+		Task:      *t,
+	})
+}
+
+// RegisterWorker adds the worker at address to the cluster, or refreshes it
+// if it is already known, with the labels and taints it advertises. It
+// reports whether the worker is new. A known worker registering with
+// another boot ID has restarted, so its tasks are reconciled with what it
+// reports. A deregistered worker may only register again once it
+// restarted, or without a boot ID, as an operator adding it by hand does.
+func (m *Manager) RegisterWorker(reg node.Registration) (node.Node, bool, error) {
+	address := reg.Address
+	m.mu.Lock()
+	if bootID, ok := m.deregistered[address]; ok {
+		if reg.BootID != "" && reg.BootID == bootID {
+			m.mu.Unlock()
+			return node.Node{}, false, fmt.Errorf("worker %s: %w", address, ErrNodeDeregistered)
+		}
+		delete(m.deregistered, address)
+	}
+	n := m.nodeByName(address)
+	created := n == nil
+	if created {
+		n = node.NewNode(address, fmt.Sprintf("http://%v", address), "worker")
+		m.Workers = append(m.Workers, address)
+		m.WorkerNodes = append(m.WorkerNodes, n)
+		m.WorkerTaskMap[address] = []uuid.UUID{}
+		// Tasks recovered before the worker registered may hold resources
+		// on it already.
+		m.refreshAllocatedLocked(address)
+	}
+	restarted := !created && n.BootID != reg.BootID
+	n.BootID = reg.BootID
+	n.Labels = reg.Labels
+	n.Taints = reg.Taints
+	recovered := n.Status != node.Healthy
+	n.Status = node.Healthy
+	n.LastSeen = time.Now().UTC()
+	n.MissedHeartbeats = 0
+	registered := *n
+	m.mu.Unlock()
+	if created || recovered {
+		m.capacityChanged()
+	}
+
+	if created {
+		log.Printf("[manager] registered worker %s\n", address)
+	} else if restarted {
+		log.Printf("[manager] worker %s restarted\n", address)
+		go m.reconcileWorker(address)
+	}
+	return registered, created, nil
+}
+
+// DeregisterWorker removes the worker from the cluster. Its tasks are
+// stopped on the worker, if it can still be reached, and rescheduled onto
+// the remaining workers. The worker is not let back in by renewing its
+// registration.
+func (m *Manager) DeregisterWorker(name string) error {
+	m.mu.Lock()
+	n := m.nodeByName(name)
+	if n == nil {
+		m.mu.Unlock()
+		return fmt.Errorf("worker %s: %w", name, ErrNodeNotFound)
+	}
+	m.deregistered[name] = n.BootID
+	for i, w := range m.Workers {
+		if w == name {
+			m.Workers = append(m.Workers[:i:i], m.Workers[i+1:]...)
+			break
+		}
+	}
+	for i, n := range m.WorkerNodes {
+		if n.Name == name {
+			m.WorkerNodes = append(m.WorkerNodes[:i:i], m.WorkerNodes[i+1:]...)
+			break
+		}
+	}
+	ids := append([]uuid.UUID(nil), m.WorkerTaskMap[name]...)
+	m.mu.Unlock()
+
+	log.Printf("[manager] deregistering worker %s with %d tasks\n", name, len(ids))
+	for _, id := range ids {
+		result, err := m.TaskDb.Get(id.String())
+		if err != nil {
+			log.Printf("[manager] %v\n", err)
+		} else if result.(*task.Task).State != task.Completed {
+			m.stopTask(name, id.String())
+			m.rescheduleTask(id)
+		}
+		// Tasks that are not rescheduled no longer belong to the worker
+		// either.
+		m.unassign(id)
+	}
+
+	m.mu.Lock()
+	delete(m.WorkerTaskMap, name)
+	m.mu.Unlock()
+	return nil
+}
+
+// CordonWorker marks the worker as unschedulable, or as schedulable again if
+// cordoned is false. Tasks already running on the worker are left alone.
+func (m *Manager) CordonWorker(name string, cordoned bool) (node.Node, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	n := m.nodeByName(name)
+	if n == nil {
+		return node.Node{}, fmt.Errorf("worker %s: %w", name, ErrNodeNotFound)
+	}
+	if n.Cordoned != cordoned {
+		log.Printf("[manager] setting cordoned=%v on worker %s\n", cordoned, name)
+	}
+	n.Cordoned = cordoned
+	if !cordoned {
+		m.capacityChanged()
+	}
+	return *n, nil
+}
+
+// DrainWorker cordons the worker and moves its tasks onto the other workers.
+// The tasks are rescheduled first, so that their replacements can start
+// while the worker stops them, and the worker is given up to timeout to
+// report them stopped. Copies still running after that are stopped as soon
+// as the worker reports them, like for any task assigned elsewhere.
+func (m *Manager) DrainWorker(name string, timeout time.Duration) error {
+	if _, err := m.CordonWorker(name, true); err != nil {
+		return err
+	}
+
+	m.mu.RLock()
+	ids := append([]uuid.UUID(nil), m.WorkerTaskMap[name]...)
+	m.mu.RUnlock()
+
+	log.Printf("[manager] draining worker %s with %d tasks\n", name, len(ids))
+	for _, id := range ids {
+		m.rescheduleTask(id)
+		m.stopTask(name, id.String())
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		running, err := m.runningOn(name, ids)
+		if err != nil {
+			return fmt.Errorf("unable to confirm worker %s stopped its tasks: %v", name, err)
+		}
+		if running == 0 {
+			log.Printf("[manager] worker %s drained\n", name)
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%d tasks still running on worker %s after %v", running, name, timeout)
+		}
+		time.Sleep(drainCheckInterval)
+	}
+}
+
+// runningOn counts the tasks among ids that worker reports as not stopped.
+func (m *Manager) runningOn(worker string, ids []uuid.UUID) (int, error) {
+	tasks, err := getWorkerTasks(worker)
+	if err != nil {
+		return 0, err
+	}
+
+	wanted := make(map[uuid.UUID]bool)
+	for _, id := range ids {
+		wanted[id] = true
+	}
+	running := 0
+	for _, t := range tasks {
+		if wanted[t.ID] && (t.State == task.Scheduled || t.State == task.Running || t.State == task.Restarting || t.State == task.Stopping) {
+			running++
+		}
+	}
+	return running, nil
+}
@@ -0,0 +1,330 @@
+package manager
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/MarouaneBouaricha/cube/node"
+	"github.com/MarouaneBouaricha/cube/task"
+	"github.com/MarouaneBouaricha/cube/worker"
+	"github.com/google/uuid"
+)
+
+func TestManagerReschedulesTasksOfFailedWorker(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// The first worker's server is closed explicitly to simulate a failure.
+	fa := task.NewFake()
+	wa := worker.New("worker-a", "memory", fa)
+	srvA := httptest.NewServer((&worker.Api{Worker: wa}).Handler())
+	addrA := strings.TrimPrefix(srvA.URL, "http://")
+	go wa.RunTasks(ctx)
+
+	fb := task.NewFake()
+	wb, addrB := startWorker(t, fb)
+	go wb.RunTasks(ctx)
+
+	m := New([]string{addrA, addrB}, "roundrobin", "memory")
+	// Round robin starts with the second node; make it pick the first.
+	m.Scheduler.Score(task.Task{}, m.WorkerNodes)
+
+	tk := task.Task{ID: uuid.New(), Name: "web", Image: "server", State: task.Scheduled}
+	m.AddTask(task.TaskEvent{ID: uuid.New(), State: task.Running, Timestamp: time.Now(), Task: tk})
+	m.SendWork()
+	if got, _ := m.workerFor(tk.ID); got != addrA {
+		t.Fatalf("task assigned to %q; want %q", got, addrA)
+	}
+	waitFor(t, func() bool { return len(fa.Containers()) == 1 })
+	m.updateTasks()
+
+	srvA.Close()
+	// A single failed check does not mark the tasks Lost.
+	m.updateTasks()
+	if got := getTask(t, m, tk.ID).State; got != task.Running {
+		t.Errorf("task state = %v after a single missed heartbeat; want %v", got, task.Running)
+	}
+	for i := 1; i < m.MaxMissedHeartbeats-1; i++ {
+		m.updateTasks()
+	}
+	if !m.isHealthy(addrA) {
+		t.Fatalf("worker marked unhealthy after %d missed heartbeats", m.MaxMissedHeartbeats-1)
+	}
+	if got := getTask(t, m, tk.ID).State; got != task.Lost {
+		t.Errorf("task state = %v while its worker is unreachable; want %v", got, task.Lost)
+	}
+	m.updateTasks()
+	if m.isHealthy(addrA) {
+		t.Fatal("expected worker to be marked unhealthy")
+	}
+
+	m.SendWork()
+	if got, _ := m.workerFor(tk.ID); got != addrB {
+		t.Fatalf("task rescheduled to %q; want %q", got, addrB)
+	}
+	waitFor(t, func() bool { return len(fb.Containers()) == 1 })
+
+	result, _ := m.EventDb.List()
+	if events := result.([]*task.TaskEvent); len(events) != 2 {
+		t.Errorf("expected the original and the rescheduling event to be recorded, got %d events", len(events))
+	}
+
+	// New tasks are not placed on the unhealthy worker.
+	for i := 0; i < 3; i++ {
+		n, err := m.SelectWorker(task.Task{ID: uuid.New()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n.Name != addrB {
+			t.Errorf("selected %s; want %s", n.Name, addrB)
+		}
+	}
+
+	for _, n := range m.GetNodes() {
+		if n.Name == addrA && n.Status != node.Unhealthy {
+			t.Errorf("node %s status = %v; want %v", n.Name, n.Status, node.Unhealthy)
+		}
+	}
+}
+
+func TestManagerRegisterAndDeregisterWorker(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	m := New(nil, "roundrobin", "memory")
+	api := Api{Manager: m}
+	srv := httptest.NewServer(api.Handler())
+	defer srv.Close()
+	managerAddr := strings.TrimPrefix(srv.URL, "http://")
+
+	fa := task.NewFake()
+	wa, addrA := startWorker(t, fa)
+	go wa.RunTasks(ctx)
+	fb := task.NewFake()
+	wb, addrB := startWorker(t, fb)
+	go wb.RunTasks(ctx)
+
+	// Workers register on startup and keep renewing their registration.
+	renewing := make(chan struct{})
+	wa.RegisterInterval = 5 * time.Millisecond
+	wa.Labels = map[string]string{"zone": "a"}
+	wa.Taints = []string{"dedicated=ci"}
+	go func() {
+		wa.Register(ctx, managerAddr, addrA)
+		close(renewing)
+	}()
+	waitFor(t, func() bool { return len(m.GetNodes()) == 1 })
+	registered := m.GetNodes()[0]
+	if registered.Labels["zone"] != "a" || len(registered.Taints) != 1 || registered.Taints[0] != "dedicated=ci" {
+		t.Errorf("registered worker has labels %v and taints %v; want zone=a and dedicated=ci", registered.Labels, registered.Taints)
+	}
+	waitFor(t, func() bool { return m.GetNodes()[0].LastSeen.After(registered.LastSeen) })
+	if got := m.GetNodes()[0].RegisteredAt; !got.Equal(registered.RegisteredAt) {
+		t.Errorf("registration time changed from %v to %v when renewing", registered.RegisteredAt, got)
+	}
+
+	tk := task.Task{ID: uuid.New(), Name: "web", Image: "server", State: task.Scheduled,
+		Tolerations: []task.Toleration{{Key: "dedicated"}}}
+	m.AddTask(task.TaskEvent{ID: uuid.New(), State: task.Running, Timestamp: time.Now(), Task: tk})
+	m.SendWork()
+	waitFor(t, func() bool { return len(fa.Containers()) == 1 })
+	m.updateTasks()
+
+	go wb.Register(ctx, managerAddr, addrB)
+	waitFor(t, func() bool { return len(m.GetNodes()) == 2 })
+
+	done := &task.Task{ID: uuid.New(), Name: "batch", Image: "batch", State: task.Completed, Worker: addrA}
+	m.TaskDb.Put(done.ID.String(), done)
+	m.assign(done, addrA)
+
+	req, _ := http.NewRequest(http.MethodDelete, srv.URL+"/nodes/"+addrA, nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("DELETE /nodes/%s returned %d", addrA, resp.StatusCode)
+	}
+
+	// The task is stopped on the removed worker and started on the other.
+	m.SendWork()
+	waitFor(t, func() bool { return len(fa.Containers()) == 0 && len(fb.Containers()) == 1 })
+	if got, _ := m.workerFor(tk.ID); got != addrB {
+		t.Errorf("task assigned to %q; want %q", got, addrB)
+	}
+	if got, ok := m.workerFor(done.ID); ok {
+		t.Errorf("completed task still assigned to %q", got)
+	}
+
+	// The removed worker stops renewing its registration, and is let back
+	// in only once it restarted.
+	select {
+	case <-renewing:
+	case <-time.After(2 * time.Second):
+		t.Fatal("removed worker still renewing its registration")
+	}
+	if _, _, err := m.RegisterWorker(node.Registration{Address: addrA, BootID: wa.BootID}); !errors.Is(err, ErrNodeDeregistered) {
+		t.Errorf("renewal of removed worker returned %v; want %v", err, ErrNodeDeregistered)
+	}
+	for _, n := range m.GetNodes() {
+		if n.Name == addrA {
+			t.Errorf("worker %s still registered", addrA)
+		}
+	}
+	if _, created, err := m.RegisterWorker(node.Registration{Address: addrA, BootID: uuid.NewString()}); err != nil || !created {
+		t.Errorf("restarted worker registered with created=%v and error %v; want it added again", created, err)
+	}
+
+	req, _ = http.NewRequest(http.MethodDelete, srv.URL+"/nodes/unknown:1234", nil)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("DELETE of unknown node returned %d; want 404", resp.StatusCode)
+	}
+}
+
+func TestManagerReconcilesOnlyRestartedWorkers(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	_, addr := startWorker(t, task.NewFake())
+	m := New(nil, "roundrobin", "memory")
+	m.RegisterWorker(node.Registration{Address: addr, BootID: "first"})
+
+	// The task was sent to the worker but is not reported by it yet.
+	tk := &task.Task{ID: uuid.New(), Name: "web", Image: "server", State: task.Scheduled, Worker: addr}
+	m.TaskDb.Put(tk.ID.String(), tk)
+	m.assign(tk, addr)
+
+	// Renewing the registration leaves the task alone.
+	m.RegisterWorker(node.Registration{Address: addr, BootID: "first"})
+	time.Sleep(50 * time.Millisecond)
+	if got := getTask(t, m, tk.ID).State; got != task.Scheduled {
+		t.Fatalf("task state = %v after a renewal; want %v", got, task.Scheduled)
+	}
+
+	// A worker that restarted lost the tasks it does not report.
+	m.RegisterWorker(node.Registration{Address: addr, BootID: "second"})
+	waitFor(t, func() bool { return getTask(t, m, tk.ID).State == task.Failed })
+}
+
+func TestManagerDrainWorker(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	fa := task.NewFake()
+	wa, addrA := startWorker(t, fa)
+	go wa.RunTasks(ctx)
+	fb := task.NewFake()
+	wb, addrB := startWorker(t, fb)
+	go wb.RunTasks(ctx)
+
+	m := New([]string{addrA, addrB}, "roundrobin", "memory")
+	api := Api{Manager: m}
+	srv := httptest.NewServer(api.Handler())
+	defer srv.Close()
+
+	post := func(path string) int {
+		t.Helper()
+		resp, err := http.Post(srv.URL+path, "application/json", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// Tasks are only placed on the worker that is not cordoned.
+	if code := post("/nodes/" + addrB + "/cordon"); code != http.StatusOK {
+		t.Fatalf("cordon returned %d", code)
+	}
+	var ids []uuid.UUID
+	for i := 0; i < 2; i++ {
+		tk := task.Task{ID: uuid.New(), Name: "web", Image: "server", State: task.Scheduled}
+		ids = append(ids, tk.ID)
+		m.AddTask(task.TaskEvent{ID: uuid.New(), State: task.Running, Timestamp: time.Now(), Task: tk})
+		m.SendWork()
+		if got, _ := m.workerFor(tk.ID); got != addrA {
+			t.Fatalf("task assigned to %q; want %q", got, addrA)
+		}
+	}
+	waitFor(t, func() bool { return len(fa.Containers()) == 2 })
+
+	if code := post("/nodes/" + addrB + "/uncordon"); code != http.StatusOK {
+		t.Fatalf("uncordon returned %d", code)
+	}
+	if code := post("/nodes/" + addrA + "/drain?timeout=2s"); code != http.StatusNoContent {
+		t.Fatalf("drain returned %d", code)
+	}
+
+	m.SendWork()
+	m.SendWork()
+	waitFor(t, func() bool { return len(fa.Containers()) == 0 && len(fb.Containers()) == 2 })
+	for _, id := range ids {
+		if got, _ := m.workerFor(id); got != addrB {
+			t.Errorf("task %s assigned to %q; want %q", id, got, addrB)
+		}
+	}
+	for _, n := range m.GetNodes() {
+		if n.Cordoned != (n.Name == addrA) {
+			t.Errorf("node %s cordoned = %v", n.Name, n.Cordoned)
+		}
+	}
+
+	if code := post("/nodes/unknown:1234/drain"); code != http.StatusNotFound {
+		t.Errorf("drain of unknown node returned %d; want 404", code)
+	}
+	if code := post("/nodes/" + addrA + "/drain?timeout=soon"); code != http.StatusBadRequest {
+		t.Errorf("drain with invalid timeout returned %d; want 400", code)
+	}
+}
+
+func TestManagerDrainWorkerLeavesFailedTasks(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	fa := task.NewFake()
+	wa, addrA := startWorker(t, fa)
+	go wa.RunTasks(ctx)
+	fb := task.NewFake()
+	wb, addrB := startWorker(t, fb)
+	go wb.RunTasks(ctx)
+	m := New([]string{addrA, addrB}, "roundrobin", "memory")
+
+	tk := &task.Task{ID: uuid.New(), Name: "batch", Image: "batch", State: task.Failed, Worker: addrA,
+		RestartPolicy: task.RestartNever}
+	m.TaskDb.Put(tk.ID.String(), tk)
+	m.assign(tk, addrA)
+
+	if err := m.DrainWorker(addrA, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	m.SendWork()
+	if got := getTask(t, m, tk.ID); got.State != task.Failed || got.Worker != addrA {
+		t.Errorf("failed task is %v on %q after the drain; want Failed on %q", got.State, got.Worker, addrA)
+	}
+	if got, _ := m.workerFor(tk.ID); got == addrB {
+		t.Errorf("failed task with restart policy never placed on %s", addrB)
+	}
+	if n := len(fb.Containers()); n != 0 {
+		t.Errorf("%d containers started on %s; want none", n, addrB)
+	}
+}
@@ -0,0 +1,180 @@
+package manager
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/MarouaneBouaricha/cube/task"
+	"github.com/google/uuid"
+)
+
+const (
+	// DefaultPendingBackoff is the delay before the first retry of an event
+	// that could not be sent unless configured otherwise.
+	DefaultPendingBackoff = time.Second
+	// MaxPendingBackoff caps the delay between retries of an event.
+	MaxPendingBackoff = time.Minute
+	// DefaultPendingTimeout is how long the manager keeps trying to send an
+	// event before failing its task unless configured otherwise.
+	DefaultPendingTimeout = 5 * time.Minute
+)
+
+// backoffEvent is a pending event waiting to be sent again.
+type backoffEvent struct {
+	event   task.TaskEvent
+	retryAt time.Time
+}
+
+// retryLater puts te aside to be sent again after a backoff, or fails its
+// task if te has been pending for longer than m.PendingTimeout. reason is
+// why te could not be sent.
+func (m *Manager) retryLater(te task.TaskEvent, reason error) {
+	now := time.Now()
+
+	m.pendingMu.Lock()
+	enqueued, ok := m.enqueuedAt[te.ID]
+	if !ok {
+		enqueued = now
+		m.enqueuedAt[te.ID] = now
+	}
+	var deadline time.Time
+	if m.PendingTimeout > 0 {
+		deadline = enqueued.Add(m.PendingTimeout)
+	}
+	expired := !deadline.IsZero() && !now.Before(deadline)
+	var retryAt time.Time
+	if !expired {
+		m.retries[te.ID]++
+		retryAt = now.Add(m.pendingDelay(m.retries[te.ID]))
+		if !deadline.IsZero() && retryAt.After(deadline) {
+			retryAt = deadline
+		}
+		m.backoff = append(m.backoff, backoffEvent{event: te, retryAt: retryAt})
+	}
+	m.pendingMu.Unlock()
+
+	if expired {
+		m.failPending(te, fmt.Sprintf("not scheduled within %v: %v", m.PendingTimeout, reason))
+		return
+	}
+	log.Printf("[manager] retrying event %s for task %s in %v: %v\n", te.ID, te.Task.ID, retryAt.Sub(now).Round(time.Millisecond), reason)
+	m.signalQueued()
+}
+
+// pendingDelay returns how long an event waits before its nth retry: the
+// pending backoff, doubled for every retry after the first, up to
+// MaxPendingBackoff.
+func (m *Manager) pendingDelay(n int) time.Duration {
+	delay := m.PendingBackoff
+	if delay <= 0 {
+		delay = DefaultPendingBackoff
+	}
+	for i := 1; i < n && delay < MaxPendingBackoff; i++ {
+		delay *= 2
+	}
+	if delay > MaxPendingBackoff {
+		delay = MaxPendingBackoff
+	}
+	return delay
+}
+
+// failPending marks the task of te as Failed with reason, and drops te. A
+// task that was never stored is Pending until then.
+func (m *Manager) failPending(te task.TaskEvent, reason string) {
+	m.taskMu.Lock()
+	t := te.Task
+	t.State = task.Pending
+	if result, err := m.TaskDb.Get(t.ID.String()); err == nil {
+		t = *result.(*task.Task)
+	}
+	err := t.Transition(task.Failed)
+	if err == nil {
+		t.Worker = ""
+		t.Error = reason
+		t.FinishTime = time.Now().UTC()
+		err = m.TaskDb.Put(t.ID.String(), &t)
+	}
+	m.taskMu.Unlock()
+
+	if err != nil {
+		log.Printf("[manager] unable to fail task %s: %v\n", t.ID, err)
+	} else {
+		log.Printf("[manager] task %s failed: %s\n", t.ID, reason)
+		m.forgetSchedulingAttempts(&t)
+	}
+	m.dispatched(te, false)
+}
+
+// promoteDueLocked moves the events whose backoff is over back onto the
+// pending queue, in the order they were put aside. The caller must hold
+// m.pendingMu.
+func (m *Manager) promoteDueLocked(now time.Time) {
+	waiting := m.backoff[:0]
+	for _, b := range m.backoff {
+		if now.Before(b.retryAt) {
+			waiting = append(waiting, b)
+			continue
+		}
+		m.Pending.Enqueue(b.event)
+	}
+	clear(m.backoff[len(waiting):])
+	m.backoff = waiting
+}
+
+// nextRetry returns how long until the backoff of an event is over, and
+// false if no event is waiting.
+func (m *Manager) nextRetry() (time.Duration, bool) {
+	m.pendingMu.Lock()
+	defer m.pendingMu.Unlock()
+	if len(m.backoff) == 0 {
+		return 0, false
+	}
+	next := m.backoff[0].retryAt
+	for _, b := range m.backoff[1:] {
+		if b.retryAt.Before(next) {
+			next = b.retryAt
+		}
+	}
+	return time.Until(next), true
+}
+
+// capacityChanged ends the backoff of the waiting events, as a worker may
+// now have room for their tasks. It only takes m.pendingMu, so it may be
+// called with m.mu held.
+func (m *Manager) capacityChanged() {
+	m.pendingMu.Lock()
+	waiting := len(m.backoff)
+	for _, b := range m.backoff {
+		m.Pending.Enqueue(b.event)
+	}
+	m.backoff = nil
+	m.pendingMu.Unlock()
+
+	if waiting > 0 {
+		m.signalQueued()
+	}
+}
+
+// cancelRetries drops the events waiting to place the task with the given
+// ID, which was stopped before it could be placed.
+func (m *Manager) cancelRetries(id uuid.UUID) {
+	m.pendingMu.Lock()
+	var cancelled []task.TaskEvent
+	waiting := m.backoff[:0]
+	for _, b := range m.backoff {
+		if b.event.Task.ID == id {
+			cancelled = append(cancelled, b.event)
+			continue
+		}
+		waiting = append(waiting, b)
+	}
+	clear(m.backoff[len(waiting):])
+	m.backoff = waiting
+	m.pendingMu.Unlock()
+
+	for _, te := range cancelled {
+		log.Printf("[manager] task %s was stopped before it could be scheduled\n", id)
+		m.dispatched(te, false)
+	}
+}
@@ -0,0 +1,225 @@
+package manager
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/MarouaneBouaricha/cube/task"
+	"github.com/MarouaneBouaricha/cube/worker"
+	"github.com/google/uuid"
+)
+
+func TestManagerRetriesTaskOnceCapacityAppears(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	f := task.NewFake()
+	w, addr := startWorker(t, f)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go w.RunTasks(ctx)
+
+	m := New([]string{addr}, "roundrobin", "memory")
+	// Only a change of capacity ends the backoff in this test.
+	m.PendingBackoff = time.Hour
+	if _, err := m.CordonWorker(addr, true); err != nil {
+		t.Fatal(err)
+	}
+	go m.ProcessTasks(ctx)
+
+	tk := task.Task{ID: uuid.New(), Name: "web", Image: "server", State: task.Scheduled}
+	m.AddTask(task.TaskEvent{ID: uuid.New(), State: task.Running, Timestamp: time.Now(), Task: tk})
+	waitFor(t, func() bool { return m.GetSchedulingStats().Retrying == 1 })
+	if stats := m.GetSchedulingStats(); stats.Dropped != 0 {
+		t.Errorf("unschedulable event dropped: %+v", stats)
+	}
+
+	if _, err := m.CordonWorker(addr, false); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return len(f.Containers()) == 1 })
+	if got, _ := m.workerFor(tk.ID); got != addr {
+		t.Errorf("task assigned to %q; want %q", got, addr)
+	}
+	waitFor(t, func() bool { return m.GetSchedulingStats().Dispatched == 1 })
+	if stats := m.GetSchedulingStats(); stats.Retrying != 0 || stats.QueueDepth != 0 {
+		t.Errorf("unexpected scheduling stats %+v", stats)
+	}
+}
+
+func TestManagerRetriesTaskOnceNodeCapacityIsKnown(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	f := task.NewFake()
+	w, addr := startWorker(t, f)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go w.RunTasks(ctx)
+
+	m := New([]string{addr}, "epvm", "memory")
+	m.PendingBackoff = time.Hour
+	go m.ProcessTasks(ctx)
+
+	tk := task.Task{ID: uuid.New(), Name: "web", Image: "server", State: task.Scheduled, Cpu: 0.5, Memory: 1 << 20}
+	m.AddTask(task.TaskEvent{ID: uuid.New(), State: task.Running, Timestamp: time.Now(), Task: tk})
+	waitFor(t, func() bool { return m.GetSchedulingStats().Retrying == 1 })
+
+	m.updateNodeStats()
+	waitFor(t, func() bool { return len(f.Containers()) == 1 })
+}
+
+func TestManagerRetriesEventWhenWorkerIsUnreachable(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// The first worker is gone by the time the task is sent to it.
+	dead := httptest.NewServer(nil)
+	deadAddr := strings.TrimPrefix(dead.URL, "http://")
+	dead.Close()
+
+	f := task.NewFake()
+	w, addr := startWorker(t, f)
+	go w.RunTasks(ctx)
+
+	m := New([]string{deadAddr, addr}, "roundrobin", "memory")
+	m.PendingBackoff = 10 * time.Millisecond
+	// Round robin starts with the second node; make it pick the first.
+	m.Scheduler.Score(task.Task{}, m.WorkerNodes)
+
+	tk := task.Task{ID: uuid.New(), Name: "web", Image: "server", State: task.Scheduled}
+	m.AddTask(task.TaskEvent{ID: uuid.New(), State: task.Running, Timestamp: time.Now(), Task: tk})
+	m.SendWork()
+	if _, ok := m.workerFor(tk.ID); ok {
+		t.Error("task still assigned to the unreachable worker")
+	}
+	if got := getTask(t, m, tk.ID).Worker; got != "" {
+		t.Errorf("stored task has worker %q; want none", got)
+	}
+
+	go m.ProcessTasks(ctx)
+	waitFor(t, func() bool { return len(f.Containers()) == 1 })
+	if got, _ := m.workerFor(tk.ID); got != addr {
+		t.Errorf("task assigned to %q; want %q", got, addr)
+	}
+}
+
+func TestManagerFailsTaskAfterPendingTimeout(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	f := task.NewFake()
+	_, addr := startWorker(t, f)
+	m := New([]string{addr}, "roundrobin", "memory")
+	m.PendingBackoff = 5 * time.Millisecond
+	m.PendingTimeout = 50 * time.Millisecond
+	if _, err := m.CordonWorker(addr, true); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go m.ProcessTasks(ctx)
+
+	tk := task.Task{ID: uuid.New(), Name: "web", Image: "server", State: task.Pending, RestartPolicy: task.RestartAlways}
+	m.AddTask(task.TaskEvent{ID: uuid.New(), State: task.Running, Timestamp: time.Now(), Task: tk})
+	waitFor(t, func() bool { return m.GetSchedulingStats().Dropped == 1 })
+
+	failed := getTask(t, m, tk.ID)
+	if failed.State != task.Failed {
+		t.Errorf("task state = %v; want %v", failed.State, task.Failed)
+	}
+	if !strings.Contains(failed.Error, "not scheduled within 50ms") || !strings.Contains(failed.Error, "No available candidates") {
+		t.Errorf("task error = %q; want the timeout and the scheduling error", failed.Error)
+	}
+	if stats := m.GetSchedulingStats(); stats.Retrying != 0 || stats.QueueDepth != 0 {
+		t.Errorf("unexpected scheduling stats %+v", stats)
+	}
+	if result, _ := m.PendingDb.List(); len(result.([]*task.TaskEvent)) != 0 {
+		t.Error("failed event left in the pending store")
+	}
+
+	// The task never ran, so its restart policy does not apply.
+	m.restartTasks()
+	if got := getTask(t, m, tk.ID).State; got != task.Failed {
+		t.Errorf("task state = %v after restarts; want %v", got, task.Failed)
+	}
+}
+
+func TestManagerReleasesTaskRejectedByWorker(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(worker.ErrResponse{HTTPStatusCode: http.StatusBadRequest, Message: "no such image"})
+	}))
+	defer srv.Close()
+	addr := strings.TrimPrefix(srv.URL, "http://")
+
+	m := New([]string{addr}, "roundrobin", "memory")
+	tk := task.Task{ID: uuid.New(), Name: "web", Image: "server", State: task.Scheduled, Cpu: 1}
+	m.AddTask(task.TaskEvent{ID: uuid.New(), State: task.Running, Timestamp: time.Now(), Task: tk})
+	m.SendWork()
+
+	if _, ok := m.workerFor(tk.ID); ok {
+		t.Error("rejected task still assigned")
+	}
+	if n := m.GetNodes()[0]; n.CpuAllocated != 0 || n.TaskCount != 0 {
+		t.Errorf("node holds %v CPUs for %d tasks after the rejection; want none", n.CpuAllocated, n.TaskCount)
+	}
+	got := getTask(t, m, tk.ID)
+	if got.State != task.Failed || got.Worker != "" || !strings.Contains(got.Error, "no such image") {
+		t.Errorf("rejected task is %v on %q with error %q; want Failed on no worker with the worker's error", got.State, got.Worker, got.Error)
+	}
+}
+
+func TestManagerFailPendingMovesStoredTask(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	m := New(nil, "roundrobin", "memory")
+	stored := &task.Task{ID: uuid.New(), Name: "web", State: task.Scheduled, RestartCount: 2}
+	if err := m.TaskDb.Put(stored.ID.String(), stored); err != nil {
+		t.Fatal(err)
+	}
+	stale := *stored
+	stale.RestartCount = 0
+	m.failPending(task.TaskEvent{ID: uuid.New(), State: task.Running, Task: stale}, "no room")
+
+	got := getTask(t, m, stored.ID)
+	if got.State != task.Failed || got.Error != "no room" || got.RestartCount != 2 {
+		t.Errorf("failed task is %v with error %q and %d restarts; want Failed with error %q and 2 restarts", got.State, got.Error, got.RestartCount, "no room")
+	}
+
+	// A task that is done already is left alone.
+	done := &task.Task{ID: uuid.New(), Name: "web", State: task.Completed}
+	m.TaskDb.Put(done.ID.String(), done)
+	m.failPending(task.TaskEvent{ID: uuid.New(), State: task.Running, Task: *done}, "no room")
+	if got := getTask(t, m, done.ID); got.State != task.Completed || got.Error != "" {
+		t.Errorf("completed task moved to %v with error %q", got.State, got.Error)
+	}
+}
+
+func TestPendingDelay(t *testing.T) {
+	m := &Manager{PendingBackoff: time.Second}
+	tests := []struct {
+		retries int
+		want    time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{4, 8 * time.Second},
+		{7, MaxPendingBackoff},
+		{100, MaxPendingBackoff},
+	}
+	for _, tt := range tests {
+		if got := m.pendingDelay(tt.retries); got != tt.want {
+			t.Errorf("pendingDelay(%d) = %v; want %v", tt.retries, got, tt.want)
+		}
+	}
+}
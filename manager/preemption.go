@@ -0,0 +1,141 @@
+package manager
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/MarouaneBouaricha/cube/node"
+	"github.com/MarouaneBouaricha/cube/task"
+	"github.com/google/uuid"
+)
+
+// placeByPreemption places t on a worker it fits on once tasks of a lower
+// priority are stopped there, stopping them and moving them back to the
+// pending queue. It returns the error of placing t if no worker would do.
+func (m *Manager) placeByPreemption(t *task.Task, placeErr error) (*node.Node, error) {
+	// The victims are unassigned and t assigned in their place at once, so
+	// that nothing else, the victims included, can take the room first.
+	m.mu.Lock()
+	worker, victims := m.preemptionVictimsLocked(*t)
+	if len(victims) == 0 {
+		m.mu.Unlock()
+		return nil, placeErr
+	}
+	for _, id := range victims {
+		m.unassignLocked(id)
+	}
+	n := m.nodeByName(worker)
+	attempt := m.newSchedulingAttempt(*t, []*node.Node{n})
+	attempt.Worker = worker
+	m.recordSchedulingAttemptLocked(t.ID, attempt)
+	m.assignLocked(t, worker)
+	m.mu.Unlock()
+
+	// The victims are only queued again once they are being stopped, so
+	// that a copy placed on their old worker is not stopped instead.
+	for _, id := range victims {
+		m.preemptTask(id, worker, *t)
+	}
+	return n, nil
+}
+
+// preemptionVictimsLocked returns the worker t fits on once the fewest
+// tasks of a lower priority are stopped there, the lowest priorities
+// breaking ties, along with those tasks. The caller must hold m.mu.
+func (m *Manager) preemptionVictimsLocked(t task.Task) (string, []uuid.UUID) {
+	var worker string
+	var victims []uuid.UUID
+	victimPriority := 0
+	for _, n := range m.availableNodes() {
+		ids := m.lowerPriorityTasksLocked(n.Name, t.Priority)
+		skip := make(map[uuid.UUID]bool)
+		for i, id := range ids {
+			skip[id] = true
+			c := *n
+			m.setAllocatedLocked(&c, skip)
+			if m.Scheduler.Filter(t, &c) != nil {
+				continue
+			}
+			// ids are sorted by priority, so the last one has the highest.
+			priority := m.allocations[id].priority
+			if victims == nil || i+1 < len(victims) || (i+1 == len(victims) && priority < victimPriority) {
+				worker = n.Name
+				victims = ids[:i+1]
+				victimPriority = priority
+			}
+			break
+		}
+	}
+	return worker, victims
+}
+
+// lowerPriorityTasksLocked returns the tasks holding resources on worker
+// whose priority is lower than priority, lowest first. Tasks that are
+// stopping or exited are left out, since they cannot be rescheduled. The
+// caller must hold m.mu.
+func (m *Manager) lowerPriorityTasksLocked(worker string, priority int) []uuid.UUID {
+	var ids []uuid.UUID
+	for id, a := range m.allocations {
+		if a.state == task.Stopping || a.state == task.Succeeded {
+			continue
+		}
+		if a.worker == worker && a.priority < priority {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		pi, pj := m.allocations[ids[i]].priority, m.allocations[ids[j]].priority
+		if pi != pj {
+			return pi < pj
+		}
+		return ids[i].String() < ids[j].String()
+	})
+	return ids
+}
+
+// preemptTask stops the task with the given ID, already unassigned from
+// worker to make room for t, and moves it back to the pending queue. The
+// preemption is recorded as a task event.
+func (m *Manager) preemptTask(id uuid.UUID, worker string, t task.Task) {
+	result, err := m.TaskDb.Get(id.String())
+	if err != nil {
+		log.Printf("[manager] unable to preempt task %s: %v\n", id, err)
+		return
+	}
+	victim := *result.(*task.Task)
+
+	te := task.TaskEvent{
+		ID:        uuid.New(),
+		State:     task.Completed,
+		Timestamp: time.Now().UTC(),
+		Task:      victim,
+		Reason:    fmt.Sprintf("preempted by task %s with priority %d", t.ID, t.Priority),
+	}
+	if err := m.EventDb.Put(te.ID.String(), &te); err != nil {
+		log.Printf("error attempting to store task event %s: %s\n", te.ID, err)
+	}
+	log.Printf("[manager] task %s with priority %d on worker %s %s\n", id, victim.Priority, worker, te.Reason)
+
+	rescheduled, err := m.updateTask(id, func(t *task.Task) error {
+		if err := t.Transition(task.Scheduled); err != nil {
+			return err
+		}
+		t.Worker = ""
+		t.ContainerID = ""
+		t.HostPorts = nil
+		return nil
+	})
+	m.stopTask(worker, id.String())
+	if err != nil {
+		log.Printf("[manager] unable to reschedule preempted task %s: %v\n", id, err)
+		return
+	}
+	m.AddTask(task.TaskEvent{
+		ID:        uuid.New(),
+		State:     task.Running,
+		Timestamp: time.Now().UTC(),
+		Task:      *rescheduled,
+	})
+}
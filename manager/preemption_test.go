@@ -0,0 +1,158 @@
+package manager
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/MarouaneBouaricha/cube/task"
+	"github.com/MarouaneBouaricha/cube/worker"
+	"github.com/google/uuid"
+)
+
+func TestManagerPreemptsLowerPriorityTasks(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	f := task.NewFake()
+	w, addr := startWorker(t, f)
+	go w.RunTasks(ctx)
+	m := New([]string{addr}, "binpack", "memory")
+	m.PendingBackoff = time.Hour
+	m.updateNodeStats()
+	cpus := float64(m.GetNodes()[0].Cpus)
+
+	// Each task takes every CPU of the worker.
+	send := func(priority int) task.Task {
+		t.Helper()
+		tk := task.Task{ID: uuid.New(), Name: "web", Image: "server", State: task.Scheduled, Cpu: cpus, Priority: priority}
+		m.AddTask(task.TaskEvent{ID: uuid.New(), State: task.Running, Timestamp: time.Now(), Task: tk})
+		m.SendWork()
+		return tk
+	}
+
+	low := send(1)
+	waitFor(t, func() bool { return len(f.Containers()) == 1 })
+
+	// Without preemption the task waits for room.
+	high := send(5)
+	if _, ok := m.workerFor(high.ID); ok {
+		t.Fatal("task placed on a worker without room")
+	}
+
+	m.Preemption = true
+	m.capacityChanged()
+	m.SendWork()
+	if got, _ := m.workerFor(high.ID); got != addr {
+		t.Fatalf("task assigned to %q; want %q", got, addr)
+	}
+	if _, ok := m.workerFor(low.ID); ok {
+		t.Error("preempted task still assigned")
+	}
+	if got := getTask(t, m, low.ID).State; got != task.Scheduled {
+		t.Errorf("preempted task state = %v; want %v", got, task.Scheduled)
+	}
+	// The worker stops the preempted task and starts the other one.
+	waitFor(t, func() bool {
+		m.updateTasks()
+		containers := f.Containers()
+		return len(containers) == 1 && containers[0] == getTask(t, m, high.ID).ContainerID
+	})
+
+	result, _ := m.EventDb.List()
+	var preemptions []*task.TaskEvent
+	for _, te := range result.([]*task.TaskEvent) {
+		if te.Reason != "" {
+			preemptions = append(preemptions, te)
+		}
+	}
+	if len(preemptions) != 1 || preemptions[0].Task.ID != low.ID || !strings.Contains(preemptions[0].Reason, "preempted by task "+high.ID.String()) {
+		t.Errorf("preemption events = %+v; want one for task %s", preemptions, low.ID)
+	}
+
+	// The preempted task is pending again but may not preempt in turn, nor
+	// may a task of equal priority.
+	m.SendWork()
+	same := send(5)
+	for _, id := range []uuid.UUID{low.ID, same.ID} {
+		if _, ok := m.workerFor(id); ok {
+			t.Errorf("task %s placed by preempting a task of higher or equal priority", id)
+		}
+	}
+	if got := m.GetSchedulingStats().Retrying; got != 2 {
+		t.Errorf("%d events waiting to be retried; want 2", got)
+	}
+}
+
+func TestManagerPreemptionQueuesVictimOnceStopped(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var m *Manager
+	var high task.Task
+	var queuedEarly, assignedLate atomic.Bool
+	f := task.NewFake()
+	w := worker.New("test-worker", "memory", f)
+	h := (&worker.Api{Worker: w}).Handler()
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		// Another dispatcher runs while the victim is being stopped.
+		if r.Method == http.MethodDelete {
+			queuedEarly.Store(m.GetSchedulingStats().QueueDepth != 0)
+			_, ok := m.workerFor(high.ID)
+			assignedLate.Store(!ok)
+			m.SendWork()
+		}
+		h.ServeHTTP(rw, r)
+	}))
+	defer srv.Close()
+	addr := strings.TrimPrefix(srv.URL, "http://")
+	go w.RunTasks(ctx)
+
+	m = New([]string{addr}, "binpack", "memory")
+	m.PendingBackoff = time.Hour
+	m.Preemption = true
+	m.updateNodeStats()
+	cpus := float64(m.GetNodes()[0].Cpus)
+
+	low := task.Task{ID: uuid.New(), Name: "batch", Image: "server", State: task.Scheduled, Cpu: cpus}
+	m.AddTask(task.TaskEvent{ID: uuid.New(), State: task.Running, Timestamp: time.Now(), Task: low})
+	m.SendWork()
+	waitFor(t, func() bool { return len(f.Containers()) == 1 })
+
+	high = task.Task{ID: uuid.New(), Name: "api", Image: "server", State: task.Scheduled, Cpu: cpus, Priority: 5}
+	m.AddTask(task.TaskEvent{ID: uuid.New(), State: task.Running, Timestamp: time.Now(), Task: high})
+	m.SendWork()
+	if queuedEarly.Load() {
+		t.Error("preempted task queued before it was stopped")
+	}
+	if assignedLate.Load() {
+		t.Error("preempting task not assigned by the time the victim was stopped")
+	}
+
+	// The victim waits for room rather than taking the place it left.
+	m.SendWork()
+	if got, _ := m.workerFor(high.ID); got != addr {
+		t.Errorf("preempting task assigned to %q; want %q", got, addr)
+	}
+	if _, ok := m.workerFor(low.ID); ok {
+		t.Error("preempted task placed again on a worker without room")
+	}
+	if got := m.GetSchedulingStats().Retrying; got != 1 {
+		t.Errorf("%d events waiting to be retried; want 1", got)
+	}
+	waitFor(t, func() bool {
+		m.updateTasks()
+		containers := f.Containers()
+		return len(containers) == 1 && containers[0] == getTask(t, m, high.ID).ContainerID
+	})
+}
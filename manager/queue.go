@@ -0,0 +1,65 @@
+package manager
+
+import (
+	"container/heap"
+
+	"github.com/MarouaneBouaricha/cube/task"
+)
+
+// PendingQueue holds the pending task events, those of the tasks with the
+// highest priority first and in the order they were added among tasks of
+// equal priority. The zero value is an empty queue.
+type PendingQueue struct {
+	events eventHeap
+	// added counts the events ever added, to order those of equal
+	// priority.
+	added uint64
+}
+
+func (q *PendingQueue) Enqueue(te task.TaskEvent) {
+	q.added++
+	heap.Push(&q.events, queuedEvent{event: te, seq: q.added})
+}
+
+// Dequeue removes and returns the first event, or returns false if the
+// queue is empty.
+func (q *PendingQueue) Dequeue() (task.TaskEvent, bool) {
+	if len(q.events) == 0 {
+		return task.TaskEvent{}, false
+	}
+	return heap.Pop(&q.events).(queuedEvent).event, true
+}
+
+func (q *PendingQueue) Len() int {
+	return len(q.events)
+}
+
+type queuedEvent struct {
+	event task.TaskEvent
+	seq   uint64
+}
+
+// eventHeap implements heap.Interface for PendingQueue.
+type eventHeap []queuedEvent
+
+func (h eventHeap) Len() int { return len(h) }
+
+func (h eventHeap) Less(i, j int) bool {
+	if pi, pj := h[i].event.Task.Priority, h[j].event.Task.Priority; pi != pj {
+		return pi > pj
+	}
+	return h[i].seq < h[j].seq
+}
+
+func (h eventHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *eventHeap) Push(x any) { *h = append(*h, x.(queuedEvent)) }
+
+func (h *eventHeap) Pop() any {
+	old := *h
+	n := len(old)
+	e := old[n-1]
+	old[n-1] = queuedEvent{}
+	*h = old[:n-1]
+	return e
+}
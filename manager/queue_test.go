@@ -0,0 +1,46 @@
+package manager
+
+import (
+	"testing"
+
+	"github.com/MarouaneBouaricha/cube/task"
+	"github.com/google/uuid"
+)
+
+func TestPendingQueueOrdersByPriority(t *testing.T) {
+	tests := []struct {
+		name       string
+		priorities []int
+		want       []int
+	}{
+		{"equal priorities keep their order", []int{0, 0, 0}, []int{0, 1, 2}},
+		{"higher priorities first", []int{1, 5, 3}, []int{1, 2, 0}},
+		{"negative priorities last", []int{-1, 0, 2, -1, 2}, []int{2, 4, 1, 0, 3}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var q PendingQueue
+			var events []task.TaskEvent
+			for _, p := range tt.priorities {
+				te := task.TaskEvent{ID: uuid.New(), Task: task.Task{Priority: p}}
+				events = append(events, te)
+				q.Enqueue(te)
+			}
+			if q.Len() != len(events) {
+				t.Fatalf("queue length = %d; want %d", q.Len(), len(events))
+			}
+			for _, i := range tt.want {
+				te, ok := q.Dequeue()
+				if !ok {
+					t.Fatal("queue empty too soon")
+				}
+				if te.ID != events[i].ID {
+					t.Errorf("dequeued event with priority %d; want event %d with priority %d", te.Task.Priority, i, tt.priorities[i])
+				}
+			}
+			if _, ok := q.Dequeue(); ok {
+				t.Error("queue not empty after dequeuing every event")
+			}
+		})
+	}
+}
@@ -0,0 +1,143 @@
+package manager
+
+import (
+	"errors"
+	"log"
+	"sort"
+
+	"github.com/MarouaneBouaricha/cube/task"
+	"github.com/google/uuid"
+)
+
+// Recover rebuilds the manager's in-memory state from its stores, so that a
+// manager restarted with persistent stores can keep managing the tasks it
+// already placed. Task assignments are reloaded and reconciled against the
+// tasks each worker reports, and events that had not been sent to a worker
+// yet are put back on the pending queue.
+func (m *Manager) Recover() {
+	m.recoverAssignments()
+	for _, w := range m.workers() {
+		m.reconcileWorker(w)
+	}
+	m.recoverPending()
+}
+
+func (m *Manager) recoverAssignments() {
+	for _, t := range m.GetTasks() {
+		if t.Worker == "" || t.State == task.Completed || t.State == task.Succeeded {
+			continue
+		}
+		if !m.isWorker(t.Worker) {
+			log.Printf("[manager] task %s is assigned to unknown worker %s\n", t.ID, t.Worker)
+		}
+		m.assign(t, t.Worker)
+	}
+}
+
+func (m *Manager) isWorker(name string) bool {
+	for _, w := range m.workers() {
+		if w == name {
+			return true
+		}
+	}
+	return false
+}
+
+// reconcileWorker updates the stored tasks with what worker reports. The
+// worker is trusted over the store: tasks it runs are (re)assigned to it,
+// and tasks assigned to it that it no longer knows about are marked Failed
+// so that they get restarted.
+func (m *Manager) reconcileWorker(worker string) {
+	tasks, err := getWorkerTasks(worker)
+	if err != nil {
+		log.Printf("[manager] unable to reconcile tasks with worker %s: %v\n", worker, err)
+		return
+	}
+
+	reported := make(map[uuid.UUID]bool)
+	for _, t := range tasks {
+		reported[t.ID] = true
+
+		_, err := m.updateTask(t.ID, func(taskPersisted *task.Task) error {
+			taskPersisted.Worker = worker
+			return mergeWorkerTask(taskPersisted, t)
+		})
+		if errors.Is(err, task.ErrInvalidTransition) {
+			log.Printf("[manager] ignoring stale report from worker %s: %v\n", worker, err)
+		} else if err != nil {
+			log.Printf("[manager] adopting task %s reported by worker %s\n", t.ID, worker)
+			adopted := *t
+			adopted.Worker = worker
+			m.taskMu.Lock()
+			m.TaskDb.Put(adopted.ID.String(), &adopted)
+			m.taskMu.Unlock()
+		}
+
+		if current, ok := m.workerFor(t.ID); !ok || current != worker {
+			m.unassign(t.ID)
+			m.assign(t, worker)
+		}
+	}
+
+	m.mu.RLock()
+	assigned := append([]uuid.UUID(nil), m.WorkerTaskMap[worker]...)
+	m.mu.RUnlock()
+	for _, id := range assigned {
+		if reported[id] {
+			continue
+		}
+		_, err := m.updateTask(id, func(t *task.Task) error {
+			switch t.State {
+			case task.Scheduled, task.Running, task.Restarting, task.Lost:
+				log.Printf("[manager] worker %s no longer knows task %s, marking it failed\n", worker, id)
+				return t.Transition(task.Failed)
+			}
+			return errSkip
+		})
+		if err != nil && err != errSkip {
+			log.Printf("[manager] %v\n", err)
+		}
+	}
+}
+
+// unassign removes the task from the worker it is assigned to.
+func (m *Manager) unassign(id uuid.UUID) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.unassignLocked(id)
+}
+
+// unassignLocked removes the task from the worker it is assigned to,
+// releasing what it holds there. The caller must hold m.mu.
+func (m *Manager) unassignLocked(id uuid.UUID) {
+	w, ok := m.TaskWorkerMap[id]
+	if !ok {
+		return
+	}
+	delete(m.TaskWorkerMap, id)
+	m.releaseLocked(id)
+	ids := m.WorkerTaskMap[w]
+	for i := range ids {
+		if ids[i] == id {
+			m.WorkerTaskMap[w] = append(ids[:i], ids[i+1:]...)
+			break
+		}
+	}
+}
+
+func (m *Manager) recoverPending() {
+	result, err := m.PendingDb.List()
+	if err != nil {
+		log.Printf("[manager] unable to load pending events: %v\n", err)
+		return
+	}
+
+	events := result.([]*task.TaskEvent)
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].Timestamp.Before(events[j].Timestamp)
+	})
+	for _, te := range events {
+		log.Printf("[manager] recovered pending event %s for task %s\n", te.ID, te.Task.ID)
+		m.AddTask(*te)
+	}
+}
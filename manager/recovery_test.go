@@ -0,0 +1,93 @@
+package manager
+
+import (
+	"context"
+	"io"
+	"log"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/MarouaneBouaricha/cube/task"
+	"github.com/google/uuid"
+)
+
+// inTempDir runs the test from an empty directory, since persistent stores
+// are created in the working directory.
+func inTempDir(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+}
+
+func TestManagerRecover(t *testing.T) {
+	log.SetOutput(io.Discard)
+	inTempDir(t)
+
+	f := task.NewFake()
+	w, addr := startWorker(t, f)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go w.RunTasks(ctx)
+
+	m := New([]string{addr}, "roundrobin", "persistent")
+	var ids []uuid.UUID
+	for i := 0; i < 3; i++ {
+		tk := task.Task{ID: uuid.New(), Name: "web", Image: "server", State: task.Scheduled}
+		ids = append(ids, tk.ID)
+		m.AddTask(task.TaskEvent{ID: uuid.New(), State: task.Running, Timestamp: time.Now(), Task: tk})
+	}
+	// Send the first two tasks and leave the third one pending.
+	m.SendWork()
+	m.SendWork()
+	waitFor(t, func() bool { return len(f.Containers()) == 2 })
+
+	// The worker forgets about the second task, e.g. because it was
+	// restarted with an in-memory store.
+	if err := w.Db.Delete(ids[1].String()); err != nil {
+		t.Fatal(err)
+	}
+	m.Close()
+
+	m = New([]string{addr}, "roundrobin", "persistent")
+	defer m.Close()
+	m.Recover()
+
+	if got, _ := m.workerFor(ids[0]); got != addr {
+		t.Errorf("task 0 assigned to %q after recovery; want %q", got, addr)
+	}
+	if got := m.GetSchedulingStats().QueueDepth; got != 1 {
+		t.Errorf("pending queue depth = %d; want 1", got)
+	}
+
+	states := map[uuid.UUID]task.State{}
+	for _, tk := range m.GetTasks() {
+		states[tk.ID] = tk.State
+	}
+	if states[ids[0]] != task.Running {
+		t.Errorf("task 0 state = %v; want %v", states[ids[0]], task.Running)
+	}
+	if states[ids[1]] != task.Failed {
+		t.Errorf("task 1 state = %v; want %v", states[ids[1]], task.Failed)
+	}
+
+	// The recovered manager can still stop a task placed before the restart.
+	result, _ := m.TaskDb.Get(ids[0].String())
+	stopped := *result.(*task.Task)
+	m.AddTask(task.TaskEvent{ID: uuid.New(), State: task.Completed, Timestamp: time.Now(), Task: stopped})
+	m.SendWork()
+	m.SendWork()
+	waitFor(t, func() bool {
+		for _, id := range f.Containers() {
+			if id == stopped.ContainerID {
+				return false
+			}
+		}
+		return true
+	})
+}
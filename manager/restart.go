@@ -0,0 +1,130 @@
+package manager
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/MarouaneBouaricha/cube/task"
+)
+
+const (
+	// DefaultRestartInterval is how often the manager looks for tasks to
+	// restart unless configured otherwise.
+	DefaultRestartInterval = time.Second
+	// DefaultMaxRetries is the number of consecutive restarts of a task
+	// unless the task or the manager sets another.
+	DefaultMaxRetries = 3
+	// DefaultRestartBackoff is the first crash-loop delay unless the task
+	// or the manager sets another.
+	DefaultRestartBackoff = 10 * time.Second
+	// MaxRestartBackoff caps the delay between restarts of a crash-looping
+	// task.
+	MaxRestartBackoff = 5 * time.Minute
+
+	// restartResetAfter is how long a task has to run for its earlier
+	// restarts to no longer count against its retries.
+	restartResetAfter = 10 * time.Minute
+)
+
+// RestartTasks restarts the tasks that exited as their restart policy asks,
+// until ctx is cancelled. A task is restarted right away the first time;
+// if it fails again it goes into CrashLoopBackOff and waits for an
+// exponentially growing delay before each further restart.
+func (m *Manager) RestartTasks(ctx context.Context) {
+	ticker := time.NewTicker(m.RestartInterval)
+	defer ticker.Stop()
+	for {
+		m.restartTasks()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (m *Manager) restartTasks() {
+	now := time.Now().UTC()
+	for _, t := range m.GetTasks() {
+		switch t.State {
+		case task.Failed, task.Succeeded:
+			m.handleExit(t, now)
+		case task.CrashLoopBackOff:
+			if !now.Before(t.NextRestart) {
+				log.Printf("[manager] backoff of task %s is over, restarting it\n", t.ID)
+				m.restartTask(t)
+			}
+		}
+	}
+}
+
+// handleExit applies the restart policy of a task that exited.
+func (m *Manager) handleExit(t *task.Task, now time.Time) {
+	// Tasks failed before they were placed never ran.
+	if t.Worker == "" && t.Error != "" {
+		return
+	}
+	if !t.RestartPolicy.Restarts(t.State) {
+		return
+	}
+
+	if t.RestartCount > 0 && !t.StartTime.IsZero() && t.FinishTime.Sub(t.StartTime) >= restartResetAfter {
+		updated, err := m.updateTask(t.ID, func(t *task.Task) error {
+			t.RestartCount = 0
+			return nil
+		})
+		if err != nil {
+			log.Printf("[manager] %v\n", err)
+			return
+		}
+		t = updated
+	}
+	if m.retriesExhausted(t) {
+		return
+	}
+
+	if t.RestartCount == 0 {
+		log.Printf("[manager] task %s is %v, restarting it\n", t.ID, t.State)
+		m.restartTask(t)
+		return
+	}
+
+	delay := m.restartDelay(t)
+	_, err := m.updateTask(t.ID, func(t *task.Task) error {
+		t.NextRestart = now.Add(delay)
+		return t.Transition(task.CrashLoopBackOff)
+	})
+	if err != nil {
+		log.Printf("[manager] %v\n", err)
+		return
+	}
+	log.Printf("[manager] task %s is crash looping, restarting it in %v\n", t.ID, delay)
+}
+
+// retriesExhausted reports whether t has been restarted as many times in a
+// row as it may be.
+func (m *Manager) retriesExhausted(t *task.Task) bool {
+	max := t.MaxRetries
+	if max == 0 {
+		max = m.MaxRetries
+	}
+	return max >= 0 && t.RestartCount >= max
+}
+
+// restartDelay returns how long t waits in CrashLoopBackOff: its backoff,
+// doubled for every restart after the first, up to MaxRestartBackoff.
+func (m *Manager) restartDelay(t *task.Task) time.Duration {
+	delay := time.Duration(t.RestartBackoff)
+	if delay <= 0 {
+		delay = m.RestartBackoff
+	}
+	for i := 1; i < t.RestartCount && delay < MaxRestartBackoff; i++ {
+		delay *= 2
+	}
+	if delay > MaxRestartBackoff {
+		delay = MaxRestartBackoff
+	}
+	return delay
+}
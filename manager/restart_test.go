@@ -0,0 +1,215 @@
+package manager
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/MarouaneBouaricha/cube/task"
+	"github.com/MarouaneBouaricha/cube/worker"
+	"github.com/google/uuid"
+)
+
+func TestManagerRestartDelay(t *testing.T) {
+	m := New(nil, "roundrobin", "memory")
+	m.RestartBackoff = time.Second
+
+	tests := []struct {
+		name    string
+		task    task.Task
+		want    time.Duration
+		retries bool
+	}{
+		{"first crash loop", task.Task{RestartCount: 1}, time.Second, false},
+		{"doubles every restart", task.Task{RestartCount: 3}, 4 * time.Second, true},
+		{"task backoff", task.Task{RestartCount: 2, RestartBackoff: task.Duration(time.Minute)}, 2 * time.Minute, false},
+		{"capped", task.Task{RestartCount: 40, MaxRetries: -1}, MaxRestartBackoff, false},
+		{"task retries", task.Task{RestartCount: 5, MaxRetries: 5}, 16 * time.Second, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := m.restartDelay(&tt.task); got != tt.want {
+				t.Errorf("restartDelay() = %v; want %v", got, tt.want)
+			}
+			if got := m.retriesExhausted(&tt.task); got != tt.retries {
+				t.Errorf("retriesExhausted() = %v; want %v", got, tt.retries)
+			}
+		})
+	}
+}
+
+func TestManagerRestartsCrashingTask(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	f := task.NewFake()
+	f.Script("crash", task.FakeBehavior{ExitAfter: 5 * time.Millisecond, ExitCode: 1})
+	f.Script("batch", task.FakeBehavior{ExitAfter: 5 * time.Millisecond})
+	w, addr := startWorker(t, f)
+	w.UpdateInterval = 5 * time.Millisecond
+	go w.RunTasks(ctx)
+	go w.UpdateTasks(ctx)
+
+	m := New([]string{addr}, "roundrobin", "memory")
+	m.UpdateInterval = 5 * time.Millisecond
+	m.RestartInterval = 5 * time.Millisecond
+	go m.UpdateTasks(ctx)
+	go m.RestartTasks(ctx)
+
+	crash := task.Task{ID: uuid.New(), Name: "crash", Image: "crash", MaxRetries: 2, RestartBackoff: task.Duration(50 * time.Millisecond)}
+	never := task.Task{ID: uuid.New(), Name: "never", Image: "crash", RestartPolicy: task.RestartNever}
+	batch := task.Task{ID: uuid.New(), Name: "batch", Image: "batch"}
+	always := task.Task{ID: uuid.New(), Name: "always", Image: "batch", RestartPolicy: task.RestartAlways, MaxRetries: 1}
+	for _, tk := range []task.Task{crash, never, batch, always} {
+		m.AddTask(task.TaskEvent{ID: uuid.New(), State: task.Running, Timestamp: time.Now(), Task: tk})
+		m.SendWork()
+	}
+
+	// The first restart is immediate, the second one waits for the backoff.
+	waitFor(t, func() bool { return getTask(t, m, crash.ID).State == task.CrashLoopBackOff })
+	if got := getTask(t, m, crash.ID).RestartCount; got != 1 {
+		t.Errorf("restart count = %d when crash looping; want 1", got)
+	}
+	waitFor(t, func() bool {
+		tk := getTask(t, m, crash.ID)
+		return tk.State == task.Failed && tk.RestartCount == 2
+	})
+	waitFor(t, func() bool { return getTask(t, m, always.ID).RestartCount == 1 })
+
+	time.Sleep(100 * time.Millisecond)
+	tests := []struct {
+		task     task.Task
+		state    task.State
+		restarts int
+	}{
+		{crash, task.Failed, 2},
+		{never, task.Failed, 0},
+		{batch, task.Succeeded, 0},
+		{always, task.Succeeded, 1},
+	}
+	for _, tt := range tests {
+		got := getTask(t, m, tt.task.ID)
+		if got.State != tt.state || got.RestartCount != tt.restarts {
+			t.Errorf("task %s is %v after %d restarts; want %v after %d", tt.task.Name, got.State, got.RestartCount, tt.state, tt.restarts)
+		}
+	}
+}
+
+func TestManagerRestartsUnhealthyTask(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	f := task.NewFake()
+	f.Script("unhealthy", task.FakeBehavior{Exec: func(cmd []string) (int, string) { return 1, "not ready" }})
+	w, addr := startWorker(t, f)
+	w.UpdateInterval = 5 * time.Millisecond
+	w.HealthCheckInterval = 5 * time.Millisecond
+	go w.RunTasks(ctx)
+	go w.UpdateTasks(ctx)
+	go w.CheckHealth(ctx)
+
+	m := New([]string{addr}, "roundrobin", "memory")
+	m.UpdateInterval = 5 * time.Millisecond
+	m.HealthCheckInterval = 5 * time.Millisecond
+	go m.UpdateTasks(ctx)
+	go m.DoHealthChecks(ctx)
+
+	health := &task.HealthCheckSpec{
+		Exec:             &task.ExecHealthCheck{Command: []string{"check"}},
+		Interval:         task.Duration(5 * time.Millisecond),
+		FailureThreshold: 2,
+	}
+	unhealthy := task.Task{ID: uuid.New(), Name: "unhealthy", Image: "unhealthy", Health: health, MaxRetries: 1}
+	never := task.Task{ID: uuid.New(), Name: "never", Image: "unhealthy", Health: health, RestartPolicy: task.RestartNever}
+	for _, tk := range []task.Task{unhealthy, never} {
+		m.AddTask(task.TaskEvent{ID: uuid.New(), State: task.Running, Timestamp: time.Now(), Task: tk})
+		m.SendWork()
+	}
+
+	waitFor(t, func() bool { return getTask(t, m, unhealthy.ID).RestartCount == 1 })
+	waitFor(t, func() bool {
+		tk := getTask(t, m, unhealthy.ID)
+		return tk.State == task.Running && tk.HealthStatus.Status == task.HealthUnhealthy
+	})
+	waitFor(t, func() bool { return getTask(t, m, never.ID).HealthStatus.Status == task.HealthUnhealthy })
+
+	time.Sleep(50 * time.Millisecond)
+	if got := getTask(t, m, unhealthy.ID).RestartCount; got != 1 {
+		t.Errorf("unhealthy task restarted %d times; want 1", got)
+	}
+	if got := getTask(t, m, never.ID); got.State != task.Running || got.RestartCount != 0 {
+		t.Errorf("task that never restarts is %v after %d restarts", got.State, got.RestartCount)
+	}
+}
+
+func TestManagerRestartsTaskOfGoneWorkerElsewhere(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	f := task.NewFake()
+	w, addr := startWorker(t, f)
+	go w.RunTasks(ctx)
+	m := New([]string{addr}, "roundrobin", "memory")
+
+	// The task succeeded on a worker that is no longer in the cluster.
+	tk := &task.Task{ID: uuid.New(), Name: "web", Image: "server", State: task.Succeeded, Worker: "gone:1",
+		RestartPolicy: task.RestartAlways, ContainerID: "old"}
+	m.TaskDb.Put(tk.ID.String(), tk)
+	m.assign(tk, "gone:1")
+
+	m.restartTasks()
+	got := getTask(t, m, tk.ID)
+	if got.State != task.Scheduled || got.Worker != "" || got.ContainerID != "" || got.RestartCount != 1 {
+		t.Fatalf("task is %v on %q with container %q after %d restarts; want Scheduled on no worker after 1", got.State, got.Worker, got.ContainerID, got.RestartCount)
+	}
+	if _, ok := m.workerFor(tk.ID); ok {
+		t.Error("task still assigned to the gone worker")
+	}
+
+	m.SendWork()
+	waitFor(t, func() bool { return len(f.Containers()) == 1 })
+	if got, _ := m.workerFor(tk.ID); got != addr {
+		t.Errorf("task assigned to %q; want %q", got, addr)
+	}
+}
+
+func TestManagerBacksOffRestartRejectedByWorker(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(worker.ErrResponse{HTTPStatusCode: http.StatusBadRequest, Message: "no such image"})
+	}))
+	defer srv.Close()
+	addr := strings.TrimPrefix(srv.URL, "http://")
+
+	m := New([]string{addr}, "roundrobin", "memory")
+	tk := &task.Task{ID: uuid.New(), Name: "web", Image: "server", State: task.Failed, Worker: addr}
+	m.TaskDb.Put(tk.ID.String(), tk)
+	m.assign(tk, addr)
+
+	m.restartTasks()
+	got := getTask(t, m, tk.ID)
+	if got.State != task.Failed || got.RestartCount != 1 || !strings.Contains(got.Error, "no such image") {
+		t.Fatalf("task is %v after %d restarts with error %q; want Failed after 1 with the worker's error", got.State, got.RestartCount, got.Error)
+	}
+
+	// The failed restart counts, so the next one waits for the backoff.
+	m.restartTasks()
+	if got := getTask(t, m, tk.ID).State; got != task.CrashLoopBackOff {
+		t.Errorf("task state = %v; want %v", got, task.CrashLoopBackOff)
+	}
+}
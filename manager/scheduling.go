@@ -0,0 +1,96 @@
+package manager
+
+import (
+	"time"
+
+	"github.com/MarouaneBouaricha/cube/node"
+	"github.com/MarouaneBouaricha/cube/task"
+	"github.com/google/uuid"
+)
+
+// maxSchedulingAttempts is the number of scheduling attempts kept per task.
+const maxSchedulingAttempts = 10
+
+// SchedulingAttempt records a run of the scheduler for a task: what it made
+// of every worker, and the worker it picked if any.
+type SchedulingAttempt struct {
+	Time  time.Time
+	Nodes []NodeDecision
+	// Worker is the worker the task was placed on, empty if there was
+	// none.
+	Worker string `json:",omitempty"`
+	// Error is why the task could not be placed.
+	Error string `json:",omitempty"`
+}
+
+// NodeDecision is what the scheduler made of a worker for a task.
+type NodeDecision struct {
+	Node string
+	// Reason is why the worker was left out; empty for candidates.
+	Reason string `json:",omitempty"`
+	// Candidate workers were scored, lower scores being better.
+	Candidate bool
+	Score     float64
+}
+
+// newSchedulingAttempt returns an attempt leaving out the nodes that are
+// not healthy and the ones the scheduler filters out for t. The caller must
+// hold m.mu.
+func (m *Manager) newSchedulingAttempt(t task.Task, candidates []*node.Node) *SchedulingAttempt {
+	a := &SchedulingAttempt{Time: time.Now().UTC()}
+	isCandidate := make(map[string]bool)
+	for _, n := range candidates {
+		isCandidate[n.Name] = true
+	}
+	for _, n := range m.WorkerNodes {
+		d := NodeDecision{Node: n.Name, Candidate: isCandidate[n.Name]}
+		switch {
+		case d.Candidate:
+		case n.Status != node.Healthy:
+			d.Reason = "node is " + n.Status.String()
+		default:
+			if err := m.Scheduler.Filter(t, n); err != nil {
+				d.Reason = err.Error()
+			}
+		}
+		a.Nodes = append(a.Nodes, d)
+	}
+	return a
+}
+
+// recordSchedulingAttemptLocked keeps a for the task, dropping its oldest
+// attempts beyond maxSchedulingAttempts. The caller must hold m.mu.
+func (m *Manager) recordSchedulingAttemptLocked(id uuid.UUID, a *SchedulingAttempt) {
+	attempts := append(m.attempts[id], *a)
+	if len(attempts) > maxSchedulingAttempts {
+		attempts = attempts[len(attempts)-maxSchedulingAttempts:]
+	}
+	m.attempts[id] = attempts
+}
+
+// forgetSchedulingAttempts drops the scheduling attempts of t once it is
+// done for good, as they no longer explain where it runs or may end up.
+func (m *Manager) forgetSchedulingAttempts(t *task.Task) {
+	switch t.State {
+	case task.Completed:
+	case task.Failed, task.Succeeded:
+		placed := t.Worker != "" || t.Error == ""
+		if placed && t.RestartPolicy.Restarts(t.State) && !m.retriesExhausted(t) {
+			return
+		}
+	default:
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.attempts, t.ID)
+}
+
+// SchedulingAttempts returns the latest scheduling attempts of the task,
+// oldest first.
+func (m *Manager) SchedulingAttempts(id uuid.UUID) []SchedulingAttempt {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return append([]SchedulingAttempt{}, m.attempts[id]...)
+}
@@ -0,0 +1,93 @@
+package manager
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/MarouaneBouaricha/cube/task"
+)
+
+// SchedulingStats reports on the pending queue and on how long task events
+// wait in it before being handed to a worker.
+type SchedulingStats struct {
+	// QueueDepth is the number of events waiting in the pending queue.
+	QueueDepth int
+	// Retrying is the number of events waiting to be sent again after
+	// they could not be.
+	Retrying int
+	// Dispatched is the number of events delivered to a worker.
+	Dispatched int
+	// Dropped is the number of events that could not be delivered.
+	Dropped        int
+	LastLatency    time.Duration
+	AverageLatency time.Duration
+	MaxLatency     time.Duration
+}
+
+type schedulingStats struct {
+	mu           sync.Mutex
+	dispatched   int
+	dropped      int
+	last         time.Duration
+	max          time.Duration
+	totalLatency time.Duration
+}
+
+// dispatched records the outcome of sending te, along with the time it spent
+// between being added and being delivered.
+func (m *Manager) dispatched(te task.TaskEvent, delivered bool) {
+	err := m.PendingDb.Delete(te.ID.String())
+	if err != nil {
+		log.Printf("error removing pending event %s: %v\n", te.ID, err)
+	}
+
+	m.pendingMu.Lock()
+	enqueued, ok := m.enqueuedAt[te.ID]
+	delete(m.enqueuedAt, te.ID)
+	delete(m.retries, te.ID)
+	m.pendingMu.Unlock()
+
+	s := &m.stats
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !delivered {
+		s.dropped++
+		return
+	}
+
+	s.dispatched++
+	if !ok {
+		return
+	}
+	latency := time.Since(enqueued)
+	s.last = latency
+	s.totalLatency += latency
+	if latency > s.max {
+		s.max = latency
+	}
+}
+
+func (m *Manager) GetSchedulingStats() SchedulingStats {
+	m.pendingMu.Lock()
+	depth := m.Pending.Len()
+	retrying := len(m.backoff)
+	m.pendingMu.Unlock()
+
+	s := &m.stats
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stats := SchedulingStats{
+		QueueDepth:  depth,
+		Retrying:    retrying,
+		Dispatched:  s.dispatched,
+		Dropped:     s.dropped,
+		LastLatency: s.last,
+		MaxLatency:  s.max,
+	}
+	if s.dispatched > 0 {
+		stats.AverageLatency = s.totalLatency / time.Duration(s.dispatched)
+	}
+	return stats
+}
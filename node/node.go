@@ -7,29 +7,98 @@ import (
 	"io"
 	"log"
 	"net/http"
+	"time"
 
 	"github.com/MarouaneBouaricha/cube/stats"
 	"github.com/MarouaneBouaricha/cube/utils"
 )
 
+type Status int
+
+const (
+	Healthy Status = iota
+	Unhealthy
+)
+
+func (s Status) String() string {
+	switch s {
+	case Healthy:
+		return "Healthy"
+	case Unhealthy:
+		return "Unhealthy"
+	default:
+		return fmt.Sprintf("Status(%d)", int(s))
+	}
+}
+
 type Node struct {
-	Name            string
-	Ip              string
-	Api             string
+	Name string
+	Ip   string
+	Api  string
+	// Memory is the memory of the node in KiB, and MemoryAllocated the
+	// part of it reserved by the tasks assigned to the node.
 	Memory          int64
 	MemoryAllocated int64
-	Disk            int64
-	DiskAllocated   int64
-	Stats           stats.Stats
-	Role            string
-	TaskCount       int
+	// Disk is the disk space of the node in bytes, and DiskAllocated the
+	// part of it reserved by the tasks assigned to the node.
+	Disk          int64
+	DiskAllocated int64
+	// Cpus is the number of CPUs of the node, and CpuAllocated the number
+	// of them reserved by the tasks assigned to the node.
+	Cpus         int
+	CpuAllocated float64
+	// CpuUsage is the fraction of CPU time the node was busy between the
+	// last two times its stats were collected.
+	CpuUsage float64
+	// PortsAllocated are the host ports, in port/protocol form, reserved by
+	// tasks assigned to the node.
+	PortsAllocated []string
+	// Labels are the key/value pairs the worker advertises, which tasks
+	// select nodes by.
+	Labels map[string]string `json:",omitempty"`
+	// Taints, in key=value form, keep tasks that do not tolerate them off
+	// the node.
+	Taints []string `json:",omitempty"`
+	// TaskLabels are the labels of the tasks assigned to the node, by task
+	// ID, which affinity rules are checked against.
+	TaskLabels map[string]map[string]string `json:",omitempty"`
+	Stats      stats.Stats
+	Role       string
+	// TaskCount is the number of tasks holding resources on the node.
+	TaskCount int
+	Status    Status
+	// Cordoned nodes keep running their tasks but get no new ones.
+	Cordoned bool
+	// RegisteredAt is when the node joined the cluster.
+	RegisteredAt time.Time
+	// BootID is the boot ID the worker last registered with.
+	BootID string `json:",omitempty"`
+	// LastSeen is the last time the manager heard from the node.
+	LastSeen time.Time
+	// MissedHeartbeats counts the checks that failed since LastSeen.
+	MissedHeartbeats int
+}
+
+// Registration is sent by a worker to join a manager's cluster.
+type Registration struct {
+	// Address is the host:port the worker API is reachable at. It is also
+	// the name of the node.
+	Address string
+	// Labels are the labels of the worker.
+	Labels map[string]string `json:",omitempty"`
+	// Taints are the taints of the worker, in key=value form.
+	Taints []string `json:",omitempty"`
+	// BootID changes every time the worker starts, which tells a worker
+	// that restarted from one renewing its registration.
+	BootID string `json:",omitempty"`
 }
 
 func NewNode(name string, api string, role string) *Node {
 	return &Node{
-		Name: name,
-		Api:  api,
-		Role: role,
+		Name:         name,
+		Api:          api,
+		Role:         role,
+		RegisteredAt: time.Now().UTC(),
 	}
 }
 
@@ -65,8 +134,14 @@ func (n *Node) GetStats() (*stats.Stats, error) {
 		return nil, fmt.Errorf("error getting stats from node %s", n.Name)
 	}
 
+	if n.Stats.CpuStats != nil {
+		n.CpuUsage = stats.CpuUsageSince(&n.Stats)
+	}
 	n.Memory = int64(stats.MemTotalKb())
 	n.Disk = int64(stats.DiskTotal())
+	n.Cpus = stats.CpuCount
+	n.Labels = stats.Labels
+	n.Taints = stats.Taints
 	n.Stats = stats
 
 	return &n.Stats, nil
@@ -0,0 +1,41 @@
+package scheduler
+
+import (
+	"github.com/MarouaneBouaricha/cube/node"
+	"github.com/MarouaneBouaricha/cube/task"
+)
+
+// BinPack places tasks on the node they fit best, the one with the least
+// resources left once the task is placed. It consolidates tasks on as few
+// nodes as possible, leaving whole nodes free.
+type BinPack struct {
+	Name string
+}
+
+func (b *BinPack) SelectCandidateNodes(t task.Task, nodes []*node.Node) []*node.Node {
+	return selectCandidates(t, nodes, b.Filter)
+}
+
+func (b *BinPack) Filter(t task.Task, n *node.Node) error {
+	return filterAll(t, n, filterSchedulable, filterLabels, filterTaints, filterPorts, filterResources)
+}
+
+// Score scores nodes with the fraction of their resources that would be
+// left once t is placed on them. Nodes that do not know their capacity yet
+// score as if empty.
+func (b *BinPack) Score(t task.Task, nodes []*node.Node) map[string]float64 {
+	nodeScores := make(map[string]float64)
+	for _, n := range nodes {
+		used, ok := utilization(t, n)
+		if !ok {
+			nodeScores[n.Name] = 1.0
+			continue
+		}
+		nodeScores[n.Name] = 1.0 - used
+	}
+	return nodeScores
+}
+
+func (b *BinPack) Pick(scores map[string]float64, candidates []*node.Node) *node.Node {
+	return pickLowest(scores, candidates)
+}
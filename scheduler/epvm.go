@@ -1,9 +1,7 @@
 package scheduler
 
 import (
-	"log"
 	"math"
-	"time"
 
 	"github.com/MarouaneBouaricha/cube/node"
 	"github.com/MarouaneBouaricha/cube/task"
@@ -14,16 +12,11 @@ type Epvm struct {
 }
 
 func (e *Epvm) SelectCandidateNodes(t task.Task, nodes []*node.Node) []*node.Node {
-	var candidates []*node.Node
-	for node := range nodes {
-
-		if checkDisk(t, nodes[node].Disk-nodes[node].DiskAllocated) {
-			candidates = append(candidates, nodes[node])
-		}
-
-	}
+	return selectCandidates(t, nodes, e.Filter)
+}
 
-	return candidates
+func (e *Epvm) Filter(t task.Task, n *node.Node) error {
+	return filterAll(t, n, filterSchedulable, filterLabels, filterTaints, filterPorts, filterResources)
 }
 
 func (e *Epvm) Score(t task.Task, nodes []*node.Node) map[string]float64 {
@@ -31,19 +24,23 @@ func (e *Epvm) Score(t task.Task, nodes []*node.Node) map[string]float64 {
 	maxJobs := 4.0
 
 	for _, node := range nodes {
-		cpuUsage, err := calculateCpuUsage(node)
-		if err != nil {
-			log.Printf("error calculating CPU usage for node %s, skipping: %v\n", node.Name, err)
-			continue
+		// CPU usage is measured when node stats are collected, since
+		// sampling it here would hold up scheduling.
+		cpuLoad := calculateLoad(node.CpuUsage, math.Pow(2, 0.8))
+		newCpuLoad := cpuLoad
+		if node.Cpus > 0 {
+			newCpuLoad += calculateLoad(t.Cpu, float64(node.Cpus))
 		}
-		cpuLoad := calculateLoad(*cpuUsage, math.Pow(2, 0.8))
 
-		memoryAllocated := float64(node.Stats.MemUsedKb()) + float64(node.MemoryAllocated)
+		memoryAllocated := float64(node.MemoryAllocated)
+		if node.Stats.MemStats != nil {
+			memoryAllocated += float64(node.Stats.MemUsedKb())
+		}
 		memoryPercentAllocated := memoryAllocated / float64(node.Memory)
 
-		newMemPercent := (calculateLoad(memoryAllocated+float64(t.Memory/1000), float64(node.Memory)))
+		newMemPercent := (calculateLoad(memoryAllocated+float64(t.Memory/1024), float64(node.Memory)))
 		memCost := math.Pow(LIEB, newMemPercent) + math.Pow(LIEB, (float64(node.TaskCount+1))/maxJobs) - math.Pow(LIEB, memoryPercentAllocated) - math.Pow(LIEB, float64(node.TaskCount)/float64(maxJobs))
-		cpuCost := math.Pow(LIEB, cpuLoad) + math.Pow(LIEB, (float64(node.TaskCount+1))/maxJobs) - math.Pow(LIEB, cpuLoad) - math.Pow(LIEB, float64(node.TaskCount)/float64(maxJobs))
+		cpuCost := math.Pow(LIEB, newCpuLoad) + math.Pow(LIEB, (float64(node.TaskCount+1))/maxJobs) - math.Pow(LIEB, cpuLoad) - math.Pow(LIEB, float64(node.TaskCount)/float64(maxJobs))
 
 		nodeScores[node.Name] = memCost + cpuCost
 	}
@@ -68,6 +65,18 @@ func (e *Epvm) Pick(scores map[string]float64, candidates []*node.Node) *node.No
 	return bestNode
 }
 
+// checkCpu reports whether the CPUs of n not yet allocated cover what t
+// requests.
+func checkCpu(t task.Task, n *node.Node) bool {
+	return t.Cpu <= float64(n.Cpus)-n.CpuAllocated
+}
+
+// checkMemory reports whether the memory of n not yet allocated covers what
+// t requests. Nodes count memory in KiB.
+func checkMemory(t task.Task, n *node.Node) bool {
+	return t.Memory/1024 <= n.Memory-n.MemoryAllocated
+}
+
 func checkDisk(t task.Task, diskAvailable int64) bool {
 	return t.Disk <= diskAvailable
 }
@@ -75,37 +84,3 @@ func checkDisk(t task.Task, diskAvailable int64) bool {
 func calculateLoad(usage float64, capacity float64) float64 {
 	return usage / capacity
 }
-
-// See discussion from this StackOverflow thread:
-// https://stackoverflow.com/questions/23367857/accurate-calculation-of-cpu-usage-given-in-percentage-in-linux
-func calculateCpuUsage(node *node.Node) (*float64, error) {
-	stat1, err := node.GetStats()
-	if err != nil {
-		return nil, err
-	}
-	time.Sleep(3 * time.Second)
-	stat2, err := node.GetStats()
-	if err != nil {
-		return nil, err
-	}
-
-	stat1Idle := stat1.CpuStats.Idle + stat1.CpuStats.IOWait
-	stat2Idle := stat2.CpuStats.Idle + stat2.CpuStats.IOWait
-
-	stat1NonIdle := stat1.CpuStats.User + stat1.CpuStats.Nice + stat1.CpuStats.System + stat1.CpuStats.IRQ + stat1.CpuStats.SoftIRQ + stat1.CpuStats.Steal
-	stat2NonIdle := stat2.CpuStats.User + stat2.CpuStats.Nice + stat2.CpuStats.System + stat2.CpuStats.IRQ + stat2.CpuStats.SoftIRQ + stat2.CpuStats.Steal
-
-	stat1Total := stat1Idle + stat1NonIdle
-	stat2Total := stat2Idle + stat2NonIdle
-
-	total := stat2Total - stat1Total
-	idle := stat2Idle - stat1Idle
-
-	var cpuPercentUsage float64
-	if total == 0 && idle == 0 {
-		cpuPercentUsage = 0.00
-	} else {
-		cpuPercentUsage = (float64(total) - float64(idle)) / float64(total)
-	}
-	return &cpuPercentUsage, nil
-}
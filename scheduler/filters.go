@@ -0,0 +1,91 @@
+package scheduler
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/MarouaneBouaricha/cube/node"
+	"github.com/MarouaneBouaricha/cube/task"
+)
+
+// filterSchedulable returns why no task may be placed on n if it is
+// cordoned. Schedulers must leave out such nodes.
+func filterSchedulable(t task.Task, n *node.Node) error {
+	if n.Cordoned {
+		return errors.New("node is cordoned")
+	}
+	return nil
+}
+
+// filterResources returns why n cannot be placed t on if the CPUs, memory
+// or disk of n not yet allocated do not cover what t requests.
+func filterResources(t task.Task, n *node.Node) error {
+	if !checkCpu(t, n) {
+		return fmt.Errorf("not enough CPUs: %g requested, %g free", t.Cpu, float64(n.Cpus)-n.CpuAllocated)
+	}
+	if !checkMemory(t, n) {
+		return fmt.Errorf("not enough memory: %d KiB requested, %d KiB free", t.Memory/1024, n.Memory-n.MemoryAllocated)
+	}
+	if !checkDisk(t, n.Disk-n.DiskAllocated) {
+		return fmt.Errorf("not enough disk: %d bytes requested, %d bytes free", t.Disk, n.Disk-n.DiskAllocated)
+	}
+	return nil
+}
+
+// filterPorts returns why t cannot be placed on n if a host port it maps is
+// already allocated on n.
+func filterPorts(t task.Task, n *node.Node) error {
+	for _, p := range t.HostPortKeys() {
+		for _, allocated := range n.PortsAllocated {
+			if p == allocated {
+				return fmt.Errorf("host port %s is taken", p)
+			}
+		}
+	}
+	return nil
+}
+
+// filterLabels returns why t cannot be placed on n if n does not satisfy the
+// node selector or the affinity and anti-affinity rules of t. The task
+// itself does not count towards its rules, so that it can be placed again
+// where it runs.
+func filterLabels(t task.Task, n *node.Node) error {
+	if !t.NodeSelector.Matches(n.Labels) {
+		return fmt.Errorf("labels do not match node selector %s", t.NodeSelector)
+	}
+	for _, s := range t.Affinity {
+		if !runsMatchingTask(t, n, s) {
+			return fmt.Errorf("no task with labels %s", s)
+		}
+	}
+	for _, s := range t.AntiAffinity {
+		if runsMatchingTask(t, n, s) {
+			return fmt.Errorf("runs a task with labels %s", s)
+		}
+	}
+	return nil
+}
+
+// runsMatchingTask reports whether a task other than t whose labels match s
+// is assigned to n.
+func runsMatchingTask(t task.Task, n *node.Node, s task.LabelSelector) bool {
+	for id, labels := range n.TaskLabels {
+		if id != t.ID.String() && s.Matches(labels) {
+			return true
+		}
+	}
+	return false
+}
+
+// filterTaints returns why t cannot be placed on n if n has a taint t does
+// not tolerate.
+func filterTaints(t task.Task, n *node.Node) error {
+	for _, taint := range n.Taints {
+		key, value, _ := strings.Cut(taint, "=")
+		if !t.Tolerates(key, value) {
+			return fmt.Errorf("taint %s is not tolerated", taint)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,179 @@
+package scheduler
+
+import (
+	"fmt"
+
+	"github.com/MarouaneBouaricha/cube/node"
+	"github.com/MarouaneBouaricha/cube/task"
+)
+
+// FilterPlugin decides whether a task may be placed on a node.
+type FilterPlugin interface {
+	// Filter returns nil if t may be placed on n, and why not otherwise.
+	Filter(t task.Task, n *node.Node) error
+}
+
+// FilterFunc adapts a function to a FilterPlugin.
+type FilterFunc func(t task.Task, n *node.Node) error
+
+func (f FilterFunc) Filter(t task.Task, n *node.Node) error {
+	return f(t, n)
+}
+
+// ScorePlugin scores the nodes a task may be placed on. Lower scores mark
+// better nodes; they should fall between 0 and 1 for weights to compare
+// plugins.
+type ScorePlugin interface {
+	Score(t task.Task, nodes []*node.Node) map[string]float64
+}
+
+// ScoreFunc adapts a function to a ScorePlugin.
+type ScoreFunc func(t task.Task, nodes []*node.Node) map[string]float64
+
+func (f ScoreFunc) Score(t task.Task, nodes []*node.Node) map[string]float64 {
+	return f(t, nodes)
+}
+
+// FilterPlugins are the filter plugins a Framework can be configured with,
+// by name.
+var FilterPlugins = map[string]FilterPlugin{
+	"resources": FilterFunc(filterResources),
+	"ports":     FilterFunc(filterPorts),
+	"labels":    FilterFunc(filterLabels),
+	"taints":    FilterFunc(filterTaints),
+}
+
+// ScorePlugins are the score plugins a Framework can be configured with, by
+// name.
+var ScorePlugins = map[string]ScorePlugin{
+	"binpack": &BinPack{},
+	"spread":  &Spread{},
+	"cpu":     ScoreFunc(scoreCpuUsage),
+}
+
+// DefaultFilters are the filter plugins of a Framework whose configuration
+// names none.
+var DefaultFilters = []string{"resources", "ports", "labels", "taints"}
+
+// DefaultScores are the score plugins of a Framework whose configuration
+// names none.
+var DefaultScores = []ScoreConfig{{Name: "spread", Weight: 1}}
+
+// FrameworkConfig configures the plugins of a Framework.
+type FrameworkConfig struct {
+	// Filters names the filter plugins a node must pass, in the order they
+	// run.
+	Filters []string
+	// Scores names the score plugins nodes are scored with.
+	Scores []ScoreConfig
+}
+
+// ScoreConfig configures a score plugin.
+type ScoreConfig struct {
+	Name string
+	// Weight multiplies the scores of the plugin. Zero counts as 1.
+	Weight float64
+}
+
+type namedFilter struct {
+	name   string
+	plugin FilterPlugin
+}
+
+type weightedScore struct {
+	name   string
+	plugin ScorePlugin
+	weight float64
+}
+
+// Framework is a scheduler composed of plugins. Nodes must pass every
+// filter plugin to be candidates, and the candidate with the lowest sum of
+// weighted scores is picked.
+type Framework struct {
+	Name    string
+	filters []namedFilter
+	scores  []weightedScore
+}
+
+// NewFramework returns a Framework with the plugins cfg names, or the
+// default ones if it names none.
+func NewFramework(name string, cfg FrameworkConfig) (*Framework, error) {
+	f := &Framework{Name: name}
+
+	filters := cfg.Filters
+	if filters == nil {
+		filters = DefaultFilters
+	}
+	for _, filter := range filters {
+		p, ok := FilterPlugins[filter]
+		if !ok {
+			return nil, fmt.Errorf("unknown filter plugin %q", filter)
+		}
+		f.filters = append(f.filters, namedFilter{name: filter, plugin: p})
+	}
+
+	scores := cfg.Scores
+	if scores == nil {
+		scores = DefaultScores
+	}
+	for _, s := range scores {
+		p, ok := ScorePlugins[s.Name]
+		if !ok {
+			return nil, fmt.Errorf("unknown score plugin %q", s.Name)
+		}
+		if s.Weight < 0 {
+			return nil, fmt.Errorf("score plugin %q has a negative weight", s.Name)
+		}
+		weight := s.Weight
+		if weight == 0 {
+			weight = 1
+		}
+		f.scores = append(f.scores, weightedScore{name: s.Name, plugin: p, weight: weight})
+	}
+	return f, nil
+}
+
+func (f *Framework) SelectCandidateNodes(t task.Task, nodes []*node.Node) []*node.Node {
+	return selectCandidates(t, nodes, f.Filter)
+}
+
+// Filter returns why t cannot be placed on n, from the first filter plugin
+// that leaves n out.
+func (f *Framework) Filter(t task.Task, n *node.Node) error {
+	if err := filterSchedulable(t, n); err != nil {
+		return err
+	}
+	for _, p := range f.filters {
+		if err := p.plugin.Filter(t, n); err != nil {
+			return fmt.Errorf("%s: %w", p.name, err)
+		}
+	}
+	return nil
+}
+
+func (f *Framework) Score(t task.Task, nodes []*node.Node) map[string]float64 {
+	nodeScores := make(map[string]float64)
+	for _, n := range nodes {
+		nodeScores[n.Name] = 0
+	}
+	for _, p := range f.scores {
+		for name, score := range p.plugin.Score(t, nodes) {
+			nodeScores[name] += p.weight * score
+		}
+	}
+	return nodeScores
+}
+
+func (f *Framework) Pick(scores map[string]float64, candidates []*node.Node) *node.Node {
+	return pickLowest(scores, candidates)
+}
+
+// scoreCpuUsage scores nodes with the fraction of CPU time they were busy
+// when their stats were last collected.
+func scoreCpuUsage(t task.Task, nodes []*node.Node) map[string]float64 {
+	nodeScores := make(map[string]float64)
+	for _, n := range nodes {
+		nodeScores[n.Name] = n.CpuUsage
+	}
+	return nodeScores
+}
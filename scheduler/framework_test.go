@@ -0,0 +1,154 @@
+package scheduler
+
+import (
+	"testing"
+
+	"github.com/MarouaneBouaricha/cube/node"
+	"github.com/MarouaneBouaricha/cube/task"
+	"github.com/google/go-cmp/cmp"
+)
+
+func newTestFramework(t *testing.T, cfg FrameworkConfig) *Framework {
+	t.Helper()
+	f, err := NewFramework("test-framework", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestNewFramework(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     FrameworkConfig
+		wantErr bool
+	}{
+		{name: "defaults", cfg: FrameworkConfig{}},
+		{name: "no filters", cfg: FrameworkConfig{Filters: []string{}}},
+		{name: "plugins", cfg: FrameworkConfig{Filters: []string{"ports", "taints"}, Scores: []ScoreConfig{{Name: "binpack", Weight: 2}, {Name: "cpu"}}}},
+		{name: "unknown filter", cfg: FrameworkConfig{Filters: []string{"gpu"}}, wantErr: true},
+		{name: "unknown score", cfg: FrameworkConfig{Scores: []ScoreConfig{{Name: "random"}}}, wantErr: true},
+		{name: "negative weight", cfg: FrameworkConfig{Scores: []ScoreConfig{{Name: "spread", Weight: -1}}}, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := NewFramework("test-framework", test.cfg)
+			if (err != nil) != test.wantErr {
+				t.Errorf("NewFramework() error = %v; want error %v", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestFrameworkFilters(t *testing.T) {
+	nodes := []*node.Node{
+		{Name: "full", Cpus: 2, CpuAllocated: 2, Memory: 4 << 20, Disk: 100, PortsAllocated: []string{"8080/tcp"}},
+		{Name: "gpu", Cpus: 8, Memory: 32 << 20, Disk: 100, Labels: map[string]string{"gpu": "true"}, Taints: []string{"gpu=true"}},
+		{Name: "idle", Cpus: 2, Memory: 4 << 20, Disk: 100, Taints: []string{"maintenance"}},
+	}
+	web := task.Task{Cpu: 1, Ports: []task.PortMapping{{ContainerPort: 80, HostPort: 8080}}}
+
+	tests := []struct {
+		name    string
+		filters []string
+		task    task.Task
+		want    []string
+	}{
+		{name: "no filters", filters: []string{}, task: web, want: []string{"full", "gpu", "idle"}},
+		{name: "resources", filters: []string{"resources"}, task: web, want: []string{"gpu", "idle"}},
+		{name: "ports", filters: []string{"ports"}, task: web, want: []string{"gpu", "idle"}},
+		{name: "taints", filters: []string{"taints"}, task: web, want: []string{"full"}},
+		{name: "tolerated taint", filters: []string{"taints"}, task: task.Task{Tolerations: []task.Toleration{{Key: "gpu", Value: "true"}}}, want: []string{"full", "gpu"}},
+		{name: "taint tolerated with any value", filters: []string{"taints"}, task: task.Task{Tolerations: []task.Toleration{{Key: "maintenance"}}}, want: []string{"full", "idle"}},
+		{name: "taint with another value", filters: []string{"taints"}, task: task.Task{Tolerations: []task.Toleration{{Key: "gpu", Value: "false"}}}, want: []string{"full"}},
+		{name: "labels", filters: []string{"labels"}, task: task.Task{NodeSelector: task.LabelSelector{"gpu": "true"}}, want: []string{"gpu"}},
+		{name: "all filters", filters: nil, task: task.Task{Cpu: 1, NodeSelector: task.LabelSelector{"gpu": "true"}, Tolerations: []task.Toleration{{Key: "gpu"}}}, want: []string{"gpu"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := newTestFramework(t, FrameworkConfig{Filters: test.filters})
+			var got []string
+			for _, n := range f.SelectCandidateNodes(test.task, nodes) {
+				got = append(got, n.Name)
+			}
+			if !cmp.Equal(got, test.want) {
+				t.Errorf("-want/+got: \n%s", cmp.Diff(test.want, got))
+			}
+		})
+	}
+}
+
+func TestFrameworkScores(t *testing.T) {
+	tests := []struct {
+		name   string
+		scores []ScoreConfig
+		want   map[string]float64
+		pick   string
+	}{
+		{
+			name:   "no scores",
+			scores: []ScoreConfig{},
+			want:   map[string]float64{"busy": 0, "light": 0, "new": 0},
+			pick:   "busy",
+		},
+		{
+			name:   "binpack",
+			scores: []ScoreConfig{{Name: "binpack"}},
+			want:   map[string]float64{"busy": 0.25, "light": 0.75, "new": 1.0},
+			pick:   "busy",
+		},
+		{
+			name:   "spread weighted over binpack",
+			scores: []ScoreConfig{{Name: "binpack", Weight: 1}, {Name: "spread", Weight: 4}},
+			want:   map[string]float64{"busy": 3.75, "light": 2.25, "new": 1.5},
+			pick:   "new",
+		},
+		{
+			name:   "binpack weighted over spread",
+			scores: []ScoreConfig{{Name: "binpack", Weight: 4}, {Name: "spread", Weight: 1}},
+			want:   map[string]float64{"busy": 1.875, "light": 3.375, "new": 4.125},
+			pick:   "busy",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := newTestFramework(t, FrameworkConfig{Scores: test.scores})
+			testScheduler(t, f, task.Task{}, []string{"busy", "light", "new"}, test.want, test.pick)
+		})
+	}
+}
+
+func TestSchedulersFilterReasons(t *testing.T) {
+	n := &node.Node{Name: "small", Cpus: 2, CpuAllocated: 1.5, Memory: 4 << 20, Disk: 100, Taints: []string{"gpu=true"}}
+	cordoned := &node.Node{Name: "cordoned", Cordoned: true}
+
+	tests := []struct {
+		name      string
+		scheduler Scheduler
+		node      *node.Node
+		task      task.Task
+		want      string
+	}{
+		{"cordoned", &Epvm{}, cordoned, task.Task{}, "node is cordoned"},
+		{"taint", &Epvm{}, n, task.Task{}, "taint gpu=true is not tolerated"},
+		{"resources", &BinPack{}, n, task.Task{Cpu: 1, Tolerations: []task.Toleration{{Key: "gpu"}}}, "not enough CPUs: 1 requested, 0.5 free"},
+		{"round robin ignores resources", &RoundRobin{}, n, task.Task{Cpu: 1, Tolerations: []task.Toleration{{Key: "gpu"}}}, ""},
+		{"framework cordoned", newTestFramework(t, FrameworkConfig{}), cordoned, task.Task{}, "node is cordoned"},
+		{"framework names the plugin", newTestFramework(t, FrameworkConfig{}), n, task.Task{Memory: 8 << 30}, "resources: not enough memory: 8388608 KiB requested, 4194304 KiB free"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var got string
+			if err := test.scheduler.Filter(test.task, test.node); err != nil {
+				got = err.Error()
+			}
+			if got != test.want {
+				t.Errorf("Filter() = %q; want %q", got, test.want)
+			}
+		})
+	}
+}
@@ -11,7 +11,11 @@ type RoundRobin struct {
 }
 
 func (r *RoundRobin) SelectCandidateNodes(t task.Task, nodes []*node.Node) []*node.Node {
-	return nodes
+	return selectCandidates(t, nodes, r.Filter)
+}
+
+func (r *RoundRobin) Filter(t task.Task, n *node.Node) error {
+	return filterAll(t, n, filterSchedulable, filterLabels, filterTaints, filterPorts)
 }
 
 func (r *RoundRobin) Score(t task.Task, nodes []*node.Node) map[string]float64 {
@@ -13,6 +13,67 @@ const (
 
 type Scheduler interface {
 	SelectCandidateNodes(t task.Task, nodes []*node.Node) []*node.Node
+	// Filter returns why t cannot be placed on n, or nil if n is one of
+	// the candidates SelectCandidateNodes returns.
+	Filter(t task.Task, n *node.Node) error
 	Score(t task.Task, nodes []*node.Node) map[string]float64
 	Pick(scores map[string]float64, candidates []*node.Node) *node.Node
 }
+
+// selectCandidates returns the nodes filter does not leave out.
+func selectCandidates(t task.Task, nodes []*node.Node, filter func(task.Task, *node.Node) error) []*node.Node {
+	var candidates []*node.Node
+	for _, n := range nodes {
+		if filter(t, n) == nil {
+			candidates = append(candidates, n)
+		}
+	}
+	return candidates
+}
+
+// filterAll returns the reason of the first of filters to leave n out.
+func filterAll(t task.Task, n *node.Node, filters ...FilterFunc) error {
+	for _, f := range filters {
+		if err := f(t, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// utilization returns the fraction of the CPUs, memory and disk of n that
+// would be allocated once t is placed on it, averaged over the resources n
+// knows the capacity of. It reports false if n knows none of them, as
+// before its stats were first collected.
+func utilization(t task.Task, n *node.Node) (float64, bool) {
+	var sum float64
+	var resources int
+	if n.Cpus > 0 {
+		sum += (n.CpuAllocated + t.Cpu) / float64(n.Cpus)
+		resources++
+	}
+	if n.Memory > 0 {
+		sum += float64(n.MemoryAllocated+t.Memory/1024) / float64(n.Memory)
+		resources++
+	}
+	if n.Disk > 0 {
+		sum += float64(n.DiskAllocated+t.Disk) / float64(n.Disk)
+		resources++
+	}
+	if resources == 0 {
+		return 0, false
+	}
+	return sum / float64(resources), true
+}
+
+// pickLowest returns the candidate with the lowest score, the first one
+// among those with the same score.
+func pickLowest(scores map[string]float64, candidates []*node.Node) *node.Node {
+	var bestNode *node.Node
+	for _, n := range candidates {
+		if bestNode == nil || scores[n.Name] < scores[bestNode.Name] {
+			bestNode = n
+		}
+	}
+	return bestNode
+}
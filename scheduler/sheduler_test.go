@@ -6,6 +6,7 @@ import (
 	"github.com/MarouaneBouaricha/cube/node"
 	"github.com/MarouaneBouaricha/cube/task"
 	"github.com/google/go-cmp/cmp"
+	"github.com/google/uuid"
 )
 
 var nodeList = []*node.Node{
@@ -125,3 +126,323 @@ func TestRoundRobinSchedulerPickBestNode(t *testing.T) {
 		})
 	}
 }
+
+func TestSchedulersSkipCordonedNodes(t *testing.T) {
+	cordoned := *nodeList[1]
+	cordoned.Cordoned = true
+	nodes := []*node.Node{nodeList[0], &cordoned, nodeList[2]}
+	want := []*node.Node{nodeList[0], nodeList[2]}
+
+	tests := []struct {
+		name      string
+		scheduler Scheduler
+	}{
+		{name: "roundrobin", scheduler: &RoundRobin{Name: "test-rr-scheduler"}},
+		{name: "epvm", scheduler: &Epvm{Name: "test-epvm-scheduler"}},
+		{name: "binpack", scheduler: &BinPack{Name: "test-binpack-scheduler"}},
+		{name: "spread", scheduler: &Spread{Name: "test-spread-scheduler"}},
+		{name: "framework", scheduler: newTestFramework(t, FrameworkConfig{})},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := test.scheduler.SelectCandidateNodes(task.Task{}, nodes)
+			if !cmp.Equal(got, want) {
+				t.Errorf("-want/+got: \n%s", cmp.Diff(want, got))
+			}
+		})
+	}
+}
+
+func TestSchedulersSkipNodesWithHostPortsTaken(t *testing.T) {
+	busy := *nodeList[1]
+	busy.PortsAllocated = []string{"8080/tcp", "53/udp"}
+	nodes := []*node.Node{nodeList[0], &busy, nodeList[2]}
+
+	tests := []struct {
+		name  string
+		ports []task.PortMapping
+		want  []*node.Node
+	}{
+		{
+			name:  "no host ports",
+			ports: nil,
+			want:  nodes,
+		},
+		{
+			name:  "runtime picked host port",
+			ports: []task.PortMapping{{ContainerPort: 80}},
+			want:  nodes,
+		},
+		{
+			name:  "host port taken",
+			ports: []task.PortMapping{{ContainerPort: 80, HostPort: 8080}},
+			want:  []*node.Node{nodeList[0], nodeList[2]},
+		},
+		{
+			name:  "host port taken on another address",
+			ports: []task.PortMapping{{ContainerPort: 80, HostPort: 8080, HostIP: "127.0.0.1"}},
+			want:  []*node.Node{nodeList[0], nodeList[2]},
+		},
+		{
+			name:  "host port taken for another protocol",
+			ports: []task.PortMapping{{ContainerPort: 8080, HostPort: 8080, Protocol: "udp"}},
+			want:  nodes,
+		},
+	}
+
+	schedulers := map[string]Scheduler{
+		"roundrobin": &RoundRobin{Name: "test-rr-scheduler"},
+		"epvm":       &Epvm{Name: "test-epvm-scheduler"},
+		"binpack":    &BinPack{Name: "test-binpack-scheduler"},
+		"spread":     &Spread{Name: "test-spread-scheduler"},
+		"framework":  newTestFramework(t, FrameworkConfig{}),
+	}
+	for name, s := range schedulers {
+		for _, test := range tests {
+			t.Run(name+"/"+test.name, func(t *testing.T) {
+				got := s.SelectCandidateNodes(task.Task{Ports: test.ports}, nodes)
+				if !cmp.Equal(got, test.want) {
+					t.Errorf("-want/+got: \n%s", cmp.Diff(test.want, got))
+				}
+			})
+		}
+	}
+}
+
+func TestEpvmSchedulerSelectCandidateNodes(t *testing.T) {
+	nodes := []*node.Node{
+		{Name: "small", Cpus: 2, CpuAllocated: 1.5, Memory: 4 << 20, MemoryAllocated: 1 << 20, Disk: 10 << 30},
+		{Name: "large", Cpus: 8, CpuAllocated: 2, Memory: 32 << 20, MemoryAllocated: 8 << 20, Disk: 100 << 30, DiskAllocated: 95 << 30},
+		{Name: "unknown"},
+	}
+
+	tests := []struct {
+		name string
+		task task.Task
+		want []string
+	}{
+		{name: "no requests", task: task.Task{}, want: []string{"small", "large", "unknown"}},
+		{name: "fits everywhere with stats", task: task.Task{Cpu: 0.5, Memory: 1 << 30, Disk: 1 << 30}, want: []string{"small", "large"}},
+		{name: "cpu", task: task.Task{Cpu: 1}, want: []string{"large"}},
+		{name: "all cpus left", task: task.Task{Cpu: 6}, want: []string{"large"}},
+		{name: "too many cpus", task: task.Task{Cpu: 6.5}, want: nil},
+		{name: "memory", task: task.Task{Memory: 16 << 30}, want: []string{"large"}},
+		{name: "all memory left", task: task.Task{Memory: 3 << 30}, want: []string{"small", "large"}},
+		{name: "too much memory", task: task.Task{Memory: 25 << 30}, want: nil},
+		{name: "disk", task: task.Task{Disk: 6 << 30}, want: []string{"small"}},
+		{name: "memory on one node, disk on the other", task: task.Task{Memory: 16 << 30, Disk: 6 << 30}, want: nil},
+	}
+
+	e := &Epvm{Name: "test-epvm-scheduler"}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var got []string
+			for _, n := range e.SelectCandidateNodes(test.task, nodes) {
+				got = append(got, n.Name)
+			}
+			if !cmp.Equal(got, test.want) {
+				t.Errorf("-want/+got: \n%s", cmp.Diff(test.want, got))
+			}
+		})
+	}
+}
+
+func TestEpvmSchedulerScoreUsesCpuUsage(t *testing.T) {
+	busy := &node.Node{Name: "busy", Cpus: 4, Memory: 32 << 20, CpuUsage: 0.9}
+	idle := &node.Node{Name: "idle", Cpus: 4, Memory: 32 << 20, CpuUsage: 0.1}
+	nodes := []*node.Node{busy, idle}
+
+	e := &Epvm{Name: "test-epvm-scheduler"}
+	scores := e.Score(task.Task{Cpu: 1, Memory: 1 << 30}, nodes)
+	if len(scores) != 2 {
+		t.Fatalf("got scores for %d nodes; want 2", len(scores))
+	}
+	if got := e.Pick(scores, nodes); got != idle {
+		t.Errorf("picked %s; want the idle node", got.Name)
+	}
+}
+
+func TestSchedulersHonorPlacementRules(t *testing.T) {
+	self := uuid.New()
+	nodes := []*node.Node{
+		{Name: "build", Labels: map[string]string{"pool": "build"}, TaskLabels: map[string]map[string]string{
+			uuid.NewString(): {"app": "web"},
+		}},
+		{Name: "gpu", Labels: map[string]string{"pool": "build", "gpu": "true"}, TaskLabels: map[string]map[string]string{
+			uuid.NewString(): {"app": "db"},
+			self.String():    {"app": "web"},
+		}},
+		{Name: "plain"},
+	}
+
+	tests := []struct {
+		name string
+		task task.Task
+		want []string
+	}{
+		{name: "no rules", task: task.Task{}, want: []string{"build", "gpu", "plain"}},
+		{name: "node selector", task: task.Task{NodeSelector: task.LabelSelector{"pool": "build"}}, want: []string{"build", "gpu"}},
+		{name: "node selector with several labels", task: task.Task{NodeSelector: task.LabelSelector{"pool": "build", "gpu": "true"}}, want: []string{"gpu"}},
+		{name: "node selector matching no node", task: task.Task{NodeSelector: task.LabelSelector{"pool": "ci"}}, want: nil},
+		{name: "affinity", task: task.Task{Affinity: []task.LabelSelector{{"app": "db"}}}, want: []string{"gpu"}},
+		{name: "affinity to several tasks", task: task.Task{Affinity: []task.LabelSelector{{"app": "db"}, {"app": "web"}}}, want: []string{"gpu"}},
+		{name: "affinity ignores the task itself", task: task.Task{ID: self, Affinity: []task.LabelSelector{{"app": "web"}, {"app": "db"}}}, want: nil},
+		{name: "anti-affinity", task: task.Task{AntiAffinity: []task.LabelSelector{{"app": "web"}}}, want: []string{"plain"}},
+		{name: "anti-affinity ignores the task itself", task: task.Task{ID: self, AntiAffinity: []task.LabelSelector{{"app": "web"}}}, want: []string{"gpu", "plain"}},
+		{name: "selector and anti-affinity", task: task.Task{NodeSelector: task.LabelSelector{"pool": "build"}, AntiAffinity: []task.LabelSelector{{"app": "db"}}}, want: []string{"build"}},
+	}
+
+	schedulers := map[string]Scheduler{
+		"roundrobin": &RoundRobin{Name: "test-rr-scheduler"},
+		"epvm":       &Epvm{Name: "test-epvm-scheduler"},
+		"binpack":    &BinPack{Name: "test-binpack-scheduler"},
+		"spread":     &Spread{Name: "test-spread-scheduler"},
+		"framework":  newTestFramework(t, FrameworkConfig{}),
+	}
+	for name, s := range schedulers {
+		for _, test := range tests {
+			t.Run(name+"/"+test.name, func(t *testing.T) {
+				var got []string
+				for _, n := range s.SelectCandidateNodes(test.task, nodes) {
+					got = append(got, n.Name)
+				}
+				if !cmp.Equal(got, test.want) {
+					t.Errorf("-want/+got: \n%s", cmp.Diff(test.want, got))
+				}
+			})
+		}
+	}
+}
+
+var loadedNodes = []*node.Node{
+	{Name: "busy", Cpus: 4, CpuAllocated: 3, Memory: 4 << 20, MemoryAllocated: 3 << 20, Disk: 100, DiskAllocated: 75, TaskCount: 3},
+	{Name: "light", Cpus: 4, CpuAllocated: 1, Memory: 4 << 20, MemoryAllocated: 1 << 20, Disk: 100, DiskAllocated: 25, TaskCount: 1},
+	{Name: "new", TaskCount: 0},
+}
+
+func TestBinPackScheduler(t *testing.T) {
+	tests := []struct {
+		name       string
+		task       task.Task
+		candidates []string
+		scores     map[string]float64
+		want       string
+	}{
+		{
+			name:       "task without requests",
+			task:       task.Task{},
+			candidates: []string{"busy", "light", "new"},
+			scores:     map[string]float64{"busy": 0.25, "light": 0.75, "new": 1.0},
+			want:       "busy",
+		},
+		{
+			name:       "task filling the busiest node",
+			task:       task.Task{Cpu: 1, Memory: 1 << 30, Disk: 25},
+			candidates: []string{"busy", "light"},
+			scores:     map[string]float64{"busy": 0, "light": 0.5, "new": 1.0},
+			want:       "busy",
+		},
+		{
+			name:       "task too large for the busiest node",
+			task:       task.Task{Cpu: 2, Memory: 2 << 30, Disk: 50},
+			candidates: []string{"light"},
+			scores:     map[string]float64{"busy": -0.25, "light": 0.25, "new": 1.0},
+			want:       "light",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			testScheduler(t, &BinPack{Name: "test-binpack-scheduler"}, test.task, test.candidates, test.scores, test.want)
+		})
+	}
+}
+
+func TestSpreadScheduler(t *testing.T) {
+	tests := []struct {
+		name       string
+		task       task.Task
+		candidates []string
+		scores     map[string]float64
+		want       string
+	}{
+		{
+			name:       "task without requests",
+			task:       task.Task{},
+			candidates: []string{"busy", "light", "new"},
+			scores:     map[string]float64{"busy": 0.875, "light": 0.375, "new": 0.125},
+			want:       "new",
+		},
+		{
+			name:       "task with requests",
+			task:       task.Task{Cpu: 1, Memory: 1 << 30, Disk: 25},
+			candidates: []string{"busy", "light"},
+			scores:     map[string]float64{"busy": 1.0, "light": 0.5, "new": 0.125},
+			want:       "light",
+		},
+		{
+			name:       "task only fitting the least loaded node",
+			task:       task.Task{Cpu: 3, Memory: 3 << 30, Disk: 75},
+			candidates: []string{"light"},
+			scores:     map[string]float64{"busy": 1.25, "light": 0.75, "new": 0.125},
+			want:       "light",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			testScheduler(t, &Spread{Name: "test-spread-scheduler"}, test.task, test.candidates, test.scores, test.want)
+		})
+	}
+}
+
+// testScheduler runs s over loadedNodes, checking the candidates it selects
+// for tk, the scores it gives every node and the candidate it picks.
+func testScheduler(t *testing.T, s Scheduler, tk task.Task, candidates []string, scores map[string]float64, want string) {
+	t.Helper()
+
+	selected := s.SelectCandidateNodes(tk, loadedNodes)
+	var names []string
+	for _, n := range selected {
+		names = append(names, n.Name)
+	}
+	if !cmp.Equal(names, candidates) {
+		t.Errorf("candidates -want/+got: \n%s", cmp.Diff(candidates, names))
+	}
+
+	got := s.Score(tk, loadedNodes)
+	if !cmp.Equal(got, scores) {
+		t.Errorf("scores -want/+got: \n%s", cmp.Diff(scores, got))
+	}
+
+	if picked := s.Pick(got, selected); picked == nil || picked.Name != want {
+		t.Errorf("picked %v; want %s", picked, want)
+	}
+}
+
+func TestSchedulersHonorTaints(t *testing.T) {
+	tainted := *nodeList[1]
+	tainted.Taints = []string{"pool=build"}
+	nodes := []*node.Node{nodeList[0], &tainted, nodeList[2]}
+
+	schedulers := map[string]Scheduler{
+		"roundrobin": &RoundRobin{Name: "test-rr-scheduler"},
+		"epvm":       &Epvm{Name: "test-epvm-scheduler"},
+		"binpack":    &BinPack{Name: "test-binpack-scheduler"},
+		"spread":     &Spread{Name: "test-spread-scheduler"},
+		"framework":  newTestFramework(t, FrameworkConfig{}),
+	}
+	for name, s := range schedulers {
+		t.Run(name, func(t *testing.T) {
+			got := s.SelectCandidateNodes(task.Task{}, nodes)
+			if want := []*node.Node{nodeList[0], nodeList[2]}; !cmp.Equal(got, want) {
+				t.Errorf("without toleration -want/+got: \n%s", cmp.Diff(want, got))
+			}
+			got = s.SelectCandidateNodes(task.Task{Tolerations: []task.Toleration{{Key: "pool"}}}, nodes)
+			if !cmp.Equal(got, nodes) {
+				t.Errorf("with toleration -want/+got: \n%s", cmp.Diff(nodes, got))
+			}
+		})
+	}
+}
@@ -0,0 +1,44 @@
+package scheduler
+
+import (
+	"github.com/MarouaneBouaricha/cube/node"
+	"github.com/MarouaneBouaricha/cube/task"
+)
+
+// Spread balances tasks over nodes, placing each on the node that runs the
+// fewest tasks and has the least of its resources allocated.
+type Spread struct {
+	Name string
+}
+
+func (s *Spread) SelectCandidateNodes(t task.Task, nodes []*node.Node) []*node.Node {
+	return selectCandidates(t, nodes, s.Filter)
+}
+
+func (s *Spread) Filter(t task.Task, n *node.Node) error {
+	return filterAll(t, n, filterSchedulable, filterLabels, filterTaints, filterPorts, filterResources)
+}
+
+// Score scores nodes with the average of two fractions once t is placed on
+// them: their share of the most tasks any node would run, and their
+// resources allocated.
+func (s *Spread) Score(t task.Task, nodes []*node.Node) map[string]float64 {
+	maxTasks := 1
+	for _, n := range nodes {
+		if n.TaskCount+1 > maxTasks {
+			maxTasks = n.TaskCount + 1
+		}
+	}
+
+	nodeScores := make(map[string]float64)
+	for _, n := range nodes {
+		used, _ := utilization(t, n)
+		tasks := float64(n.TaskCount+1) / float64(maxTasks)
+		nodeScores[n.Name] = (tasks + used) / 2
+	}
+	return nodeScores
+}
+
+func (s *Spread) Pick(scores map[string]float64, candidates []*node.Node) *node.Node {
+	return pickLowest(scores, candidates)
+}
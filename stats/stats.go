@@ -2,6 +2,7 @@ package stats
 
 import (
 	"log"
+	"runtime"
 
 	"github.com/c9s/goprocinfo/linux"
 )
@@ -11,7 +12,13 @@ type Stats struct {
 	DiskStats *linux.Disk
 	CpuStats  *linux.CPUStat
 	LoadStats *linux.LoadAvg
+	// CpuCount is the number of CPUs of the host.
+	CpuCount  int
 	TaskCount int
+	// Labels are the labels of the worker the stats were collected on.
+	Labels map[string]string `json:",omitempty"`
+	// Taints are the taints of the worker, in key=value form.
+	Taints []string `json:",omitempty"`
 }
 
 func (s *Stats) MemUsedKb() uint64 {
@@ -43,11 +50,7 @@ func (s *Stats) DiskUsed() uint64 {
 }
 
 func (s *Stats) CpuUsage() float64 {
-
-	idle := s.CpuStats.Idle + s.CpuStats.IOWait
-	nonIdle := s.CpuStats.User + s.CpuStats.Nice + s.CpuStats.System + s.CpuStats.IRQ + s.CpuStats.SoftIRQ + s.CpuStats.Steal
-	total := idle + nonIdle
-
+	idle, total := cpuTimes(s.CpuStats)
 	if total == 0 && idle == 0 {
 		return 0.00
 	}
@@ -55,11 +58,43 @@ func (s *Stats) CpuUsage() float64 {
 	return (float64(total) - float64(idle)) / float64(total)
 }
 
+// CpuUsageSince returns the fraction of CPU time the host was busy between
+// prev and s. It returns 0 if either has no CPU stats or the counters did
+// not move forward.
+//
+// See discussion from this StackOverflow thread:
+// https://stackoverflow.com/questions/23367857/accurate-calculation-of-cpu-usage-given-in-percentage-in-linux
+func (s *Stats) CpuUsageSince(prev *Stats) float64 {
+	if prev == nil || prev.CpuStats == nil || s.CpuStats == nil {
+		return 0.00
+	}
+	prevIdle, prevTotal := cpuTimes(prev.CpuStats)
+	curIdle, curTotal := cpuTimes(s.CpuStats)
+	if curTotal <= prevTotal || curIdle < prevIdle {
+		return 0.00
+	}
+
+	total := curTotal - prevTotal
+	idle := curIdle - prevIdle
+	if idle > total {
+		return 0.00
+	}
+	return float64(total-idle) / float64(total)
+}
+
+// cpuTimes returns the idle and total CPU time counted in c.
+func cpuTimes(c *linux.CPUStat) (idle, total uint64) {
+	idle = c.Idle + c.IOWait
+	nonIdle := c.User + c.Nice + c.System + c.IRQ + c.SoftIRQ + c.Steal
+	return idle, idle + nonIdle
+}
+
 func GetStats() *Stats {
 	return &Stats{
 		MemStats:  GetMemoryInfo(),
 		DiskStats: GetDiskInfo(),
 		CpuStats:  GetCpuStats(),
+		CpuCount:  GetCpuCount(),
 		LoadStats: GetLoadAvg(),
 	}
 }
@@ -97,6 +132,17 @@ func GetCpuStats() *linux.CPUStat {
 	return &stats.CPUStatAll
 }
 
+// GetCpuCount returns the number of CPUs listed in /proc/stat, falling back
+// to the number the Go runtime sees.
+func GetCpuCount() int {
+	stats, err := linux.ReadStat("/proc/stat")
+	if err != nil || len(stats.CPUStats) == 0 {
+		return runtime.NumCPU()
+	}
+
+	return len(stats.CPUStats)
+}
+
 // GetLoadAvg See https://godoc.org/github.com/c9s/goprocinfo/linux#LoadAvg
 func GetLoadAvg() *linux.LoadAvg {
 	loadavg, err := linux.ReadLoadAvg("/proc/loadavg")
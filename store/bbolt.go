@@ -131,6 +131,13 @@ func (t *TaskStore) List() (interface{}, error) {
 	return tasks, nil
 }
 
+func (t *TaskStore) Delete(key string) error {
+	return t.Db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(t.Bucket))
+		return b.Delete([]byte(key))
+	})
+}
+
 type EventStore struct {
 	DbFile   string
 	FileMode os.FileMode
@@ -248,3 +255,10 @@ func (e *EventStore) List() (interface{}, error) {
 
 	return events, nil
 }
+
+func (e *EventStore) Delete(key string) error {
+	return e.Db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(e.Bucket))
+		return b.Delete([]byte(key))
+	})
+}
@@ -2,12 +2,16 @@ package store
 
 import (
 	"fmt"
+	"sync"
 
 	"github.com/MarouaneBouaricha/cube/task"
 )
 
-// Task store
+// InMemoryTaskStore keeps tasks in a map. It is safe for concurrent use and,
+// like the persistent store, stores and returns copies so that callers never
+// share a *task.Task.
 type InMemoryTaskStore struct {
+	mu sync.RWMutex
 	Db map[string]*task.Task
 }
 
@@ -22,33 +26,53 @@ func (i *InMemoryTaskStore) Put(key string, value interface{}) error {
 	if !ok {
 		return fmt.Errorf("value %v is not a task.Task type", value)
 	}
-	i.Db[key] = t
+	c := *t
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.Db[key] = &c
 	return nil
 }
 
 func (i *InMemoryTaskStore) Get(key string) (interface{}, error) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
 	t, ok := i.Db[key]
 	if !ok {
 		return nil, fmt.Errorf("task with key %s does not exist", key)
 	}
 
-	return t, nil
+	c := *t
+	return &c, nil
 }
 
 func (i *InMemoryTaskStore) List() (interface{}, error) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
 	var tasks []*task.Task
 	for _, t := range i.Db {
-		tasks = append(tasks, t)
+		c := *t
+		tasks = append(tasks, &c)
 	}
 	return tasks, nil
 }
 
 func (i *InMemoryTaskStore) Count() (int, error) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
 	return len(i.Db), nil
 }
 
-// Event task store
+func (i *InMemoryTaskStore) Delete(key string) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	delete(i.Db, key)
+	return nil
+}
+
+// InMemoryTaskEventStore keeps task events in a map. Like InMemoryTaskStore
+// it is safe for concurrent use and works on copies.
 type InMemoryTaskEventStore struct {
+	mu sync.RWMutex
 	Db map[string]*task.TaskEvent
 }
 
@@ -63,27 +87,45 @@ func (i *InMemoryTaskEventStore) Put(key string, value interface{}) error {
 	if !ok {
 		return fmt.Errorf("value %v is not a task.TaskEvent type", value)
 	}
-	i.Db[key] = e
+	c := *e
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.Db[key] = &c
 	return nil
 }
 
 func (i *InMemoryTaskEventStore) Get(key string) (interface{}, error) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
 	e, ok := i.Db[key]
 	if !ok {
 		return nil, fmt.Errorf("task event with key %s does not exist", key)
 	}
 
-	return e, nil
+	c := *e
+	return &c, nil
 }
 
 func (i *InMemoryTaskEventStore) List() (interface{}, error) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
 	var events []*task.TaskEvent
 	for _, e := range i.Db {
-		events = append(events, e)
+		c := *e
+		events = append(events, &c)
 	}
 	return events, nil
 }
 
 func (i *InMemoryTaskEventStore) Count() (int, error) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
 	return len(i.Db), nil
 }
+
+func (i *InMemoryTaskEventStore) Delete(key string) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	delete(i.Db, key)
+	return nil
+}
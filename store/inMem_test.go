@@ -1,10 +1,12 @@
 package store
 
 import (
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/MarouaneBouaricha/cube/task"
+	"github.com/google/go-cmp/cmp"
 	"github.com/google/uuid"
 )
 
@@ -27,7 +29,7 @@ func TestInMemoryTaskStore(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Failed to get task: %v", err)
 	}
-	if retrievedTask.(*task.Task) != task1 {
+	if !cmp.Equal(retrievedTask.(*task.Task), task1) {
 		t.Errorf("Expected task %v, got %v", task1, retrievedTask)
 	}
 
@@ -78,7 +80,7 @@ func TestInMemoryTaskEventStore(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Failed to get task event: %v", err)
 	}
-	if retrievedEvent.(*task.TaskEvent) != event1 {
+	if !cmp.Equal(retrievedEvent.(*task.TaskEvent), event1) {
 		t.Errorf("Expected event %v, got %v", event1, retrievedEvent)
 	}
 
@@ -103,3 +105,40 @@ func TestInMemoryTaskEventStore(t *testing.T) {
 		t.Error("Expected error for non-existent key, got nil")
 	}
 }
+
+func TestInMemoryTaskStoreConcurrentAccess(t *testing.T) {
+	store := NewInMemoryTaskStore()
+
+	taskID := uuid.New()
+	store.Put(taskID.String(), &task.Task{ID: taskID, State: task.Pending})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			result, _ := store.Get(taskID.String())
+			tk := result.(*task.Task)
+			tk.State = task.Running
+			store.Put(taskID.String(), tk)
+		}()
+		go func() {
+			defer wg.Done()
+			result, _ := store.List()
+			for _, tk := range result.([]*task.Task) {
+				tk.Name = "changed by caller"
+			}
+			store.Count()
+		}()
+	}
+	wg.Wait()
+
+	result, _ := store.Get(taskID.String())
+	got := result.(*task.Task)
+	if got.State != task.Running {
+		t.Errorf("Expected state %v, got %v", task.Running, got.State)
+	}
+	if got.Name != "" {
+		t.Errorf("Expected changes to listed tasks not to be stored, got name %q", got.Name)
+	}
+}
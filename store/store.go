@@ -5,4 +5,5 @@ type Store interface {
 	Get(key string) (interface{}, error)
 	List() (interface{}, error)
 	Count() (int, error)
+	Delete(key string) error
 }
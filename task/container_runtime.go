@@ -1,8 +1,48 @@
 package task
 
+import (
+	"context"
+	"fmt"
+	"io"
+)
+
 type ContainerRuntime interface {
-	Run() ContainerResult
+	Run(c *Config) ContainerResult
 	Stop(id string) ContainerResult
 	Remove(id string) ContainerResult
 	Inspect(containerID string) ContainerInspectResponse
+	// Exec runs cmd inside the running container and waits for it to exit.
+	Exec(ctx context.Context, containerID string, cmd []string) ExecResult
+	// ExecAttach runs a command inside the running container with its
+	// standard streams connected to stdin, stdout and stderr, and returns
+	// its exit code once it exits. stdin may be nil.
+	ExecAttach(ctx context.Context, containerID string, c ExecConfig, stdin io.Reader, stdout, stderr io.Writer) (int, error)
+	// Logs returns the output of the container selected by opts. The
+	// caller must close it.
+	Logs(ctx context.Context, containerID string, opts LogsOptions) (io.ReadCloser, error)
+	// RemoveVolume deletes the named volume. It fails while a container
+	// uses the volume.
+	RemoveVolume(name string) error
+	// Stats samples the resources the running container uses.
+	Stats(containerID string) (ContainerStats, error)
+}
+
+// NewContainerRuntime returns the ContainerRuntime registered under name.
+func NewContainerRuntime(name string) (ContainerRuntime, error) {
+	switch name {
+	case "docker":
+		d, err := NewDocker()
+		if err != nil {
+			return nil, err
+		}
+		return d, nil
+	case "podman":
+		p, err := NewPodman("")
+		if err != nil {
+			return nil, err
+		}
+		return p, nil
+	default:
+		return nil, fmt.Errorf("unsupported container runtime %q", name)
+	}
 }
@@ -1,39 +1,47 @@
 package task
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"log"
 	"math"
 	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
 
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/api/types/mount"
 	"github.com/docker/docker/client"
+	"github.com/docker/go-connections/nat"
 	"github.com/moby/moby/pkg/stdcopy"
 )
 
 type Docker struct {
 	Client *client.Client
-	Config Config
+	// noDiskQuota is set once the storage driver refused a disk quota, so
+	// that later containers are created without one straight away.
+	noDiskQuota atomic.Bool
 }
 
-func NewDocker(c *Config) *Docker {
+func NewDocker() (*Docker, error) {
 	dc, initErr := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
 	if initErr != nil {
-		log.Fatalf("failed to initialize Docker client: %v", initErr)
+		return nil, fmt.Errorf("failed to initialize Docker client: %v", initErr)
 	}
 
 	_, err := dc.Ping(context.Background())
 	if err != nil {
-		log.Fatalf("Docker daemon is not running: %v", err)
+		return nil, fmt.Errorf("Docker daemon is not running: %v", err)
 	}
 	return &Docker{
 		Client: dc,
-		Config: *c,
-	}
+	}, nil
 }
 
 func DaemonHealthCheck() error {
@@ -61,38 +69,70 @@ type ContainerInspectResponse struct {
 	Container *types.ContainerJSON
 }
 
-func (d *Docker) Run() ContainerResult {
+// ExecResult is the outcome of a command run inside a container.
+type ExecResult struct {
+	Error    error
+	ExitCode int
+	// Output holds what the command wrote to stdout and stderr.
+	Output string
+}
+
+func (d *Docker) Run(c *Config) ContainerResult {
 	ctx := context.Background()
-	reader, err := d.Client.ImagePull(ctx, d.Config.Image, image.PullOptions{})
+	reader, err := d.Client.ImagePull(ctx, c.Image, image.PullOptions{})
 	if err != nil {
-		log.Printf("Error pulling image %s: %v\n", d.Config.Image, err)
+		log.Printf("Error pulling image %s: %v\n", c.Image, err)
 		return ContainerResult{Error: err}
 	}
 	io.Copy(os.Stdout, reader)
 
 	rp := container.RestartPolicy{
-		Name: d.Config.RestartPolicy,
+		Name: c.RestartPolicy,
 	}
 
 	r := container.Resources{
-		Memory:   d.Config.Memory,
-		NanoCPUs: int64(d.Config.Cpu * math.Pow(10, 9)),
+		Memory:   c.Memory,
+		NanoCPUs: int64(c.Cpu * math.Pow(10, 9)),
+	}
+
+	ports := publishedPorts(c)
+	exposed := make(nat.PortSet)
+	for p := range ports {
+		exposed[p] = struct{}{}
 	}
 
 	hc := container.HostConfig{
-		RestartPolicy:   rp,
-		Resources:       r,
-		PublishAllPorts: true,
+		RestartPolicy: rp,
+		Resources:     r,
+		PortBindings:  ports,
+		Mounts:        dockerMounts(c.Mounts),
+	}
+	// Disk quotas are only enforced by some storage drivers, such as
+	// overlay2 on xfs mounted with pquota, btrfs and zfs.
+	if c.Disk > 0 && !d.noDiskQuota.Load() {
+		hc.StorageOpt = map[string]string{"size": strconv.FormatInt(c.Disk, 10)}
 	}
 
-	resp, err := d.Client.ContainerCreate(ctx, &container.Config{
-		Image:        d.Config.Image,
+	cc := &container.Config{
+		Image:        c.Image,
 		Tty:          false,
-		Env:          d.Config.Env,
-		ExposedPorts: d.Config.ExposedPorts,
-	}, &hc, nil, nil, d.Config.Name)
+		Env:          c.Env,
+		Entrypoint:   c.Entrypoint,
+		Cmd:          c.Cmd,
+		WorkingDir:   c.WorkingDir,
+		User:         c.User,
+		Labels:       c.Labels,
+		ExposedPorts: exposed,
+	}
+	resp, err := d.Client.ContainerCreate(ctx, cc, &hc, nil, nil, c.Name)
+	if err != nil && hc.StorageOpt != nil && diskQuotaUnsupported(err) {
+		log.Printf("Storage driver cannot enforce disk quotas, creating containers without them: %v\n", err)
+		d.noDiskQuota.Store(true)
+		hc.StorageOpt = nil
+		resp, err = d.Client.ContainerCreate(ctx, cc, &hc, nil, nil, c.Name)
+	}
 	if err != nil {
-		log.Printf("Error creating container using image %s: %v\n", d.Config.Image, err)
+		log.Printf("Error creating container using image %s: %v\n", c.Image, err)
 		return ContainerResult{Error: err}
 	}
 
@@ -101,17 +141,26 @@ func (d *Docker) Run() ContainerResult {
 		return ContainerResult{Error: err}
 	}
 
-	out, err := d.Client.ContainerLogs(ctx, resp.ID, container.LogsOptions{ShowStdout: true, ShowStderr: true})
-	if err != nil {
-		log.Printf("Error getting logs for container %s: %v\n", resp.ID, err)
-		return ContainerResult{Error: err}
-	}
-
-	stdcopy.StdCopy(os.Stdout, os.Stderr, out)
-
 	return ContainerResult{ContainerId: resp.ID, Action: "start", Result: "success"}
 }
 
+func dockerMounts(mounts []Mount) []mount.Mount {
+	var dm []mount.Mount
+	for _, m := range mounts {
+		d := mount.Mount{
+			Type:     mount.Type(m.Type),
+			Source:   m.Source,
+			Target:   m.Target,
+			ReadOnly: m.ReadOnly,
+		}
+		if m.TmpfsSize > 0 {
+			d.TmpfsOptions = &mount.TmpfsOptions{SizeBytes: m.TmpfsSize}
+		}
+		dm = append(dm, d)
+	}
+	return dm
+}
+
 func (d *Docker) Stop(id string) ContainerResult {
 	log.Printf("Attempting to stop container %v", id)
 	ctx := context.Background()
@@ -140,9 +189,8 @@ func (d *Docker) Remove(id string) ContainerResult {
 }
 
 func (d *Docker) Inspect(containerID string) ContainerInspectResponse {
-	dc, _ := client.NewClientWithOpts(client.FromEnv)
 	ctx := context.Background()
-	resp, err := dc.ContainerInspect(ctx, containerID)
+	resp, err := d.Client.ContainerInspect(ctx, containerID)
 	if err != nil {
 		log.Printf("Error inspecting container: %s\n", err)
 		return ContainerInspectResponse{Error: err}
@@ -150,3 +198,129 @@ func (d *Docker) Inspect(containerID string) ContainerInspectResponse {
 	return ContainerInspectResponse{Container: &resp}
 
 }
+
+func (d *Docker) Exec(ctx context.Context, containerID string, cmd []string) ExecResult {
+	var out bytes.Buffer
+	code, err := d.ExecAttach(ctx, containerID, ExecConfig{Cmd: cmd}, nil, &out, &out)
+	return ExecResult{Error: err, ExitCode: code, Output: out.String()}
+}
+
+func (d *Docker) ExecAttach(ctx context.Context, containerID string, c ExecConfig, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+	created, err := d.Client.ContainerExecCreate(ctx, containerID, container.ExecOptions{
+		Cmd:          c.Cmd,
+		Tty:          c.Tty,
+		ConsoleSize:  c.consoleSize(),
+		AttachStdin:  stdin != nil,
+		AttachStdout: true,
+		AttachStderr: true,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	attach, err := d.Client.ContainerExecAttach(ctx, created.ID, container.ExecAttachOptions{Tty: c.Tty, ConsoleSize: c.consoleSize()})
+	if err != nil {
+		return 0, err
+	}
+	defer attach.Close()
+
+	// The attached connection outlives ctx unless it is closed.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			attach.Close()
+		case <-done:
+		}
+	}()
+
+	if stdin != nil {
+		go func() {
+			io.Copy(attach.Conn, stdin)
+			attach.CloseWrite()
+		}()
+	}
+	if c.Tty {
+		_, err = io.Copy(stdout, attach.Reader)
+	} else {
+		_, err = stdcopy.StdCopy(stdout, stderr, attach.Reader)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	inspect, err := d.Client.ContainerExecInspect(ctx, created.ID)
+	if err != nil {
+		return 0, err
+	}
+	return inspect.ExitCode, nil
+}
+
+// Logs returns the output of the container, with stdout and stderr
+// interleaved.
+func (d *Docker) Logs(ctx context.Context, containerID string, opts LogsOptions) (io.ReadCloser, error) {
+	lo := container.LogsOptions{
+		ShowStdout: true,
+		ShowStderr: true,
+		Follow:     opts.Follow,
+		Tail:       opts.Tail,
+		Timestamps: opts.Timestamps,
+	}
+	if !opts.Since.IsZero() {
+		lo.Since = opts.Since.Format(time.RFC3339Nano)
+	}
+	out, err := d.Client.ContainerLogs(ctx, containerID, lo)
+	if err != nil {
+		return nil, err
+	}
+	return demux(out), nil
+}
+
+func (d *Docker) RemoveVolume(name string) error {
+	log.Printf("Attempting to delete volume %v", name)
+	if err := d.Client.VolumeRemove(context.Background(), name, false); err != nil {
+		log.Printf("Error removing volume %s: %v\n", name, err)
+		return err
+	}
+	return nil
+}
+
+func (d *Docker) Stats(containerID string) (ContainerStats, error) {
+	ctx := context.Background()
+	resp, err := d.Client.ContainerStatsOneShot(ctx, containerID)
+	if err != nil {
+		return ContainerStats{}, err
+	}
+	defer resp.Body.Close()
+	var s container.StatsResponse
+	if err := json.NewDecoder(resp.Body).Decode(&s); err != nil {
+		return ContainerStats{}, fmt.Errorf("error decoding stats of container %s: %v", containerID, err)
+	}
+
+	// Like docker stats, leave out the page cache: inactive_file on
+	// cgroup v2 hosts and total_inactive_file on cgroup v1 ones.
+	memory := s.MemoryStats.Usage
+	for _, key := range []string{"inactive_file", "total_inactive_file"} {
+		if cache, ok := s.MemoryStats.Stats[key]; ok && cache < memory {
+			memory -= cache
+			break
+		}
+	}
+
+	info, _, err := d.Client.ContainerInspectWithRaw(ctx, containerID, true)
+	if err != nil {
+		return ContainerStats{}, err
+	}
+	var disk int64
+	if info.SizeRw != nil {
+		disk = *info.SizeRw
+	}
+
+	return ContainerStats{
+		CpuTime: time.Duration(s.CPUStats.CPUUsage.TotalUsage),
+		Memory:  int64(memory),
+		Disk:    disk,
+		Time:    s.Read,
+	}, nil
+}
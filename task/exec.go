@@ -0,0 +1,22 @@
+package task
+
+// ExecConfig describes an interactive command run with
+// ContainerRuntime.ExecAttach.
+type ExecConfig struct {
+	Cmd []string
+	// Tty allocates a terminal for the command, in which case everything
+	// it writes goes to stdout.
+	Tty bool
+	// Height and Width set the initial size of the terminal.
+	Height uint
+	Width  uint
+}
+
+// consoleSize returns the initial terminal size in the form container
+// engines expect, or nil if it is not set.
+func (c ExecConfig) consoleSize() *[2]uint {
+	if !c.Tty || c.Height == 0 || c.Width == 0 {
+		return nil
+	}
+	return &[2]uint{c.Height, c.Width}
+}
@@ -0,0 +1,503 @@
+package task
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/go-connections/nat"
+)
+
+// FakeBehavior scripts the lifecycle of the containers a Fake runtime starts
+// for a given image.
+type FakeBehavior struct {
+	// StartDelay is how long Run blocks before the container is started.
+	StartDelay time.Duration
+	// RunError, when set, makes Run fail without creating a container.
+	RunError error
+	// ExitAfter is how long the container runs before exiting on its own.
+	// Zero means it runs until stopped.
+	ExitAfter time.Duration
+	// ExitCode is reported once the container has exited on its own.
+	ExitCode int
+	// Ports overrides the host ports published for the container. When nil,
+	// ports are published as mapped in the config, exposed ports without a
+	// mapping going to the next free host port.
+	Ports nat.PortMap
+	// Exec returns the exit code and output of commands run in the
+	// container. When nil, commands copy their stdin to stdout and exit
+	// with code 0.
+	Exec func(cmd []string) (int, string)
+	// Logs are the lines the container writes when it starts.
+	Logs []string
+	// Cpu is the number of CPUs the container keeps busy while it runs.
+	Cpu float64
+	// Memory and Disk are the bytes of memory and disk the container uses.
+	Memory int64
+	Disk   int64
+}
+
+// fakeLogPollInterval is how often followed logs of a fake container are
+// checked for new lines.
+const fakeLogPollInterval = 5 * time.Millisecond
+
+type fakeLogLine struct {
+	time time.Time
+	text string
+}
+
+type fakeContainer struct {
+	id         string
+	config     Config
+	behavior   FakeBehavior
+	ports      nat.PortMap
+	startedAt  time.Time
+	finishedAt time.Time
+	exited     bool
+	exitCode   int
+	logs       []fakeLogLine
+}
+
+// Fake is an in-process ContainerRuntime. It never talks to a container
+// engine, which makes it suitable for tests running on hosts without Docker.
+type Fake struct {
+	mu         sync.Mutex
+	behaviors  map[string]FakeBehavior
+	containers map[string]*fakeContainer
+	volumes    map[string]bool
+	nextID     int
+	nextPort   int
+}
+
+func NewFake() *Fake {
+	return &Fake{
+		behaviors:  make(map[string]FakeBehavior),
+		containers: make(map[string]*fakeContainer),
+		volumes:    make(map[string]bool),
+		nextPort:   32768,
+	}
+}
+
+// Script sets the behavior of containers subsequently started from image.
+func (f *Fake) Script(image string, b FakeBehavior) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.behaviors[image] = b
+}
+
+// Crash makes a running container exit immediately with exitCode.
+func (f *Fake) Crash(containerID string, exitCode int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	c, ok := f.containers[containerID]
+	if !ok {
+		return fmt.Errorf("no such container: %s", containerID)
+	}
+	f.refresh(c)
+	if c.exited {
+		return fmt.Errorf("container %s is not running", containerID)
+	}
+	c.exited = true
+	c.exitCode = exitCode
+	c.finishedAt = time.Now().UTC()
+	return nil
+}
+
+// Log makes a running container write line to its logs.
+func (f *Fake) Log(containerID string, line string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	c, ok := f.containers[containerID]
+	if !ok {
+		return fmt.Errorf("no such container: %s", containerID)
+	}
+	f.refresh(c)
+	if c.exited {
+		return fmt.Errorf("container %s is not running", containerID)
+	}
+	c.logs = append(c.logs, fakeLogLine{time: time.Now().UTC(), text: line})
+	return nil
+}
+
+// Volumes returns the names of the volumes that have not been removed.
+func (f *Fake) Volumes() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var names []string
+	for name := range f.volumes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Containers returns the IDs of all containers that have not been removed.
+func (f *Fake) Containers() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var ids []string
+	for id := range f.containers {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func (f *Fake) Run(c *Config) ContainerResult {
+	f.mu.Lock()
+	b := f.behaviors[c.Image]
+	f.mu.Unlock()
+
+	if b.StartDelay > 0 {
+		time.Sleep(b.StartDelay)
+	}
+	if b.RunError != nil {
+		log.Printf("Error starting container for image %s: %v\n", c.Image, b.RunError)
+		return ContainerResult{Error: b.RunError}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.checkHostPorts(c); err != nil {
+		log.Printf("Error starting container for image %s: %v\n", c.Image, err)
+		return ContainerResult{Error: err}
+	}
+
+	f.nextID++
+	fc := &fakeContainer{
+		id:        fmt.Sprintf("fake-%d", f.nextID),
+		config:    *c,
+		behavior:  b,
+		ports:     b.Ports,
+		startedAt: time.Now().UTC(),
+	}
+	for _, line := range b.Logs {
+		fc.logs = append(fc.logs, fakeLogLine{time: fc.startedAt, text: line})
+	}
+	if fc.ports == nil {
+		fc.ports = publishedPorts(c)
+		for _, bindings := range fc.ports {
+			for i := range bindings {
+				if bindings[i].HostIP == "" {
+					bindings[i].HostIP = "0.0.0.0"
+				}
+				if bindings[i].HostPort == "" {
+					bindings[i].HostPort = strconv.Itoa(f.nextPort)
+					f.nextPort++
+				}
+			}
+		}
+	}
+	for _, m := range c.Mounts {
+		if m.Type == MountVolume {
+			f.volumes[m.Source] = true
+		}
+	}
+	f.containers[fc.id] = fc
+
+	return ContainerResult{ContainerId: fc.id, Action: "start", Result: "success"}
+}
+
+// checkHostPorts fails like a container engine would if c maps a host port
+// already published by a running container.
+func (f *Fake) checkHostPorts(c *Config) error {
+	for _, m := range c.PortMappings {
+		if m.HostPort == 0 {
+			continue
+		}
+		for _, other := range f.containers {
+			f.refresh(other)
+			if other.exited {
+				continue
+			}
+			for p, bindings := range other.ports {
+				for _, b := range bindings {
+					if p.Proto() == m.Port().Proto() && b.HostPort == strconv.Itoa(int(m.HostPort)) {
+						return fmt.Errorf("host port %s is already allocated", m.HostPortKey())
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (f *Fake) Stop(id string) ContainerResult {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	c, ok := f.containers[id]
+	if !ok {
+		return ContainerResult{Error: fmt.Errorf("no such container: %s", id)}
+	}
+	f.refresh(c)
+	if !c.exited {
+		c.exited = true
+		// A container stopped on request is killed by SIGTERM.
+		c.exitCode = 143
+		c.finishedAt = time.Now().UTC()
+	}
+	return ContainerResult{Action: "stop", Result: "success"}
+}
+
+func (f *Fake) Remove(id string) ContainerResult {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	c, ok := f.containers[id]
+	if !ok {
+		return ContainerResult{Error: fmt.Errorf("no such container: %s", id)}
+	}
+	f.refresh(c)
+	if !c.exited {
+		return ContainerResult{Error: fmt.Errorf("cannot remove running container %s", id)}
+	}
+	delete(f.containers, id)
+	return ContainerResult{Action: "delete", Result: "success"}
+}
+
+func (f *Fake) Stats(containerID string) (ContainerStats, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	c, ok := f.containers[containerID]
+	if !ok {
+		return ContainerStats{}, fmt.Errorf("no such container: %s", containerID)
+	}
+	f.refresh(c)
+	if c.exited {
+		return ContainerStats{}, fmt.Errorf("container %s is not running", containerID)
+	}
+	now := time.Now().UTC()
+	return ContainerStats{
+		CpuTime: time.Duration(c.behavior.Cpu * float64(now.Sub(c.startedAt))),
+		Memory:  c.behavior.Memory,
+		Disk:    c.behavior.Disk,
+		Time:    now,
+	}, nil
+}
+
+func (f *Fake) RemoveVolume(name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !f.volumes[name] {
+		return fmt.Errorf("no such volume: %s", name)
+	}
+	for _, c := range f.containers {
+		for _, m := range c.config.Mounts {
+			if m.Type == MountVolume && m.Source == name {
+				return fmt.Errorf("volume %s is in use by container %s", name, c.id)
+			}
+		}
+	}
+	delete(f.volumes, name)
+	return nil
+}
+
+func (f *Fake) Inspect(containerID string) ContainerInspectResponse {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	c, ok := f.containers[containerID]
+	if !ok {
+		return ContainerInspectResponse{Error: fmt.Errorf("no such container: %s", containerID)}
+	}
+	f.refresh(c)
+
+	state := &types.ContainerState{
+		Status:    "running",
+		Running:   true,
+		StartedAt: c.startedAt.Format(time.RFC3339Nano),
+	}
+	if c.exited {
+		state.Status = "exited"
+		state.Running = false
+		state.ExitCode = c.exitCode
+		state.FinishedAt = c.finishedAt.Format(time.RFC3339Nano)
+	}
+
+	var storageOpt map[string]string
+	if c.config.Disk > 0 {
+		storageOpt = map[string]string{"size": strconv.FormatInt(c.config.Disk, 10)}
+	}
+
+	return ContainerInspectResponse{Container: &types.ContainerJSON{
+		ContainerJSONBase: &types.ContainerJSONBase{
+			ID:    c.id,
+			Name:  "/" + c.config.Name,
+			Image: c.config.Image,
+			State: state,
+			HostConfig: &container.HostConfig{
+				Resources: container.Resources{
+					Memory:   c.config.Memory,
+					NanoCPUs: int64(c.config.Cpu * 1e9),
+				},
+				StorageOpt: storageOpt,
+			},
+		},
+		Mounts: fakeMountPoints(c.config.Mounts),
+		Config: &container.Config{
+			Image:        c.config.Image,
+			Env:          c.config.Env,
+			Entrypoint:   c.config.Entrypoint,
+			Cmd:          c.config.Cmd,
+			WorkingDir:   c.config.WorkingDir,
+			User:         c.config.User,
+			Labels:       c.config.Labels,
+			ExposedPorts: c.config.ExposedPorts,
+		},
+		NetworkSettings: &types.NetworkSettings{
+			NetworkSettingsBase: types.NetworkSettingsBase{Ports: c.ports},
+		},
+	}}
+}
+
+// refresh applies the scripted exit of a container whose time is up.
+// The caller must hold f.mu.
+func (f *Fake) refresh(c *fakeContainer) {
+	if c.exited || c.behavior.ExitAfter == 0 {
+		return
+	}
+	exitAt := c.startedAt.Add(c.behavior.ExitAfter)
+	if time.Now().After(exitAt) {
+		c.exited = true
+		c.exitCode = c.behavior.ExitCode
+		c.finishedAt = exitAt
+	}
+}
+
+func (f *Fake) Exec(ctx context.Context, containerID string, cmd []string) ExecResult {
+	var out strings.Builder
+	code, err := f.ExecAttach(ctx, containerID, ExecConfig{Cmd: cmd}, nil, &out, &out)
+	return ExecResult{Error: err, ExitCode: code, Output: out.String()}
+}
+
+func (f *Fake) ExecAttach(ctx context.Context, containerID string, c ExecConfig, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+	f.mu.Lock()
+	fc, ok := f.containers[containerID]
+	running := false
+	if ok {
+		f.refresh(fc)
+		running = !fc.exited
+	}
+	f.mu.Unlock()
+
+	if !ok {
+		return 0, fmt.Errorf("no such container: %s", containerID)
+	}
+	if !running {
+		return 0, fmt.Errorf("container %s is not running", containerID)
+	}
+	// The behavior is only written by Run, so it can be read unlocked.
+	if fc.behavior.Exec != nil {
+		code, out := fc.behavior.Exec(c.Cmd)
+		_, err := io.WriteString(stdout, out)
+		return code, err
+	}
+	if stdin == nil {
+		return 0, nil
+	}
+
+	copied := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(stdout, stdin)
+		copied <- err
+	}()
+	select {
+	case err := <-copied:
+		return 0, err
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
+func (f *Fake) Logs(ctx context.Context, containerID string, opts LogsOptions) (io.ReadCloser, error) {
+	f.mu.Lock()
+	c, ok := f.containers[containerID]
+	next := 0
+	if ok {
+		if n := opts.tailLines(); n >= 0 && n < len(c.logs) {
+			next = len(c.logs) - n
+		}
+	}
+	f.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("no such container: %s", containerID)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	pr, pw := io.Pipe()
+	go func() {
+		defer cancel()
+		ticker := time.NewTicker(fakeLogPollInterval)
+		defer ticker.Stop()
+
+		for {
+			f.mu.Lock()
+			f.refresh(c)
+			lines := append([]fakeLogLine(nil), c.logs[next:]...)
+			next = len(c.logs)
+			exited := c.exited
+			f.mu.Unlock()
+
+			for _, l := range lines {
+				if l.time.Before(opts.Since) {
+					continue
+				}
+				text := l.text + "\n"
+				if opts.Timestamps {
+					text = l.time.Format(time.RFC3339Nano) + " " + text
+				}
+				if _, err := io.WriteString(pw, text); err != nil {
+					return
+				}
+			}
+			if !opts.Follow || exited {
+				pw.Close()
+				return
+			}
+
+			select {
+			case <-ctx.Done():
+				pw.CloseWithError(ctx.Err())
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return &logReader{Reader: pr, close: func() error {
+		cancel()
+		return pr.Close()
+	}}, nil
+}
+
+func fakeMountPoints(mounts []Mount) []types.MountPoint {
+	var points []types.MountPoint
+	for _, m := range mounts {
+		p := types.MountPoint{
+			Type:        mount.Type(m.Type),
+			Source:      m.Source,
+			Destination: m.Target,
+			RW:          !m.ReadOnly,
+		}
+		if m.Type == MountVolume {
+			p.Name = m.Source
+		}
+		points = append(points, p)
+	}
+	return points
+}
@@ -0,0 +1,192 @@
+package task
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/go-connections/nat"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestFakeRuntimeLifecycle(t *testing.T) {
+	f := NewFake()
+	f.Script("exits", FakeBehavior{ExitAfter: 10 * time.Millisecond, ExitCode: 3})
+	f.Script("broken", FakeBehavior{RunError: errors.New("pull failed")})
+
+	tests := []struct {
+		name     string
+		image    string
+		wait     time.Duration
+		wantErr  bool
+		status   string
+		exitCode int
+	}{
+		{"runs until stopped", "server", 20 * time.Millisecond, false, "running", 0},
+		{"exits with scripted code", "exits", 20 * time.Millisecond, false, "exited", 3},
+		{"fails to start", "broken", 0, true, "", 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := f.Run(&Config{Name: tt.name, Image: tt.image})
+			if (result.Error != nil) != tt.wantErr {
+				t.Fatalf("Run() error = %v; wantErr %v", result.Error, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			time.Sleep(tt.wait)
+			resp := f.Inspect(result.ContainerId)
+			if resp.Error != nil {
+				t.Fatalf("Inspect() error = %v", resp.Error)
+			}
+			if resp.Container.State.Status != tt.status {
+				t.Errorf("status = %s; want %s", resp.Container.State.Status, tt.status)
+			}
+			if resp.Container.State.ExitCode != tt.exitCode {
+				t.Errorf("exit code = %d; want %d", resp.Container.State.ExitCode, tt.exitCode)
+			}
+		})
+	}
+}
+
+func TestFakeRuntimeCrashAndRemove(t *testing.T) {
+	f := NewFake()
+	result := f.Run(&Config{Name: "web", Image: "server", ExposedPorts: nat.PortSet{"80/tcp": struct{}{}}})
+
+	resp := f.Inspect(result.ContainerId)
+	if len(resp.Container.NetworkSettings.Ports["80/tcp"]) != 1 {
+		t.Fatalf("expected port 80/tcp to be published, got %v", resp.Container.NetworkSettings.Ports)
+	}
+
+	if r := f.Remove(result.ContainerId); r.Error == nil {
+		t.Errorf("expected removing a running container to fail")
+	}
+
+	if err := f.Crash(result.ContainerId, 137); err != nil {
+		t.Fatalf("Crash() error = %v", err)
+	}
+	resp = f.Inspect(result.ContainerId)
+	if resp.Container.State.Status != "exited" || resp.Container.State.ExitCode != 137 {
+		t.Errorf("expected container to have exited with 137, got %+v", resp.Container.State)
+	}
+
+	if r := f.Remove(result.ContainerId); r.Error != nil {
+		t.Fatalf("Remove() error = %v", r.Error)
+	}
+	if len(f.Containers()) != 0 {
+		t.Errorf("expected no containers left, got %v", f.Containers())
+	}
+}
+
+func TestFakeRuntimePortMappings(t *testing.T) {
+	f := NewFake()
+	c := &Config{Name: "web", Image: "server", PortMappings: []PortMapping{{ContainerPort: 80, HostPort: 8080, HostIP: "127.0.0.1"}}}
+	result := f.Run(c)
+	if result.Error != nil {
+		t.Fatalf("Run() error = %v", result.Error)
+	}
+	want := []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: "8080"}}
+	if got := f.Inspect(result.ContainerId).Container.NetworkSettings.Ports["80/tcp"]; !cmp.Equal(got, want) {
+		t.Errorf("ports of 80/tcp = %v; want %v", got, want)
+	}
+
+	if r := f.Run(c); r.Error == nil {
+		t.Error("expected a second container mapping host port 8080 to fail")
+	}
+	f.Stop(result.ContainerId)
+	if r := f.Run(c); r.Error != nil {
+		t.Errorf("Run() after the port was freed: error = %v", r.Error)
+	}
+}
+
+func TestFakeRuntimeStats(t *testing.T) {
+	f := NewFake()
+	f.Script("busy", FakeBehavior{Cpu: 2, Memory: 64 << 20, Disk: 1 << 20})
+	result := f.Run(&Config{Name: "busy", Image: "busy", Disk: 1 << 30})
+
+	if got := f.Inspect(result.ContainerId).Container.HostConfig.StorageOpt["size"]; got != "1073741824" {
+		t.Errorf("disk quota = %q; want 1073741824", got)
+	}
+
+	first, err := f.Stats(result.ContainerId)
+	if err != nil {
+		t.Fatalf("Stats() error = %v", err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	second, err := f.Stats(result.ContainerId)
+	if err != nil {
+		t.Fatalf("Stats() error = %v", err)
+	}
+	if u := Usage(first, second); u.Cpu < 1.9 || u.Cpu > 2.1 || u.Memory != 64<<20 || u.Disk != 1<<20 {
+		t.Errorf("usage = %+v; want 2 CPUs, 64 MiB of memory and 1 MiB of disk", u)
+	}
+
+	f.Stop(result.ContainerId)
+	if _, err := f.Stats(result.ContainerId); err == nil {
+		t.Error("expected stats of a stopped container to fail")
+	}
+}
+
+func TestFakeRuntimeLogs(t *testing.T) {
+	f := NewFake()
+	f.Script("server", FakeBehavior{Logs: []string{"starting", "listening"}})
+	result := f.Run(&Config{Name: "web", Image: "server"})
+
+	read := func(opts LogsOptions) string {
+		t.Helper()
+		logs, err := f.Logs(context.Background(), result.ContainerId, opts)
+		if err != nil {
+			t.Fatalf("Logs() error = %v", err)
+		}
+		defer logs.Close()
+		data, err := io.ReadAll(logs)
+		if err != nil {
+			t.Fatalf("reading logs: %v", err)
+		}
+		return string(data)
+	}
+
+	time.Sleep(5 * time.Millisecond)
+	f.Log(result.ContainerId, "ready")
+
+	tests := []struct {
+		name string
+		opts LogsOptions
+		want string
+	}{
+		{"all", LogsOptions{}, "starting\nlistening\nready\n"},
+		{"tail", LogsOptions{Tail: "2"}, "listening\nready\n"},
+		{"tail all", LogsOptions{Tail: "all"}, "starting\nlistening\nready\n"},
+		{"since", LogsOptions{Since: time.Now().Add(-time.Millisecond)}, "ready\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := read(tt.opts); got != tt.want {
+				t.Errorf("logs = %q; want %q", got, tt.want)
+			}
+		})
+	}
+
+	if got := read(LogsOptions{Tail: "1", Timestamps: true}); !strings.HasSuffix(got, " ready\n") || len(got) <= len(" ready\n") {
+		t.Errorf("logs with timestamps = %q", got)
+	}
+
+	// Followed logs stream new lines until the container exits.
+	logs, err := f.Logs(context.Background(), result.ContainerId, LogsOptions{Follow: true, Tail: "0"})
+	if err != nil {
+		t.Fatalf("Logs() error = %v", err)
+	}
+	defer logs.Close()
+	f.Log(result.ContainerId, "request")
+	f.Stop(result.ContainerId)
+	data, err := io.ReadAll(logs)
+	if err != nil || string(data) != "request\n" {
+		t.Errorf("followed logs = %q, %v; want %q", data, err, "request\n")
+	}
+}
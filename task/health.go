@@ -0,0 +1,136 @@
+package task
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/docker/go-connections/nat"
+)
+
+const (
+	DefaultHealthInterval         = 10 * time.Second
+	DefaultHealthTimeout          = time.Second
+	DefaultHealthSuccessThreshold = 1
+	DefaultHealthFailureThreshold = 3
+)
+
+// HealthCheckSpec configures how a worker checks that a running task is
+// healthy. Exactly one of HTTP, TCP and Exec is set.
+type HealthCheckSpec struct {
+	HTTP *HTTPHealthCheck
+	TCP  *TCPHealthCheck
+	Exec *ExecHealthCheck
+	// Interval is the time between two checks. Zero means 10s.
+	Interval Duration
+	// Timeout bounds a single check. Zero means 1s.
+	Timeout Duration
+	// InitialDelay is how long after the container started the first check
+	// runs.
+	InitialDelay Duration
+	// SuccessThreshold is the number of consecutive successful checks after
+	// which the task is healthy. Zero means 1.
+	SuccessThreshold int
+	// FailureThreshold is the number of consecutive failed checks after
+	// which the task is unhealthy. Zero means 3.
+	FailureThreshold int
+}
+
+// HTTPHealthCheck passes if a GET of Path on the host port published for
+// Port answers with ExpectedStatus and every header in ExpectedHeaders.
+type HTTPHealthCheck struct {
+	// Port is the container port, such as "80/tcp". Empty means the first
+	// published port.
+	Port nat.Port
+	Path string
+	// ExpectedStatus is the status code of a healthy response. Zero means
+	// any 2xx or 3xx status.
+	ExpectedStatus  int
+	ExpectedHeaders map[string]string
+}
+
+// TCPHealthCheck passes if a connection to the host port published for
+// Port can be opened.
+type TCPHealthCheck struct {
+	// Port is the container port, such as "5432/tcp". Empty means the first
+	// published port.
+	Port nat.Port
+}
+
+// ExecHealthCheck passes if Command exits with code 0 when run inside the
+// container.
+type ExecHealthCheck struct {
+	Command []string
+}
+
+// Health is the outcome of the health checks of a task.
+type Health string
+
+const (
+	// HealthStarting tasks have not passed or failed enough checks yet.
+	HealthStarting  Health = "starting"
+	HealthHealthy   Health = "healthy"
+	HealthUnhealthy Health = "unhealthy"
+)
+
+// HealthStatus is what a worker reports about the health checks of a task.
+type HealthStatus struct {
+	Status Health `json:",omitempty"`
+	// Successes and Failures count the consecutive checks with the same
+	// result.
+	Successes int       `json:",omitempty"`
+	Failures  int       `json:",omitempty"`
+	LastCheck time.Time `json:",omitempty"`
+	// Message describes the result of the last check.
+	Message string `json:",omitempty"`
+}
+
+// HealthCheckSpec returns the health checks to run for t, if any. The older
+// HealthCheck path is turned into an HTTP check of the first published
+// port.
+func (t *Task) HealthCheckSpec() *HealthCheckSpec {
+	if t.Health != nil {
+		return t.Health
+	}
+	if t.HealthCheck != "" {
+		return &HealthCheckSpec{HTTP: &HTTPHealthCheck{Path: t.HealthCheck}}
+	}
+	return nil
+}
+
+// Validate reports whether the spec sets exactly one kind of check with
+// sensible settings.
+func (s *HealthCheckSpec) Validate() error {
+	kinds := 0
+	for _, set := range []bool{s.HTTP != nil, s.TCP != nil, s.Exec != nil} {
+		if set {
+			kinds++
+		}
+	}
+	if kinds != 1 {
+		return fmt.Errorf("health check must set exactly one of HTTP, TCP and Exec")
+	}
+	if s.Exec != nil && len(s.Exec.Command) == 0 {
+		return fmt.Errorf("exec health check needs a command")
+	}
+	if s.Interval < 0 || s.Timeout < 0 || s.InitialDelay < 0 || s.SuccessThreshold < 0 || s.FailureThreshold < 0 {
+		return fmt.Errorf("health check settings must not be negative")
+	}
+	return nil
+}
+
+// WithDefaults returns a copy of s with the unset settings filled in.
+func (s HealthCheckSpec) WithDefaults() HealthCheckSpec {
+	if s.Interval == 0 {
+		s.Interval = Duration(DefaultHealthInterval)
+	}
+	if s.Timeout == 0 {
+		s.Timeout = Duration(DefaultHealthTimeout)
+	}
+	if s.SuccessThreshold == 0 {
+		s.SuccessThreshold = DefaultHealthSuccessThreshold
+	}
+	if s.FailureThreshold == 0 {
+		s.FailureThreshold = DefaultHealthFailureThreshold
+	}
+	return s
+}
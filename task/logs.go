@@ -0,0 +1,57 @@
+package task
+
+import (
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/moby/moby/pkg/stdcopy"
+)
+
+// LogsOptions selects the container logs returned by ContainerRuntime.Logs.
+type LogsOptions struct {
+	// Follow keeps the logs open and streams new output until the
+	// container exits or the context is cancelled.
+	Follow bool
+	// Tail is the number of lines to return from the end of the logs, or
+	// "all". Empty means all.
+	Tail string
+	// Since, when set, skips output written before it.
+	Since time.Time
+	// Timestamps prefixes each line with the time it was written.
+	Timestamps bool
+}
+
+// tailLines returns the number of lines selected by Tail, or -1 for all.
+func (o LogsOptions) tailLines() int {
+	n, err := strconv.Atoi(o.Tail)
+	if err != nil || n < 0 {
+		return -1
+	}
+	return n
+}
+
+// logReader is a log stream along with what has to be released once the
+// caller is done reading it.
+type logReader struct {
+	io.Reader
+	close func() error
+}
+
+func (r *logReader) Close() error {
+	return r.close()
+}
+
+// demux returns the output of a multiplexed log stream with stdout and
+// stderr interleaved.
+func demux(rc io.ReadCloser) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		_, err := stdcopy.StdCopy(pw, pw, rc)
+		pw.CloseWithError(err)
+	}()
+	return &logReader{Reader: pr, close: func() error {
+		pr.Close()
+		return rc.Close()
+	}}
+}
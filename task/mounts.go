@@ -0,0 +1,111 @@
+package task
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+)
+
+type MountType string
+
+const (
+	// MountVolume mounts a named volume, created on first use.
+	MountVolume MountType = "volume"
+	// MountBind mounts a path of the worker's host. Workers only allow
+	// paths they are configured to.
+	MountBind MountType = "bind"
+	// MountTmpfs mounts an in-memory filesystem, discarded with the
+	// container.
+	MountTmpfs MountType = "tmpfs"
+)
+
+// Mount makes storage available inside the container of a task.
+type Mount struct {
+	Type MountType
+	// Source is the name of the volume for volume mounts and the host path
+	// for bind mounts. Tmpfs mounts have none.
+	Source string `json:",omitempty"`
+	// Target is where the mount appears in the container.
+	Target   string
+	ReadOnly bool `json:",omitempty"`
+	// TmpfsSize limits the size of tmpfs mounts, in bytes. Zero leaves it
+	// to the runtime.
+	TmpfsSize int64 `json:",omitempty"`
+}
+
+// VolumeRetention decides what happens to the named volumes of a task once
+// it is stopped.
+type VolumeRetention string
+
+const (
+	// RetainVolumes keeps the volumes of stopped tasks, for the next task
+	// mounting them. It is the default.
+	RetainVolumes VolumeRetention = "retain"
+	// DeleteVolumes removes the volumes of a task when it is stopped.
+	DeleteVolumes VolumeRetention = "delete"
+)
+
+// volumeName matches the names Docker and Podman accept for volumes.
+var volumeName = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+func (m Mount) validate() error {
+	if !path.IsAbs(m.Target) {
+		return fmt.Errorf("mount target %q must be an absolute path", m.Target)
+	}
+	switch m.Type {
+	case MountVolume:
+		if !volumeName.MatchString(m.Source) {
+			return fmt.Errorf("invalid volume name %q for mount at %s", m.Source, m.Target)
+		}
+	case MountBind:
+		if !path.IsAbs(m.Source) {
+			return fmt.Errorf("bind mount source %q must be an absolute path", m.Source)
+		}
+	case MountTmpfs:
+		if m.Source != "" {
+			return fmt.Errorf("tmpfs mount at %s cannot have a source", m.Target)
+		}
+	default:
+		return fmt.Errorf("unknown mount type %q for mount at %s", m.Type, m.Target)
+	}
+	if m.TmpfsSize != 0 && m.Type != MountTmpfs {
+		return fmt.Errorf("%s mount at %s cannot have a tmpfs size", m.Type, m.Target)
+	}
+	if m.TmpfsSize < 0 {
+		return fmt.Errorf("tmpfs mount at %s has a negative size", m.Target)
+	}
+	return nil
+}
+
+func (t *Task) validateMounts() error {
+	targets := make(map[string]bool)
+	for _, m := range t.Mounts {
+		if err := m.validate(); err != nil {
+			return err
+		}
+		target := path.Clean(m.Target)
+		if targets[target] {
+			return fmt.Errorf("%s is mounted more than once", target)
+		}
+		targets[target] = true
+	}
+	switch t.VolumeRetention {
+	case "", RetainVolumes, DeleteVolumes:
+	default:
+		return fmt.Errorf("unknown volume retention %q", t.VolumeRetention)
+	}
+	return nil
+}
+
+// Volumes returns the names of the volumes t mounts.
+func (t *Task) Volumes() []string {
+	var names []string
+	seen := make(map[string]bool)
+	for _, m := range t.Mounts {
+		if m.Type == MountVolume && !seen[m.Source] {
+			seen[m.Source] = true
+			names = append(names, m.Source)
+		}
+	}
+	return names
+}
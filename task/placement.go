@@ -0,0 +1,87 @@
+package task
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// LabelSelector selects the labels that hold every one of its key/value
+// pairs.
+type LabelSelector map[string]string
+
+// Matches reports whether labels hold every pair of s. An empty selector
+// matches any labels.
+func (s LabelSelector) Matches(labels map[string]string) bool {
+	for k, v := range s {
+		if got, ok := labels[k]; !ok || got != v {
+			return false
+		}
+	}
+	return true
+}
+
+func (s LabelSelector) String() string {
+	pairs := make([]string, 0, len(s))
+	for k, v := range s {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (s LabelSelector) validate() error {
+	for k := range s {
+		if k == "" {
+			return fmt.Errorf("label selector %q has an empty key", s)
+		}
+	}
+	return nil
+}
+
+// Toleration lets a task be placed on workers with a matching taint.
+type Toleration struct {
+	Key string
+	// Value is the value of the taint tolerated. An empty value tolerates
+	// any value of the key.
+	Value string `json:",omitempty"`
+}
+
+// Tolerates reports whether t may be placed on a worker with the taint
+// key=value.
+func (t *Task) Tolerates(key, value string) bool {
+	for _, tol := range t.Tolerations {
+		if tol.Key == key && (tol.Value == "" || tol.Value == value) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *Task) validatePlacement() error {
+	if err := t.NodeSelector.validate(); err != nil {
+		return fmt.Errorf("node selector: %w", err)
+	}
+	for _, s := range t.Affinity {
+		if len(s) == 0 {
+			return fmt.Errorf("affinity rules must select at least one label")
+		}
+		if err := s.validate(); err != nil {
+			return fmt.Errorf("affinity: %w", err)
+		}
+	}
+	for _, s := range t.AntiAffinity {
+		if len(s) == 0 {
+			return fmt.Errorf("anti-affinity rules must select at least one label")
+		}
+		if err := s.validate(); err != nil {
+			return fmt.Errorf("anti-affinity: %w", err)
+		}
+	}
+	for _, tol := range t.Tolerations {
+		if tol.Key == "" {
+			return fmt.Errorf("toleration of value %q has an empty key", tol.Value)
+		}
+	}
+	return nil
+}
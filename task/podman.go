@@ -0,0 +1,647 @@
+package task
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/go-connections/nat"
+	"github.com/moby/moby/pkg/stdcopy"
+)
+
+// podmanAPIVersion is the libpod API version requested from the service.
+const podmanAPIVersion = "v4.0.0"
+
+// Podman talks to a Podman service through its libpod REST API.
+type Podman struct {
+	Client *http.Client
+	// BaseURL is the root of the libpod API, e.g. http://d/v4.0.0/libpod.
+	BaseURL string
+	// noDiskQuota is set once the storage driver refused a disk quota, so
+	// that later containers are created without one straight away.
+	noDiskQuota atomic.Bool
+}
+
+// NewPodman connects to the Podman service listening on host, which is either
+// a unix:// socket or an http(s):// URL. When host is empty the socket is taken
+// from CONTAINER_HOST, then from the rootless default under XDG_RUNTIME_DIR,
+// then from the rootful default.
+func NewPodman(host string) (*Podman, error) {
+	if host == "" {
+		host = defaultPodmanHost()
+	}
+
+	u, err := url.Parse(host)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Podman host %s: %v", host, err)
+	}
+
+	p := Podman{}
+	switch u.Scheme {
+	case "unix":
+		socket := u.Path
+		p.Client = &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "unix", socket)
+				},
+			},
+		}
+		p.BaseURL = fmt.Sprintf("http://d/%s/libpod", podmanAPIVersion)
+	case "http", "https":
+		p.Client = &http.Client{}
+		p.BaseURL = fmt.Sprintf("%s/%s/libpod", strings.TrimSuffix(host, "/"), podmanAPIVersion)
+	default:
+		return nil, fmt.Errorf("unsupported Podman host scheme %q", u.Scheme)
+	}
+
+	resp, err := p.Client.Get(p.BaseURL + "/_ping")
+	if err != nil {
+		return nil, fmt.Errorf("Podman service is not running: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Podman service is not healthy: %s", resp.Status)
+	}
+
+	return &p, nil
+}
+
+func defaultPodmanHost() string {
+	if host := os.Getenv("CONTAINER_HOST"); host != "" {
+		return host
+	}
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return "unix://" + filepath.Join(dir, "podman", "podman.sock")
+	}
+	return "unix:///run/podman/podman.sock"
+}
+
+type podmanPortMapping struct {
+	ContainerPort uint16 `json:"container_port"`
+	HostPort      uint16 `json:"host_port,omitempty"`
+	HostIP        string `json:"host_ip,omitempty"`
+	Protocol      string `json:"protocol,omitempty"`
+}
+
+type podmanNamedVolume struct {
+	Name    string   `json:"Name"`
+	Dest    string   `json:"Dest"`
+	Options []string `json:"Options,omitempty"`
+}
+
+type podmanMount struct {
+	Destination string   `json:"destination"`
+	Type        string   `json:"type"`
+	Source      string   `json:"source,omitempty"`
+	Options     []string `json:"options,omitempty"`
+}
+
+type podmanResourceLimits struct {
+	Memory *podmanMemory `json:"memory,omitempty"`
+	CPU    *podmanCPU    `json:"cpu,omitempty"`
+}
+
+type podmanMemory struct {
+	Limit int64 `json:"limit"`
+}
+
+type podmanCPU struct {
+	Quota  int64  `json:"quota"`
+	Period uint64 `json:"period"`
+}
+
+// podmanSpec is the subset of the libpod SpecGenerator used by cube.
+type podmanSpec struct {
+	Name              string                `json:"name,omitempty"`
+	Image             string                `json:"image"`
+	Command           []string              `json:"command,omitempty"`
+	Entrypoint        []string              `json:"entrypoint,omitempty"`
+	WorkDir           string                `json:"work_dir,omitempty"`
+	User              string                `json:"user,omitempty"`
+	Labels            map[string]string     `json:"labels,omitempty"`
+	Env               map[string]string     `json:"env,omitempty"`
+	Expose            map[uint16]string     `json:"expose,omitempty"`
+	PortMappings      []podmanPortMapping   `json:"portmappings,omitempty"`
+	Volumes           []podmanNamedVolume   `json:"volumes,omitempty"`
+	Mounts            []podmanMount         `json:"mounts,omitempty"`
+	StorageOpts       map[string]string     `json:"storage_opts,omitempty"`
+	PublishImagePorts bool                  `json:"publish_image_ports"`
+	ResourceLimits    *podmanResourceLimits `json:"resource_limits,omitempty"`
+	RestartPolicy     string                `json:"restart_policy,omitempty"`
+}
+
+type podmanInspect struct {
+	ID      string `json:"Id"`
+	Name    string
+	Image   string
+	Created time.Time
+	State   struct {
+		Status     string
+		Running    bool
+		Paused     bool
+		Restarting bool
+		OOMKilled  bool
+		Dead       bool
+		Pid        int
+		ExitCode   int
+		Error      string
+		StartedAt  time.Time
+		FinishedAt time.Time
+	}
+	Config struct {
+		Image      string
+		Env        []string
+		Cmd        []string
+		WorkingDir string
+		User       string
+		Labels     map[string]string
+	}
+	Mounts          []types.MountPoint
+	NetworkSettings struct {
+		Ports nat.PortMap
+	}
+}
+
+type podmanError struct {
+	Cause    string `json:"cause"`
+	Message  string `json:"message"`
+	Response int    `json:"response"`
+}
+
+func newPodmanSpec(c *Config) (*podmanSpec, error) {
+	s := podmanSpec{
+		Name:          c.Name,
+		Image:         c.Image,
+		Command:       c.Cmd,
+		Entrypoint:    c.Entrypoint,
+		WorkDir:       c.WorkingDir,
+		User:          c.User,
+		Labels:        c.Labels,
+		RestartPolicy: string(c.RestartPolicy),
+	}
+
+	if len(c.Env) > 0 {
+		s.Env = make(map[string]string)
+		for _, e := range c.Env {
+			k, v, _ := strings.Cut(e, "=")
+			s.Env[k] = v
+		}
+	}
+
+	if len(c.ExposedPorts) > 0 {
+		s.Expose = make(map[uint16]string)
+		for p := range c.ExposedPorts {
+			port, err := strconv.ParseUint(p.Port(), 10, 16)
+			if err != nil {
+				return nil, fmt.Errorf("invalid exposed port %s: %v", p, err)
+			}
+			s.Expose[uint16(port)] = p.Proto()
+		}
+	}
+
+	for p, bindings := range publishedPorts(c) {
+		port, err := strconv.ParseUint(p.Port(), 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port %s: %v", p, err)
+		}
+		for _, b := range bindings {
+			m := podmanPortMapping{ContainerPort: uint16(port), HostIP: b.HostIP, Protocol: p.Proto()}
+			if b.HostPort != "" {
+				hostPort, err := strconv.ParseUint(b.HostPort, 10, 16)
+				if err != nil {
+					return nil, fmt.Errorf("invalid host port %s: %v", b.HostPort, err)
+				}
+				m.HostPort = uint16(hostPort)
+			}
+			s.PortMappings = append(s.PortMappings, m)
+		}
+	}
+
+	for _, m := range c.Mounts {
+		var options []string
+		if m.ReadOnly {
+			options = append(options, "ro")
+		}
+		switch m.Type {
+		case MountVolume:
+			s.Volumes = append(s.Volumes, podmanNamedVolume{Name: m.Source, Dest: m.Target, Options: options})
+		case MountBind:
+			s.Mounts = append(s.Mounts, podmanMount{Destination: m.Target, Type: "bind", Source: m.Source, Options: append(options, "rbind")})
+		case MountTmpfs:
+			if m.TmpfsSize > 0 {
+				options = append(options, fmt.Sprintf("size=%d", m.TmpfsSize))
+			}
+			s.Mounts = append(s.Mounts, podmanMount{Destination: m.Target, Type: "tmpfs", Source: "tmpfs", Options: options})
+		default:
+			return nil, fmt.Errorf("unknown mount type %q", m.Type)
+		}
+	}
+
+	if c.Memory > 0 || c.Cpu > 0 {
+		s.ResourceLimits = &podmanResourceLimits{}
+		if c.Memory > 0 {
+			s.ResourceLimits.Memory = &podmanMemory{Limit: c.Memory}
+		}
+		if c.Cpu > 0 {
+			// Podman expresses CPU limits as a CFS quota per 100ms period.
+			s.ResourceLimits.CPU = &podmanCPU{
+				Quota:  int64(c.Cpu * math.Pow(10, 5)),
+				Period: 100000,
+			}
+		}
+	}
+
+	return &s, nil
+}
+
+// do sends a request to the libpod API and decodes an error response if the
+// status code is not one of ok.
+func (p *Podman) do(method string, path string, body interface{}, ok ...int) (*http.Response, error) {
+	return p.doContext(context.Background(), method, path, body, ok...)
+}
+
+func (p *Podman) doContext(ctx context.Context, method string, path string, body interface{}, ok ...int) (*http.Response, error) {
+	req, err := p.newRequest(ctx, method, path, body)
+	if err != nil {
+		return nil, err
+	}
+	return p.send(req, ok...)
+}
+
+func (p *Podman) newRequest(ctx context.Context, method string, path string, body interface{}) (*http.Request, error) {
+	var r io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		r = bytes.NewBuffer(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, p.BaseURL+path, r)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return req, nil
+}
+
+// send sends req, returning an error carrying the message of the service
+// unless the response status is one of ok.
+func (p *Podman) send(req *http.Request, ok ...int) (*http.Response, error) {
+	resp, err := p.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, code := range ok {
+		if resp.StatusCode == code {
+			return resp, nil
+		}
+	}
+
+	defer resp.Body.Close()
+	path := strings.TrimPrefix(req.URL.String(), p.BaseURL)
+	e := podmanError{}
+	if err := json.NewDecoder(resp.Body).Decode(&e); err != nil || e.Message == "" {
+		return nil, fmt.Errorf("%s %s: unexpected status %s", req.Method, path, resp.Status)
+	}
+	return nil, fmt.Errorf("%s %s: %s", req.Method, path, e.Message)
+}
+
+func (p *Podman) pull(image string) error {
+	path := fmt.Sprintf("/images/pull?reference=%s", url.QueryEscape(image))
+	resp, err := p.do(http.MethodPost, path, nil, http.StatusOK)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// The pull progress is streamed as a sequence of JSON objects, any of
+	// which may carry an error.
+	d := json.NewDecoder(resp.Body)
+	for {
+		var report struct {
+			Stream string `json:"stream"`
+			Error  string `json:"error"`
+		}
+		err := d.Decode(&report)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if report.Error != "" {
+			return fmt.Errorf("%s", report.Error)
+		}
+		if report.Stream != "" {
+			io.WriteString(os.Stdout, report.Stream)
+		}
+	}
+}
+
+func (p *Podman) Run(c *Config) ContainerResult {
+	err := p.pull(c.Image)
+	if err != nil {
+		log.Printf("Error pulling image %s: %v\n", c.Image, err)
+		return ContainerResult{Error: err}
+	}
+
+	spec, err := newPodmanSpec(c)
+	if err != nil {
+		log.Printf("Error creating container spec for image %s: %v\n", c.Image, err)
+		return ContainerResult{Error: err}
+	}
+
+	// Disk quotas are only enforced by some storage drivers, such as
+	// overlay on xfs mounted with pquota.
+	if c.Disk > 0 && !p.noDiskQuota.Load() {
+		spec.StorageOpts = map[string]string{"size": strconv.FormatInt(c.Disk, 10)}
+	}
+
+	resp, err := p.do(http.MethodPost, "/containers/create", spec, http.StatusCreated)
+	if err != nil && spec.StorageOpts != nil && diskQuotaUnsupported(err) {
+		log.Printf("Storage driver cannot enforce disk quotas, creating containers without them: %v\n", err)
+		p.noDiskQuota.Store(true)
+		spec.StorageOpts = nil
+		resp, err = p.do(http.MethodPost, "/containers/create", spec, http.StatusCreated)
+	}
+	if err != nil {
+		log.Printf("Error creating container using image %s: %v\n", c.Image, err)
+		return ContainerResult{Error: err}
+	}
+	defer resp.Body.Close()
+
+	created := struct {
+		ID string `json:"Id"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil {
+		log.Printf("Error decoding create response for image %s: %v\n", c.Image, err)
+		return ContainerResult{Error: err}
+	}
+
+	start, err := p.do(http.MethodPost, fmt.Sprintf("/containers/%s/start", created.ID), nil, http.StatusNoContent, http.StatusNotModified)
+	if err != nil {
+		log.Printf("Error starting container %s: %v\n", created.ID, err)
+		return ContainerResult{Error: err}
+	}
+	start.Body.Close()
+
+	return ContainerResult{ContainerId: created.ID, Action: "start", Result: "success"}
+}
+
+func (p *Podman) Stop(id string) ContainerResult {
+	log.Printf("Attempting to stop container %v", id)
+	resp, err := p.do(http.MethodPost, fmt.Sprintf("/containers/%s/stop", id), nil, http.StatusNoContent, http.StatusNotModified)
+	if err != nil {
+		log.Printf("Error stopping container %s: %v\n", id, err)
+		return ContainerResult{Error: err}
+	}
+	resp.Body.Close()
+
+	return ContainerResult{Action: "stop", Result: "success", Error: nil}
+}
+
+func (p *Podman) Remove(id string) ContainerResult {
+	log.Printf("Attempting to delete container %v", id)
+	resp, err := p.do(http.MethodDelete, fmt.Sprintf("/containers/%s?v=true", id), nil, http.StatusOK, http.StatusNoContent)
+	if err != nil {
+		log.Printf("Error removing container %s: %v\n", id, err)
+		return ContainerResult{Error: err}
+	}
+	resp.Body.Close()
+
+	return ContainerResult{Action: "delete", Result: "success", Error: nil}
+}
+
+func (p *Podman) Stats(containerID string) (ContainerStats, error) {
+	path := fmt.Sprintf("/containers/stats?containers=%s&stream=false", url.QueryEscape(containerID))
+	resp, err := p.do(http.MethodGet, path, nil, http.StatusOK)
+	if err != nil {
+		return ContainerStats{}, err
+	}
+	defer resp.Body.Close()
+	report := struct {
+		Error *podmanError
+		Stats []struct {
+			CPUNano  uint64
+			MemUsage uint64
+		}
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+		return ContainerStats{}, fmt.Errorf("error decoding stats of container %s: %v", containerID, err)
+	}
+	if report.Error != nil {
+		return ContainerStats{}, fmt.Errorf("stats of container %s: %s", containerID, report.Error.Message)
+	}
+	if len(report.Stats) == 0 {
+		return ContainerStats{}, fmt.Errorf("no stats for container %s", containerID)
+	}
+	now := time.Now().UTC()
+
+	size, err := p.do(http.MethodGet, fmt.Sprintf("/containers/%s/json?size=true", containerID), nil, http.StatusOK)
+	if err != nil {
+		return ContainerStats{}, err
+	}
+	defer size.Body.Close()
+	var pi struct{ SizeRw int64 }
+	if err := json.NewDecoder(size.Body).Decode(&pi); err != nil {
+		return ContainerStats{}, fmt.Errorf("error decoding size of container %s: %v", containerID, err)
+	}
+
+	return ContainerStats{
+		CpuTime: time.Duration(report.Stats[0].CPUNano),
+		Memory:  int64(report.Stats[0].MemUsage),
+		Disk:    pi.SizeRw,
+		Time:    now,
+	}, nil
+}
+
+func (p *Podman) RemoveVolume(name string) error {
+	log.Printf("Attempting to delete volume %v", name)
+	resp, err := p.do(http.MethodDelete, fmt.Sprintf("/volumes/%s", name), nil, http.StatusNoContent)
+	if err != nil {
+		log.Printf("Error removing volume %s: %v\n", name, err)
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (p *Podman) Inspect(containerID string) ContainerInspectResponse {
+	resp, err := p.do(http.MethodGet, fmt.Sprintf("/containers/%s/json", containerID), nil, http.StatusOK)
+	if err != nil {
+		log.Printf("Error inspecting container: %s\n", err)
+		return ContainerInspectResponse{Error: err}
+	}
+	defer resp.Body.Close()
+
+	var pi podmanInspect
+	if err := json.NewDecoder(resp.Body).Decode(&pi); err != nil {
+		log.Printf("Error decoding inspect response: %s\n", err)
+		return ContainerInspectResponse{Error: err}
+	}
+
+	return ContainerInspectResponse{Container: pi.toContainerJSON()}
+}
+
+// toContainerJSON converts a libpod inspect response to the Docker format the
+// rest of cube works with.
+func (pi *podmanInspect) toContainerJSON() *types.ContainerJSON {
+	state := &types.ContainerState{
+		Status:     pi.State.Status,
+		Running:    pi.State.Running,
+		Paused:     pi.State.Paused,
+		Restarting: pi.State.Restarting,
+		OOMKilled:  pi.State.OOMKilled,
+		Dead:       pi.State.Dead,
+		Pid:        pi.State.Pid,
+		ExitCode:   pi.State.ExitCode,
+		Error:      pi.State.Error,
+		StartedAt:  pi.State.StartedAt.Format(time.RFC3339Nano),
+		FinishedAt: pi.State.FinishedAt.Format(time.RFC3339Nano),
+	}
+	// libpod reports containers that were stopped as "stopped" or "exited"
+	// depending on the version; cube only knows the Docker name.
+	if state.Status == "stopped" {
+		state.Status = "exited"
+	}
+
+	return &types.ContainerJSON{
+		ContainerJSONBase: &types.ContainerJSONBase{
+			ID:      pi.ID,
+			Created: pi.Created.Format(time.RFC3339Nano),
+			Name:    pi.Name,
+			Image:   pi.Image,
+			State:   state,
+		},
+		Mounts: pi.Mounts,
+		Config: &container.Config{
+			Image:      pi.Config.Image,
+			Env:        pi.Config.Env,
+			Cmd:        pi.Config.Cmd,
+			WorkingDir: pi.Config.WorkingDir,
+			User:       pi.Config.User,
+			Labels:     pi.Config.Labels,
+		},
+		NetworkSettings: &types.NetworkSettings{
+			NetworkSettingsBase: types.NetworkSettingsBase{Ports: pi.NetworkSettings.Ports},
+		},
+	}
+}
+
+func (p *Podman) Exec(ctx context.Context, containerID string, cmd []string) ExecResult {
+	var out bytes.Buffer
+	code, err := p.ExecAttach(ctx, containerID, ExecConfig{Cmd: cmd}, nil, &out, &out)
+	return ExecResult{Error: err, ExitCode: code, Output: out.String()}
+}
+
+func (p *Podman) ExecAttach(ctx context.Context, containerID string, c ExecConfig, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+	body := map[string]interface{}{"Cmd": c.Cmd, "Tty": c.Tty, "AttachStdin": stdin != nil, "AttachStdout": true, "AttachStderr": true}
+	resp, err := p.doContext(ctx, http.MethodPost, fmt.Sprintf("/containers/%s/exec", containerID), body, http.StatusCreated)
+	if err != nil {
+		return 0, err
+	}
+	created := struct {
+		ID string `json:"Id"`
+	}{}
+	err = json.NewDecoder(resp.Body).Decode(&created)
+	resp.Body.Close()
+	if err != nil {
+		return 0, err
+	}
+
+	start := map[string]interface{}{"Detach": false, "Tty": c.Tty}
+	if size := c.consoleSize(); size != nil {
+		start["h"], start["w"] = size[0], size[1]
+	}
+	req, err := p.newRequest(ctx, http.MethodPost, fmt.Sprintf("/exec/%s/start", created.ID), start)
+	if err != nil {
+		return 0, err
+	}
+	// Upgrading the connection lets stdin be written to it.
+	if stdin != nil {
+		req.Header.Set("Connection", "Upgrade")
+		req.Header.Set("Upgrade", "tcp")
+	}
+	resp, err = p.send(req, http.StatusOK, http.StatusSwitchingProtocols)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if stdin != nil {
+		conn, ok := resp.Body.(io.ReadWriteCloser)
+		if !ok {
+			return 0, fmt.Errorf("podman did not upgrade the connection of exec %s", created.ID)
+		}
+		go func() {
+			io.Copy(conn, stdin)
+			if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+				cw.CloseWrite()
+			}
+		}()
+	}
+	if c.Tty {
+		_, err = io.Copy(stdout, resp.Body)
+	} else {
+		_, err = stdcopy.StdCopy(stdout, stderr, resp.Body)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	resp, err = p.doContext(ctx, http.MethodGet, fmt.Sprintf("/exec/%s/json", created.ID), nil, http.StatusOK)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	inspect := struct {
+		ExitCode int
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&inspect); err != nil {
+		return 0, err
+	}
+	return inspect.ExitCode, nil
+}
+
+// Logs returns the output of the container, with stdout and stderr
+// interleaved.
+func (p *Podman) Logs(ctx context.Context, containerID string, opts LogsOptions) (io.ReadCloser, error) {
+	q := url.Values{}
+	q.Set("stdout", "true")
+	q.Set("stderr", "true")
+	q.Set("follow", strconv.FormatBool(opts.Follow))
+	q.Set("timestamps", strconv.FormatBool(opts.Timestamps))
+	if opts.Tail != "" {
+		q.Set("tail", opts.Tail)
+	}
+	if !opts.Since.IsZero() {
+		q.Set("since", strconv.FormatInt(opts.Since.Unix(), 10))
+	}
+	resp, err := p.doContext(ctx, http.MethodGet, fmt.Sprintf("/containers/%s/logs?%s", containerID, q.Encode()), nil, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	return demux(resp.Body), nil
+}
@@ -0,0 +1,389 @@
+package task
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/go-connections/nat"
+	"github.com/google/go-cmp/cmp"
+	"github.com/moby/moby/pkg/stdcopy"
+)
+
+// libpodServer is a minimal stand-in for the Podman service, implementing
+// just enough of the libpod API for the Podman runtime.
+type libpodServer struct {
+	mu         sync.Mutex
+	containers map[string]*podmanInspect
+	specs      map[string]podmanSpec
+	execs      map[string][]string
+	volumes    map[string]bool
+	nextID     int
+	// noDiskQuota makes creating containers with a disk quota fail, as
+	// with storage drivers that cannot enforce one.
+	noDiskQuota bool
+}
+
+func newLibpodServer(t *testing.T) (*libpodServer, *httptest.Server) {
+	s := &libpodServer{
+		containers: make(map[string]*podmanInspect),
+		specs:      make(map[string]podmanSpec),
+		execs:      make(map[string][]string),
+		volumes:    make(map[string]bool),
+	}
+	srv := httptest.NewServer(s)
+	t.Cleanup(srv.Close)
+	return s, srv
+}
+
+func (s *libpodServer) fail(w http.ResponseWriter, code int, msg string) {
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(podmanError{Cause: msg, Message: msg, Response: code})
+}
+
+func (s *libpodServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	path := strings.TrimPrefix(r.URL.Path, "/"+podmanAPIVersion+"/libpod")
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+
+	switch {
+	case path == "/_ping":
+		io.WriteString(w, "OK")
+	case path == "/images/pull" && r.Method == http.MethodPost:
+		if r.URL.Query().Get("reference") == "missing:latest" {
+			json.NewEncoder(w).Encode(map[string]string{"error": "image not known"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"stream": "pulled\n"})
+	case path == "/containers/create" && r.Method == http.MethodPost:
+		var spec podmanSpec
+		if err := json.NewDecoder(r.Body).Decode(&spec); err != nil {
+			s.fail(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if s.noDiskQuota && spec.StorageOpts["size"] != "" {
+			s.fail(w, http.StatusInternalServerError, "setting a disk quota: the backing filesystem does not support quotas")
+			return
+		}
+		s.nextID++
+		id := fmt.Sprintf("%064d", s.nextID)
+		c := &podmanInspect{ID: id, Name: spec.Name, Image: spec.Image, Created: time.Now()}
+		c.State.Status = "created"
+		c.NetworkSettings.Ports = make(nat.PortMap)
+		for _, m := range spec.PortMappings {
+			p := nat.Port(fmt.Sprintf("%d/%s", m.ContainerPort, m.Protocol))
+			hostPort := "40000"
+			if m.HostPort != 0 {
+				hostPort = fmt.Sprint(m.HostPort)
+			}
+			c.NetworkSettings.Ports[p] = append(c.NetworkSettings.Ports[p], nat.PortBinding{HostIP: "0.0.0.0", HostPort: hostPort})
+		}
+		for _, v := range spec.Volumes {
+			s.volumes[v.Name] = true
+			c.Mounts = append(c.Mounts, types.MountPoint{Type: "volume", Name: v.Name, Destination: v.Dest, RW: len(v.Options) == 0})
+		}
+		for _, m := range spec.Mounts {
+			c.Mounts = append(c.Mounts, types.MountPoint{Type: mount.Type(m.Type), Source: m.Source, Destination: m.Destination})
+		}
+		s.containers[id] = c
+		s.specs[id] = spec
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]interface{}{"Id": id, "Warnings": []string{}})
+	case len(parts) == 2 && parts[0] == "volumes" && r.Method == http.MethodDelete:
+		if !s.volumes[parts[1]] {
+			s.fail(w, http.StatusNotFound, "no such volume")
+			return
+		}
+		for id, c := range s.containers {
+			for _, m := range c.Mounts {
+				if m.Name == parts[1] {
+					s.fail(w, http.StatusConflict, "volume is being used by container "+id)
+					return
+				}
+			}
+		}
+		delete(s.volumes, parts[1])
+		w.WriteHeader(http.StatusNoContent)
+	case path == "/containers/stats" && r.Method == http.MethodGet:
+		if _, ok := s.containers[r.URL.Query().Get("containers")]; !ok {
+			s.fail(w, http.StatusNotFound, "no such container")
+			return
+		}
+		io.WriteString(w, `{"Error":null,"Stats":[{"CPUNano":1500000000,"MemUsage":8388608}]}`)
+	case len(parts) >= 2 && parts[0] == "containers":
+		c, ok := s.containers[parts[1]]
+		if !ok {
+			s.fail(w, http.StatusNotFound, "no such container")
+			return
+		}
+		switch {
+		case r.Method == http.MethodDelete:
+			if c.State.Running {
+				s.fail(w, http.StatusConflict, "container is running")
+				return
+			}
+			delete(s.containers, c.ID)
+			json.NewEncoder(w).Encode([]map[string]string{{"Id": c.ID}})
+		case parts[2] == "start":
+			c.State.Status = "running"
+			c.State.Running = true
+			c.State.StartedAt = time.Now()
+			w.WriteHeader(http.StatusNoContent)
+		case parts[2] == "stop":
+			if !c.State.Running {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			c.State.Status = "stopped"
+			c.State.Running = false
+			c.State.ExitCode = 143
+			c.State.FinishedAt = time.Now()
+			w.WriteHeader(http.StatusNoContent)
+		case parts[2] == "json":
+			if r.URL.Query().Get("size") == "true" {
+				json.NewEncoder(w).Encode(struct {
+					*podmanInspect
+					SizeRw int64
+				}{c, 8192})
+				return
+			}
+			json.NewEncoder(w).Encode(c)
+		case parts[2] == "exec" && r.Method == http.MethodPost:
+			var body struct{ Cmd []string }
+			json.NewDecoder(r.Body).Decode(&body)
+			s.nextID++
+			id := fmt.Sprintf("exec-%d", s.nextID)
+			s.execs[id] = body.Cmd
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(map[string]string{"Id": id})
+		case parts[2] == "logs":
+			// Every container writes a line to stdout, then one to stderr.
+			lines := []struct {
+				stream stdcopy.StdType
+				text   string
+			}{{stdcopy.Stdout, "listening\n"}, {stdcopy.Stderr, "warning\n"}}
+			if r.URL.Query().Get("tail") == "1" {
+				lines = lines[1:]
+			}
+			for _, l := range lines {
+				io.WriteString(stdcopy.NewStdWriter(w, l.stream), l.text)
+			}
+		default:
+			s.fail(w, http.StatusNotFound, "not found")
+		}
+	case len(parts) == 3 && parts[0] == "exec":
+		// Commands print their arguments and exit with code 1 if the
+		// first one is "false".
+		cmd, ok := s.execs[parts[1]]
+		if !ok {
+			s.fail(w, http.StatusNotFound, "no such exec session")
+			return
+		}
+		switch parts[2] {
+		case "start":
+			io.WriteString(stdcopy.NewStdWriter(w, stdcopy.Stdout), strings.Join(cmd, " ")+"\n")
+		case "json":
+			code := 0
+			if cmd[0] == "false" {
+				code = 1
+			}
+			json.NewEncoder(w).Encode(map[string]int{"ExitCode": code})
+		}
+	default:
+		s.fail(w, http.StatusNotFound, "not found")
+	}
+}
+
+func TestPodmanRuntime(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	server, srv := newLibpodServer(t)
+	p, err := NewPodman(srv.URL)
+	if err != nil {
+		t.Fatalf("NewPodman() error = %v", err)
+	}
+
+	c := &Config{
+		Name:         "web",
+		Image:        "docker.io/library/nginx:latest",
+		Env:          []string{"MODE=test"},
+		Entrypoint:   []string{"/docker-entrypoint.sh"},
+		Cmd:          []string{"nginx", "-g", "daemon off;"},
+		WorkingDir:   "/srv",
+		User:         "nginx",
+		Labels:       map[string]string{"team": "web"},
+		Cpu:          0.5,
+		Memory:       64 * 1024 * 1024,
+		ExposedPorts: nat.PortSet{"80/tcp": struct{}{}},
+		PortMappings: []PortMapping{{ContainerPort: 53, HostPort: 5353, Protocol: "udp", HostIP: "127.0.0.1"}},
+		Mounts: []Mount{
+			{Type: MountVolume, Source: "cache", Target: "/cache", ReadOnly: true},
+			{Type: MountBind, Source: "/srv/www", Target: "/usr/share/nginx/html"},
+			{Type: MountTmpfs, Target: "/tmp", TmpfsSize: 1024},
+		},
+	}
+	result := p.Run(c)
+	if result.Error != nil {
+		t.Fatalf("Run() error = %v", result.Error)
+	}
+
+	spec := server.specs[result.ContainerId]
+	if spec.Env["MODE"] != "test" {
+		t.Errorf("expected env MODE=test, got %v", spec.Env)
+	}
+	if len(spec.Command) != 3 || spec.Entrypoint[0] != "/docker-entrypoint.sh" || spec.WorkDir != "/srv" || spec.User != "nginx" || spec.Labels["team"] != "web" {
+		t.Errorf("container settings not passed to podman: %+v", spec)
+	}
+	if spec.PublishImagePorts || len(spec.PortMappings) != 2 {
+		t.Errorf("expected the exposed and the mapped port to be published, got %+v", spec.PortMappings)
+	}
+	for _, m := range spec.PortMappings {
+		if m.ContainerPort == 53 && (m.HostPort != 5353 || m.Protocol != "udp" || m.HostIP != "127.0.0.1") {
+			t.Errorf("unexpected port mapping %+v", m)
+		}
+	}
+	wantVolumes := []podmanNamedVolume{{Name: "cache", Dest: "/cache", Options: []string{"ro"}}}
+	wantMounts := []podmanMount{
+		{Destination: "/usr/share/nginx/html", Type: "bind", Source: "/srv/www", Options: []string{"rbind"}},
+		{Destination: "/tmp", Type: "tmpfs", Source: "tmpfs", Options: []string{"size=1024"}},
+	}
+	if !cmp.Equal(spec.Volumes, wantVolumes) || !cmp.Equal(spec.Mounts, wantMounts) {
+		t.Errorf("unexpected mounts %+v and volumes %+v", spec.Mounts, spec.Volumes)
+	}
+	if spec.ResourceLimits == nil || spec.ResourceLimits.CPU.Quota != 50000 || spec.ResourceLimits.Memory.Limit != c.Memory {
+		t.Errorf("unexpected resource limits %+v", spec.ResourceLimits)
+	}
+
+	resp := p.Inspect(result.ContainerId)
+	if resp.Error != nil {
+		t.Fatalf("Inspect() error = %v", resp.Error)
+	}
+	if resp.Container.State.Status != "running" {
+		t.Errorf("status = %s; want running", resp.Container.State.Status)
+	}
+	if got := resp.Container.NetworkSettings.Ports["80/tcp"]; len(got) != 1 || got[0].HostPort != "40000" {
+		t.Errorf("unexpected ports %v", resp.Container.NetworkSettings.Ports)
+	}
+	stats, err := p.Stats(result.ContainerId)
+	if err != nil || stats.CpuTime != 1500*time.Millisecond || stats.Memory != 8<<20 || stats.Disk != 8192 {
+		t.Errorf("Stats() = %+v, %v", stats, err)
+	}
+	if got := resp.Container.Mounts; len(got) != 3 || got[0].Name != "cache" || got[0].RW {
+		t.Errorf("unexpected mounts %+v", got)
+	}
+
+	for tail, want := range map[string]string{"": "listening\nwarning\n", "1": "warning\n"} {
+		logs, err := p.Logs(context.Background(), result.ContainerId, LogsOptions{Tail: tail})
+		if err != nil {
+			t.Fatalf("Logs() error = %v", err)
+		}
+		got, err := io.ReadAll(logs)
+		logs.Close()
+		if err != nil || string(got) != want {
+			t.Errorf("logs with tail %q = %q, %v; want %q", tail, got, err, want)
+		}
+	}
+
+	for _, cmd := range [][]string{{"true", "ok"}, {"false"}} {
+		r := p.Exec(context.Background(), result.ContainerId, cmd)
+		wantCode := 0
+		if cmd[0] == "false" {
+			wantCode = 1
+		}
+		if r.Error != nil || r.ExitCode != wantCode || r.Output != strings.Join(cmd, " ")+"\n" {
+			t.Errorf("Exec(%v) = %+v", cmd, r)
+		}
+	}
+
+	if err := p.RemoveVolume("cache"); err == nil {
+		t.Errorf("expected removing a volume in use to fail")
+	}
+	if r := p.Remove(result.ContainerId); r.Error == nil {
+		t.Errorf("expected removing a running container to fail")
+	}
+	if r := p.Stop(result.ContainerId); r.Error != nil {
+		t.Fatalf("Stop() error = %v", r.Error)
+	}
+	resp = p.Inspect(result.ContainerId)
+	if resp.Container.State.Status != "exited" {
+		t.Errorf("status = %s; want exited", resp.Container.State.Status)
+	}
+	if r := p.Remove(result.ContainerId); r.Error != nil {
+		t.Fatalf("Remove() error = %v", r.Error)
+	}
+	if resp := p.Inspect(result.ContainerId); resp.Error == nil {
+		t.Errorf("expected inspecting a removed container to fail")
+	}
+	if err := p.RemoveVolume("cache"); err != nil {
+		t.Errorf("RemoveVolume() error = %v", err)
+	}
+	if err := p.RemoveVolume("cache"); err == nil {
+		t.Errorf("expected removing a missing volume to fail")
+	}
+}
+
+func TestPodmanRuntimeDiskQuota(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	tests := []struct {
+		name        string
+		noDiskQuota bool
+		disk        int64
+		want        map[string]string
+	}{
+		{"quota", false, 1 << 30, map[string]string{"size": "1073741824"}},
+		{"no quota requested", false, 0, nil},
+		{"quota not supported", true, 1 << 30, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, srv := newLibpodServer(t)
+			server.noDiskQuota = tt.noDiskQuota
+			p, err := NewPodman(srv.URL)
+			if err != nil {
+				t.Fatalf("NewPodman() error = %v", err)
+			}
+
+			for i := 0; i < 2; i++ {
+				result := p.Run(&Config{Name: "db", Image: "postgres:16", Disk: tt.disk})
+				if result.Error != nil {
+					t.Fatalf("Run() error = %v", result.Error)
+				}
+				if got := server.specs[result.ContainerId].StorageOpts; !cmp.Equal(got, tt.want) {
+					t.Errorf("storage options = %v; want %v", got, tt.want)
+				}
+			}
+			if got := p.noDiskQuota.Load(); got != tt.noDiskQuota {
+				t.Errorf("disk quotas disabled = %v; want %v", got, tt.noDiskQuota)
+			}
+		})
+	}
+}
+
+func TestPodmanRuntimePullError(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	_, srv := newLibpodServer(t)
+	p, err := NewPodman(srv.URL)
+	if err != nil {
+		t.Fatalf("NewPodman() error = %v", err)
+	}
+
+	result := p.Run(&Config{Name: "broken", Image: "missing:latest"})
+	if result.Error == nil || !strings.Contains(result.Error.Error(), "image not known") {
+		t.Errorf("expected pull error, got %v", result.Error)
+	}
+}
@@ -0,0 +1,134 @@
+package task
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/docker/go-connections/nat"
+)
+
+// PortMapping publishes a container port on the host the task runs on.
+type PortMapping struct {
+	// ContainerPort is the port the container listens on.
+	ContainerPort uint16
+	// HostPort is the port published on the host. Zero publishes the
+	// container port on a free port picked by the container runtime.
+	HostPort uint16
+	// Protocol is "tcp" (the default), "udp" or "sctp".
+	Protocol string
+	// HostIP restricts the published port to one address of the host.
+	HostIP string
+}
+
+// Port returns the container port in port/protocol form.
+func (p PortMapping) Port() nat.Port {
+	proto := p.Protocol
+	if proto == "" {
+		proto = "tcp"
+	}
+	return nat.Port(fmt.Sprintf("%d/%s", p.ContainerPort, proto))
+}
+
+// HostPortKey identifies the host port of p in port/protocol form, or is
+// empty if the runtime picks the host port. Host ports are treated as taken
+// on every address of the host, whichever HostIP they are bound to.
+func (p PortMapping) HostPortKey() string {
+	if p.HostPort == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%d/%s", p.HostPort, p.Port().Proto())
+}
+
+func (p PortMapping) validate() error {
+	if p.ContainerPort == 0 {
+		return fmt.Errorf("port mapping %+v has no container port", p)
+	}
+	switch p.Protocol {
+	case "", "tcp", "udp", "sctp":
+	default:
+		return fmt.Errorf("port mapping %+v has unsupported protocol %q", p, p.Protocol)
+	}
+	if p.HostIP != "" && net.ParseIP(p.HostIP) == nil {
+		return fmt.Errorf("port mapping %+v has invalid host IP %q", p, p.HostIP)
+	}
+	return nil
+}
+
+// PortMappings returns the ports t publishes: Ports, followed by the
+// PortBindings of earlier versions, which map "port/protocol" to
+// "[hostIP:]hostPort".
+func (t *Task) PortMappings() ([]PortMapping, error) {
+	mappings := append([]PortMapping(nil), t.Ports...)
+	bound := make([]string, 0, len(t.PortBindings))
+	for containerPort := range t.PortBindings {
+		bound = append(bound, containerPort)
+	}
+	sort.Strings(bound)
+	for _, containerPort := range bound {
+		binding := t.PortBindings[containerPort]
+		proto, port := nat.SplitProtoPort(containerPort)
+		cp, err := strconv.ParseUint(port, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port binding %s: %v", containerPort, err)
+		}
+		ip, hostPort := "", binding
+		if i := strings.LastIndex(binding, ":"); i >= 0 {
+			ip, hostPort = strings.Trim(binding[:i], "[]"), binding[i+1:]
+		}
+		hp, err := strconv.ParseUint(hostPort, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid host port for binding %s: %v", containerPort, err)
+		}
+		mappings = append(mappings, PortMapping{ContainerPort: uint16(cp), HostPort: uint16(hp), Protocol: proto, HostIP: ip})
+	}
+
+	seen := make(map[string]bool)
+	for _, m := range mappings {
+		if err := m.validate(); err != nil {
+			return nil, err
+		}
+		if key := m.HostPortKey(); key != "" {
+			if seen[key] {
+				return nil, fmt.Errorf("host port %s is mapped more than once", key)
+			}
+			seen[key] = true
+		}
+	}
+	return mappings, nil
+}
+
+// HostPortKeys returns the host ports t needs on the node it runs on, in
+// port/protocol form.
+func (t *Task) HostPortKeys() []string {
+	mappings, _ := t.PortMappings()
+	var keys []string
+	for _, m := range mappings {
+		if key := m.HostPortKey(); key != "" {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// publishedPorts returns the host ports to publish the container ports of c
+// on. Exposed ports without a mapping are published on a port picked by the
+// runtime, which an empty HostPort stands for.
+func publishedPorts(c *Config) nat.PortMap {
+	ports := make(nat.PortMap)
+	for _, m := range c.PortMappings {
+		binding := nat.PortBinding{HostIP: m.HostIP}
+		if m.HostPort != 0 {
+			binding.HostPort = strconv.Itoa(int(m.HostPort))
+		}
+		ports[m.Port()] = append(ports[m.Port()], binding)
+	}
+	for p := range c.ExposedPorts {
+		if _, ok := ports[p]; !ok {
+			ports[p] = []nat.PortBinding{{}}
+		}
+	}
+	return ports
+}
@@ -0,0 +1,49 @@
+package task
+
+import (
+	"strings"
+	"time"
+)
+
+// ContainerStats is a sample of the resources a container uses.
+type ContainerStats struct {
+	// CpuTime is the CPU time the container has used since it started.
+	CpuTime time.Duration
+	// Memory is the memory the container uses, in bytes, leaving out the
+	// page cache the kernel can reclaim.
+	Memory int64
+	// Disk is the size of the files the container has written, in bytes.
+	Disk int64
+	// Time is when the sample was taken.
+	Time time.Time
+}
+
+// ResourceUsage is what a running task actually uses, as last measured by
+// its worker.
+type ResourceUsage struct {
+	// Cpu is the number of CPUs the task kept busy on average between the
+	// last two measurements.
+	Cpu float64
+	// Memory in bytes.
+	Memory int64
+	// Disk is the size of the files the task has written, in bytes.
+	Disk      int64
+	UpdatedAt time.Time
+}
+
+// Usage returns the usage of a container sampled at cur, the average CPU
+// use being measured since prev. prev is ignored if it is the zero sample.
+func Usage(prev, cur ContainerStats) ResourceUsage {
+	u := ResourceUsage{Memory: cur.Memory, Disk: cur.Disk, UpdatedAt: cur.Time}
+	if elapsed := cur.Time.Sub(prev.Time); !prev.Time.IsZero() && elapsed > 0 && cur.CpuTime >= prev.CpuTime {
+		u.Cpu = float64(cur.CpuTime-prev.CpuTime) / float64(elapsed)
+	}
+	return u
+}
+
+// diskQuotaUnsupported reports whether err is a container engine refusing a
+// disk quota because its storage driver cannot enforce one.
+func diskQuotaUnsupported(err error) bool {
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "storage-opt") || strings.Contains(msg, "storage opt") || strings.Contains(msg, "quota")
+}
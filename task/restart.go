@@ -0,0 +1,58 @@
+package task
+
+import "fmt"
+
+// RestartPolicy decides whether the manager restarts a task once its
+// container has exited.
+type RestartPolicy string
+
+const (
+	RestartNever     RestartPolicy = "never"
+	RestartOnFailure RestartPolicy = "on-failure"
+	RestartAlways    RestartPolicy = "always"
+)
+
+// ParseRestartPolicy returns the policy with the given name. The empty name
+// is the default, on-failure; Docker's "no" and "unless-stopped" are
+// accepted for never and always.
+func ParseRestartPolicy(name string) (RestartPolicy, error) {
+	switch name {
+	case "", string(RestartOnFailure):
+		return RestartOnFailure, nil
+	case string(RestartNever), "no":
+		return RestartNever, nil
+	case string(RestartAlways), "unless-stopped":
+		return RestartAlways, nil
+	default:
+		return "", fmt.Errorf("unknown restart policy %q", name)
+	}
+}
+
+func (p *RestartPolicy) UnmarshalText(text []byte) error {
+	policy, err := ParseRestartPolicy(string(text))
+	if err != nil {
+		return err
+	}
+	*p = policy
+	return nil
+}
+
+func (p RestartPolicy) String() string {
+	if p == "" {
+		return string(RestartOnFailure)
+	}
+	return string(p)
+}
+
+// Restarts reports whether a task that ended up in state s is restarted
+// under p.
+func (p RestartPolicy) Restarts(s State) bool {
+	switch p {
+	case RestartNever:
+		return false
+	case RestartAlways:
+		return s == Failed || s == Succeeded
+	default:
+		return s == Failed
+	}
+}
@@ -0,0 +1,69 @@
+package task
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestRestartPolicy(t *testing.T) {
+	tests := []struct {
+		json      string
+		want      RestartPolicy
+		failed    bool
+		succeeded bool
+	}{
+		{json: `""`, want: RestartOnFailure, failed: true},
+		{json: `"on-failure"`, want: RestartOnFailure, failed: true},
+		{json: `"never"`, want: RestartNever},
+		{json: `"no"`, want: RestartNever},
+		{json: `"always"`, want: RestartAlways, failed: true, succeeded: true},
+		{json: `"unless-stopped"`, want: RestartAlways, failed: true, succeeded: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.json, func(t *testing.T) {
+			var got Task
+			if err := json.Unmarshal([]byte(`{"RestartPolicy": `+tt.json+`}`), &got); err != nil {
+				t.Fatalf("Unmarshal() error = %v", err)
+			}
+			if got.RestartPolicy != tt.want {
+				t.Errorf("policy = %q; want %q", got.RestartPolicy, tt.want)
+			}
+			if r := got.RestartPolicy.Restarts(Failed); r != tt.failed {
+				t.Errorf("Restarts(Failed) = %v; want %v", r, tt.failed)
+			}
+			if r := got.RestartPolicy.Restarts(Succeeded); r != tt.succeeded {
+				t.Errorf("Restarts(Succeeded) = %v; want %v", r, tt.succeeded)
+			}
+		})
+	}
+
+	var tk Task
+	if err := json.Unmarshal([]byte(`{"RestartPolicy": "sometimes"}`), &tk); err == nil {
+		t.Errorf("expected an error for an unknown restart policy")
+	}
+}
+
+func TestDurationEncoding(t *testing.T) {
+	var tk Task
+	if err := json.Unmarshal([]byte(`{"RestartBackoff": "1m30s"}`), &tk); err != nil {
+		t.Fatal(err)
+	}
+	if time.Duration(tk.RestartBackoff) != 90*time.Second {
+		t.Errorf("RestartBackoff = %v; want 1m30s", tk.RestartBackoff)
+	}
+	if err := json.Unmarshal([]byte(`{"RestartBackoff": 1000000000}`), &tk); err != nil {
+		t.Fatal(err)
+	}
+	if time.Duration(tk.RestartBackoff) != time.Second {
+		t.Errorf("RestartBackoff = %v; want 1s", tk.RestartBackoff)
+	}
+
+	data, _ := json.Marshal(Task{RestartBackoff: Duration(10 * time.Second)})
+	var m map[string]interface{}
+	json.Unmarshal(data, &m)
+	if m["RestartBackoff"] != "10s" {
+		t.Errorf("RestartBackoff encoded as %v; want \"10s\"", m["RestartBackoff"])
+	}
+}
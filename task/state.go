@@ -1,27 +1,104 @@
 package task
 
-import "log"
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+)
 
 type State int
 
+// The values of existing states are part of the API and of persisted data,
+// so new states are only ever added at the end.
 const (
 	Pending State = iota
 	Scheduled
 	Running
+	// Completed tasks were stopped on request.
 	Completed
+	// Failed tasks exited with a non-zero code or could not be started.
 	Failed
+	// Stopping tasks have been asked to stop but have not exited yet.
+	Stopping
+	// Restarting tasks are being started again where they ran before.
+	Restarting
+	// Lost tasks ran on a worker the manager cannot reach.
+	Lost
+	// Succeeded tasks exited on their own with code 0.
+	Succeeded
+	// CrashLoopBackOff tasks failed again after being restarted and wait
+	// until NextRestart to be restarted once more.
+	CrashLoopBackOff
 )
 
+var stateNames = []string{"Pending", "Scheduled", "Running", "Completed", "Failed", "Stopping", "Restarting", "Lost", "Succeeded", "CrashLoopBackOff"}
+
+// ErrInvalidTransition is returned when a task is moved to a state it cannot
+// reach from its current one.
+var ErrInvalidTransition = errors.New("invalid state transition")
+
+// stateTransitionMap lists the states each state may move to. It is the only
+// place the task life cycle is defined; both the manager and the workers go
+// through Task.Transition to change the state of a task.
 var stateTransitionMap = map[State][]State{
-	Pending:   []State{Scheduled},
-	Scheduled: []State{Scheduled, Running, Failed},
-	Running:   []State{Running, Completed, Failed, Scheduled},
-	Completed: []State{},
-	Failed:    []State{Scheduled},
+	Pending:          []State{Scheduled, Failed},
+	Scheduled:        []State{Scheduled, Running, Failed, Stopping, Lost, Succeeded},
+	Running:          []State{Running, Completed, Failed, Scheduled, Stopping, Restarting, Lost, Succeeded},
+	Completed:        []State{},
+	Failed:           []State{Scheduled, Restarting, Stopping, CrashLoopBackOff},
+	Stopping:         []State{Completed, Failed, Lost},
+	Restarting:       []State{Scheduled, Running, Failed, Stopping, Lost, Succeeded},
+	Lost:             []State{Scheduled, Running, Completed, Failed, Stopping, Succeeded},
+	Succeeded:        []State{Restarting, Stopping, CrashLoopBackOff},
+	CrashLoopBackOff: []State{Restarting, Scheduled, Stopping},
+}
+
+func (s State) String() string {
+	if s < 0 || int(s) >= len(stateNames) {
+		return fmt.Sprintf("State(%d)", int(s))
+	}
+	return stateNames[s]
+}
+
+// ParseState returns the state with the given name, ignoring case.
+func ParseState(name string) (State, error) {
+	for i, n := range stateNames {
+		if strings.EqualFold(n, name) {
+			return State(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown task state %q", name)
 }
 
-func (s State) String() []string {
-	return []string{"Pending", "Scheduled", "Running", "Completed", "Failed"}
+// MarshalJSON encodes the state by name.
+func (s State) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.String())
+}
+
+// UnmarshalJSON accepts a state name as well as the numeric value earlier
+// versions used.
+func (s *State) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err == nil {
+		state, err := ParseState(name)
+		if err != nil {
+			return err
+		}
+		*s = state
+		return nil
+	}
+
+	var n int
+	if err := json.Unmarshal(data, &n); err != nil {
+		return fmt.Errorf("task state must be a name or a number: %s", data)
+	}
+	if n < 0 || n >= len(stateNames) {
+		return fmt.Errorf("unknown task state %d", n)
+	}
+	*s = State(n)
+	return nil
 }
 
 func Contains(states []State, state State) bool {
@@ -34,6 +111,16 @@ func Contains(states []State, state State) bool {
 }
 
 func ValidStateTransition(src State, dst State) bool {
-	log.Printf("attempting to transition from %#v to %#v\n", src, dst)
+	log.Printf("attempting to transition from %v to %v\n", src, dst)
 	return Contains(stateTransitionMap[src], dst)
 }
+
+// Transition moves t to dst, or returns an error wrapping
+// ErrInvalidTransition if dst cannot be reached from the current state.
+func (t *Task) Transition(dst State) error {
+	if !ValidStateTransition(t.State, dst) {
+		return fmt.Errorf("%w from %v to %v for task %s", ErrInvalidTransition, t.State, dst, t.ID)
+	}
+	t.State = dst
+	return nil
+}
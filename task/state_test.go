@@ -1,6 +1,8 @@
 package task
 
 import (
+	"encoding/json"
+	"errors"
 	"log"
 	"os"
 	"testing"
@@ -18,9 +20,11 @@ func TestValidStateTransition(t *testing.T) {
 	}{
 		{"Pending to Scheduled", Pending, Scheduled, true},
 		{"Pending to Running", Pending, Running, false},
+		{"Pending to Failed", Pending, Failed, true},
 		{"Scheduled to Scheduled", Scheduled, Scheduled, true},
 		{"Scheduled to Running", Scheduled, Running, true},
 		{"Scheduled to Failed", Scheduled, Failed, true},
+		{"Scheduled to Succeeded", Scheduled, Succeeded, true},
 		{"Scheduled to Completed", Scheduled, Completed, false},
 		{"Running to Running", Running, Running, true},
 		{"Running to Completed", Running, Completed, true},
@@ -31,6 +35,19 @@ func TestValidStateTransition(t *testing.T) {
 		{"Completed to Running", Completed, Running, false},
 		{"Failed to Scheduled", Failed, Scheduled, true},
 		{"Failed to Running", Failed, Running, false},
+		{"Failed to Restarting", Failed, Restarting, true},
+		{"Running to Stopping", Running, Stopping, true},
+		{"Running to Succeeded", Running, Succeeded, true},
+		{"Running to Lost", Running, Lost, true},
+		{"Stopping to Completed", Stopping, Completed, true},
+		{"Stopping to Running", Stopping, Running, false},
+		{"Restarting to Running", Restarting, Running, true},
+		{"Restarting to Succeeded", Restarting, Succeeded, true},
+		{"Lost to Running", Lost, Running, true},
+		{"Lost to Scheduled", Lost, Scheduled, true},
+		{"Succeeded to Restarting", Succeeded, Restarting, true},
+		{"Succeeded to Scheduled", Succeeded, Scheduled, false},
+		{"Completed to Stopping", Completed, Stopping, false},
 	}
 
 	for _, tt := range tests {
@@ -42,3 +59,63 @@ func TestValidStateTransition(t *testing.T) {
 		})
 	}
 }
+
+func TestTaskTransition(t *testing.T) {
+	log.SetOutput(os.NewFile(0, os.DevNull))
+
+	tk := Task{State: Running}
+	if err := tk.Transition(Stopping); err != nil {
+		t.Fatalf("Transition(Stopping) error = %v", err)
+	}
+	err := tk.Transition(Running)
+	if !errors.Is(err, ErrInvalidTransition) {
+		t.Errorf("Transition(Running) error = %v; want ErrInvalidTransition", err)
+	}
+	if tk.State != Stopping {
+		t.Errorf("state = %v after an invalid transition; want Stopping", tk.State)
+	}
+}
+
+func TestStateEncoding(t *testing.T) {
+	tests := []struct {
+		json    string
+		want    State
+		wantErr bool
+	}{
+		{json: `"Running"`, want: Running},
+		{json: `"succeeded"`, want: Succeeded},
+		{json: `2`, want: Running},
+		{json: `7`, want: Lost},
+		{json: `"Sleeping"`, wantErr: true},
+		{json: `42`, wantErr: true},
+		{json: `true`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.json, func(t *testing.T) {
+			var got State
+			err := json.Unmarshal([]byte(tt.json), &got)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Unmarshal(%s) error = %v; wantErr %v", tt.json, err, tt.wantErr)
+			}
+			if err == nil && got != tt.want {
+				t.Errorf("Unmarshal(%s) = %v; want %v", tt.json, got, tt.want)
+			}
+		})
+	}
+
+	data, err := json.Marshal(TaskEvent{State: Completed, Task: Task{State: Restarting}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var te TaskEvent
+	if err := json.Unmarshal(data, &te); err != nil {
+		t.Fatal(err)
+	}
+	if te.State != Completed || te.Task.State != Restarting {
+		t.Errorf("round trip of %s gave states %v and %v", data, te.State, te.Task.State)
+	}
+	if got := State(42).String(); got != "State(42)" {
+		t.Errorf("String() = %q; want State(42)", got)
+	}
+}
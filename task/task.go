@@ -1,6 +1,8 @@
 package task
 
 import (
+	"fmt"
+	"strings"
 	"time"
 
 	"github.com/docker/docker/api/types/container"
@@ -9,22 +11,94 @@ import (
 )
 
 type Task struct {
-	ID            uuid.UUID
-	ContainerID   string
-	Name          string
-	State         State
-	Image         string
-	Cpu           float64
-	Memory        int64
-	Disk          int64
-	HostPorts     nat.PortMap
-	ExposedPorts  nat.PortSet
-	PortBindings  map[string]string
-	RestartPolicy container.RestartPolicyMode
+	ID          uuid.UUID
+	ContainerID string
+	Name        string
+	State       State
+	Image       string
+	// Cpu is the number of CPUs the task may use.
+	Cpu float64
+	// Memory is the memory the task may use, in bytes.
+	Memory int64
+	// Disk is the disk space the task may write to, in bytes. Workers
+	// enforce it where the storage driver supports disk quotas.
+	Disk         int64
+	HostPorts    nat.PortMap
+	ExposedPorts nat.PortSet
+	// PortBindings maps container ports to host ports, as in
+	// {"80/tcp": "8080"}. Ports is preferred.
+	PortBindings map[string]string
+	// Ports publishes container ports on fixed or runtime-picked host ports.
+	// ExposedPorts without a mapping are published on free host ports.
+	Ports []PortMapping
+	// Mounts are the volumes, bind mounts and tmpfs mounts of the
+	// container.
+	Mounts []Mount
+	// VolumeRetention decides whether the named volumes of the task are
+	// kept or deleted once it is stopped: "retain" (the default) or
+	// "delete".
+	VolumeRetention VolumeRetention
+	// Env holds environment variables for the container in KEY=value
+	// form.
+	Env []string
+	// Entrypoint replaces the entrypoint of the image.
+	Entrypoint []string
+	// Command replaces the default command of the image.
+	Command []string
+	// Args are appended to Command, or replace the default command of the
+	// image if Command is empty.
+	Args       []string
+	WorkingDir string
+	// User runs the container as user[:group], by name or ID.
+	User   string
+	Labels map[string]string
+	// NodeSelector restricts the task to the workers whose labels match
+	// it.
+	NodeSelector LabelSelector `json:",omitempty"`
+	// Affinity places the task on workers running, for every selector, a
+	// task whose labels match it.
+	Affinity []LabelSelector `json:",omitempty"`
+	// AntiAffinity keeps the task off workers running a task whose labels
+	// match any of the selectors. Replicas select their own labels to be
+	// spread over workers.
+	AntiAffinity []LabelSelector `json:",omitempty"`
+	// Tolerations let the task be placed on workers with matching taints,
+	// which other tasks keep off.
+	Tolerations []Toleration `json:",omitempty"`
+	// Priority orders pending tasks, higher first. When preemption is
+	// enabled on the manager, a task no worker has room for may stop tasks
+	// of a lower priority to take their place.
+	Priority int `json:",omitempty"`
+	// RestartPolicy decides whether the manager restarts the task once it
+	// has exited: "never", "on-failure" (the default) or "always".
+	RestartPolicy RestartPolicy
 	StartTime     time.Time
 	FinishTime    time.Time
-	HealthCheck   string
-	RestartCount  int
+	// HealthCheck is the path of an HTTP health check of the first
+	// published port. Health takes precedence if set.
+	HealthCheck string
+	// Health configures the health checks the worker runs for the task.
+	Health *HealthCheckSpec `json:",omitempty"`
+	// HealthStatus is the latest outcome of those checks.
+	HealthStatus HealthStatus
+	// Usage is what the running task actually uses, as last measured by
+	// its worker.
+	Usage        ResourceUsage
+	RestartCount int
+	// MaxRetries limits the consecutive restarts of the task. Zero uses the
+	// manager's default and a negative value means no limit.
+	MaxRetries int
+	// RestartBackoff is how long the manager waits before restarting a
+	// task that failed again after a restart. It doubles with every
+	// further restart; zero uses the manager's default.
+	RestartBackoff Duration
+	// NextRestart is when a task in CrashLoopBackOff is restarted.
+	NextRestart time.Time
+	// Worker is the worker the manager assigned the task to.
+	Worker string
+	// Error is why the manager failed the task, such as finding no worker
+	// to place it on in time.
+	Error string `json:",omitempty"`
 }
 
 type TaskEvent struct {
@@ -32,6 +106,9 @@ type TaskEvent struct {
 	State     State
 	Timestamp time.Time
 	Task      Task
+	// Reason is why the manager created the event, for the events it
+	// creates on its own such as preemptions.
+	Reason string `json:",omitempty"`
 }
 
 type Config struct {
@@ -43,23 +120,66 @@ type Config struct {
 	Cmd          []string
 	Image        string
 	Cpu          float64
-	// Memory in MiB
+	// Memory in bytes
 	Memory int64
-	// Disk in GiB
+	// Disk in bytes
 	Disk int64
 	Env  []string
 	// RestartPolicy for the container ["always", "unless-stopped", "on-failure"]
 	RestartPolicy container.RestartPolicyMode
+	// PortMappings publish container ports on the host. ExposedPorts
+	// without a mapping are published on free host ports.
+	PortMappings []PortMapping
+	Mounts       []Mount
+	Entrypoint   []string
+	WorkingDir   string
+	User         string
+	Labels       map[string]string
 }
 
 func NewConfig(t *Task) *Config {
+	// Invalid mappings are rejected when the task is submitted.
+	mappings, _ := t.PortMappings()
 	return &Config{
-		Name:          t.Name,
-		ExposedPorts:  t.ExposedPorts,
-		Image:         t.Image,
-		Cpu:           t.Cpu,
-		Memory:        t.Memory,
-		Disk:          t.Disk,
-		RestartPolicy: t.RestartPolicy,
+		PortMappings: mappings,
+		Mounts:       t.Mounts,
+		Name:         t.Name,
+		ExposedPorts: t.ExposedPorts,
+		Image:        t.Image,
+		Cpu:          t.Cpu,
+		Memory:       t.Memory,
+		Disk:         t.Disk,
+		Env:          t.Env,
+		Entrypoint:   t.Entrypoint,
+		Cmd:          append(append([]string(nil), t.Command...), t.Args...),
+		WorkingDir:   t.WorkingDir,
+		User:         t.User,
+		Labels:       t.Labels,
+		// Restarts are left to the manager, which applies the task's
+		// RestartPolicy, so the runtime does not restart containers itself.
+	}
+}
+
+// Validate reports settings of t that cannot be applied to a container.
+func (t *Task) Validate() error {
+	for _, e := range t.Env {
+		if k, _, _ := strings.Cut(e, "="); k == "" || !strings.Contains(e, "=") {
+			return fmt.Errorf("environment variable %q must be in KEY=value form", e)
+		}
+	}
+	if _, err := t.PortMappings(); err != nil {
+		return err
+	}
+	if err := t.validateMounts(); err != nil {
+		return err
+	}
+	if err := t.validatePlacement(); err != nil {
+		return err
+	}
+	if t.Health != nil {
+		if err := t.Health.Validate(); err != nil {
+			return err
+		}
 	}
+	return nil
 }
@@ -0,0 +1,144 @@
+package task
+
+import (
+	"testing"
+	"time"
+
+	"github.com/docker/go-connections/nat"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestNewConfig(t *testing.T) {
+	tests := []struct {
+		name string
+		task Task
+		cmd  []string
+	}{
+		{"image defaults", Task{}, nil},
+		{"command", Task{Command: []string{"nginx", "-g", "daemon off;"}}, []string{"nginx", "-g", "daemon off;"}},
+		{"command and args", Task{Command: []string{"sleep"}, Args: []string{"10"}}, []string{"sleep", "10"}},
+		{"args only", Task{Args: []string{"--verbose"}}, []string{"--verbose"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.task.Env = []string{"MODE=test"}
+			tt.task.Entrypoint = []string{"/entrypoint.sh"}
+			tt.task.WorkingDir = "/srv"
+			tt.task.User = "1000:1000"
+			tt.task.Labels = map[string]string{"team": "web"}
+
+			c := NewConfig(&tt.task)
+			if diff := cmp.Diff(tt.cmd, c.Cmd); diff != "" {
+				t.Errorf("Cmd mismatch (-want +got):\n%s", diff)
+			}
+			if c.Env[0] != "MODE=test" || c.Entrypoint[0] != "/entrypoint.sh" || c.WorkingDir != "/srv" || c.User != "1000:1000" || c.Labels["team"] != "web" {
+				t.Errorf("task settings not copied to config: %+v", c)
+			}
+		})
+	}
+}
+
+func TestTaskValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		task    Task
+		wantErr bool
+	}{
+		{"empty", Task{}, false},
+		{"env", Task{Env: []string{"A=1", "EMPTY="}}, false},
+		{"env without value", Task{Env: []string{"A"}}, true},
+		{"env without name", Task{Env: []string{"=1"}}, true},
+		{"invalid health check", Task{Health: &HealthCheckSpec{}}, true},
+		{"ports", Task{Ports: []PortMapping{{ContainerPort: 80, HostPort: 8080}, {ContainerPort: 53, HostPort: 8080, Protocol: "udp"}}}, false},
+		{"port without container port", Task{Ports: []PortMapping{{HostPort: 8080}}}, true},
+		{"port with unknown protocol", Task{Ports: []PortMapping{{ContainerPort: 80, Protocol: "http"}}}, true},
+		{"port with invalid host IP", Task{Ports: []PortMapping{{ContainerPort: 80, HostIP: "localhost"}}}, true},
+		{"host port mapped twice", Task{Ports: []PortMapping{{ContainerPort: 80, HostPort: 8080}, {ContainerPort: 81, HostPort: 8080}}}, true},
+		{"mounts", Task{Mounts: []Mount{{Type: MountVolume, Source: "cache", Target: "/cache"}, {Type: MountBind, Source: "/srv", Target: "/srv", ReadOnly: true}, {Type: MountTmpfs, Target: "/tmp", TmpfsSize: 1 << 20}}, VolumeRetention: DeleteVolumes}, false},
+		{"mount with relative target", Task{Mounts: []Mount{{Type: MountTmpfs, Target: "tmp"}}}, true},
+		{"mount of unknown type", Task{Mounts: []Mount{{Type: "nfs", Source: "server:/export", Target: "/data"}}}, true},
+		{"volume without name", Task{Mounts: []Mount{{Type: MountVolume, Target: "/data"}}}, true},
+		{"volume with path as name", Task{Mounts: []Mount{{Type: MountVolume, Source: "/data", Target: "/data"}}}, true},
+		{"bind mount of relative path", Task{Mounts: []Mount{{Type: MountBind, Source: "data", Target: "/data"}}}, true},
+		{"tmpfs with source", Task{Mounts: []Mount{{Type: MountTmpfs, Source: "/tmp", Target: "/tmp"}}}, true},
+		{"tmpfs size on volume", Task{Mounts: []Mount{{Type: MountVolume, Source: "cache", Target: "/cache", TmpfsSize: 1}}}, true},
+		{"target mounted twice", Task{Mounts: []Mount{{Type: MountTmpfs, Target: "/tmp"}, {Type: MountVolume, Source: "tmp", Target: "/tmp/"}}}, true},
+		{"unknown volume retention", Task{VolumeRetention: "archive"}, true},
+		{"invalid port binding", Task{PortBindings: map[string]string{"80/tcp": "http"}}, true},
+		{"placement rules", Task{NodeSelector: LabelSelector{"pool": "build"}, Affinity: []LabelSelector{{"app": "db"}}, AntiAffinity: []LabelSelector{{"app": "web"}}}, false},
+		{"node selector with empty key", Task{NodeSelector: LabelSelector{"": "build"}}, true},
+		{"empty affinity rule", Task{Affinity: []LabelSelector{{}}}, true},
+		{"empty anti-affinity rule", Task{AntiAffinity: []LabelSelector{nil}}, true},
+		{"tolerations", Task{Tolerations: []Toleration{{Key: "gpu"}, {Key: "pool", Value: "build"}}}, false},
+		{"toleration without key", Task{Tolerations: []Toleration{{Value: "build"}}}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.task.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v; wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestTaskPortMappings(t *testing.T) {
+	tk := Task{
+		Ports:        []PortMapping{{ContainerPort: 80, HostPort: 8080}, {ContainerPort: 9000}},
+		PortBindings: map[string]string{"53/udp": "127.0.0.1:5353"},
+	}
+	want := []PortMapping{
+		{ContainerPort: 80, HostPort: 8080},
+		{ContainerPort: 9000},
+		{ContainerPort: 53, HostPort: 5353, Protocol: "udp", HostIP: "127.0.0.1"},
+	}
+	got, err := tk.PortMappings()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("PortMappings() mismatch (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff([]string{"8080/tcp", "5353/udp"}, tk.HostPortKeys()); diff != "" {
+		t.Errorf("HostPortKeys() mismatch (-want +got):\n%s", diff)
+	}
+
+	c := NewConfig(&tk)
+	ports := publishedPorts(&Config{PortMappings: c.PortMappings, ExposedPorts: nat.PortSet{"80/tcp": {}, "443/tcp": {}}})
+	wantPorts := nat.PortMap{
+		"80/tcp":   {{HostPort: "8080"}},
+		"9000/tcp": {{}},
+		"53/udp":   {{HostIP: "127.0.0.1", HostPort: "5353"}},
+		"443/tcp":  {{}},
+	}
+	if diff := cmp.Diff(wantPorts, ports); diff != "" {
+		t.Errorf("publishedPorts() mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestUsage(t *testing.T) {
+	start := time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC)
+	cur := ContainerStats{CpuTime: 3 * time.Second, Memory: 1 << 20, Disk: 4096, Time: start.Add(10 * time.Second)}
+
+	tests := []struct {
+		name string
+		prev ContainerStats
+		cpu  float64
+	}{
+		{"first sample", ContainerStats{}, 0},
+		{"half a CPU", ContainerStats{CpuTime: 2 * time.Second, Time: start.Add(8 * time.Second)}, 0.5},
+		{"two CPUs", ContainerStats{CpuTime: time.Second, Time: start.Add(9 * time.Second)}, 2},
+		{"counter reset", ContainerStats{CpuTime: 5 * time.Second, Time: start}, 0},
+		{"same time", ContainerStats{CpuTime: time.Second, Time: cur.Time}, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			want := ResourceUsage{Cpu: tt.cpu, Memory: 1 << 20, Disk: 4096, UpdatedAt: cur.Time}
+			if diff := cmp.Diff(want, Usage(tt.prev, cur)); diff != "" {
+				t.Errorf("Usage() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
@@ -27,6 +27,8 @@ func (a *Api) initRouter() {
 		r.Route("/{taskID}", func(r chi.Router) {
 			r.Delete("/", a.StopTaskHandler)
 			r.Get("/", a.InspectTaskHandler)
+			r.Get("/logs", a.GetTaskLogsHandler)
+			r.Post("/exec", a.ExecTaskHandler)
 		})
 	})
 	a.Router.Route("/stats", func(r chi.Router) {
@@ -34,6 +36,12 @@ func (a *Api) initRouter() {
 	})
 }
 
+// Handler returns the worker API routes without starting a listener.
+func (a *Api) Handler() http.Handler {
+	a.initRouter()
+	return a.Router
+}
+
 func (a *Api) Start() {
 	a.initRouter()
 	http.ListenAndServe(fmt.Sprintf("%s:%d", a.Address, a.Port), a.Router)
@@ -0,0 +1,107 @@
+package worker
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/MarouaneBouaricha/cube/task"
+	"github.com/google/uuid"
+)
+
+// TestWorkerApiConcurrentWithLoops drives the API while the background loops
+// are running. It is most useful with -race.
+func TestWorkerApiConcurrentWithLoops(t *testing.T) {
+	w, f := newTestWorker(t)
+	w.UpdateInterval = 5 * time.Millisecond
+	w.StatsInterval = 5 * time.Millisecond
+
+	api := Api{Worker: w}
+	srv := httptest.NewServer(api.Handler())
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var loops sync.WaitGroup
+	for _, loop := range []func(context.Context){w.RunTasks, w.UpdateTasks, w.CollectStats} {
+		loops.Add(1)
+		go func(loop func(context.Context)) {
+			defer loops.Done()
+			loop(ctx)
+		}(loop)
+	}
+
+	var ids []uuid.UUID
+	for i := 0; i < 20; i++ {
+		ids = append(ids, uuid.New())
+	}
+
+	var clients sync.WaitGroup
+	for i, id := range ids {
+		clients.Add(2)
+		go func(id uuid.UUID) {
+			defer clients.Done()
+			te := task.TaskEvent{ID: uuid.New(), Task: task.Task{ID: id, Name: "web", Image: "server", State: task.Scheduled}}
+			data, _ := json.Marshal(te)
+			resp, err := http.Post(srv.URL+"/tasks", "application/json", bytes.NewBuffer(data))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusCreated {
+				t.Errorf("POST /tasks returned %d", resp.StatusCode)
+			}
+		}(id)
+		go func(path string) {
+			defer clients.Done()
+			resp, err := http.Get(srv.URL + path)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			resp.Body.Close()
+		}([]string{"/tasks", "/stats", fmt.Sprintf("/tasks/%s", ids[0])}[i%3])
+	}
+	clients.Wait()
+
+	waitFor(t, func() bool { return len(f.Containers()) == len(ids) })
+
+	for _, id := range ids[:5] {
+		req, _ := http.NewRequest(http.MethodDelete, fmt.Sprintf("%s/tasks/%s", srv.URL, id), nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	waitFor(t, func() bool { return len(f.Containers()) == len(ids)-5 })
+
+	cancel()
+	loops.Wait()
+
+	for i, id := range ids {
+		want := task.Running
+		if i < 5 {
+			want = task.Completed
+		}
+		if got := getTask(t, w, id).State; got != want {
+			t.Errorf("task %d state = %v; want %v", i, got, want)
+		}
+	}
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for condition")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
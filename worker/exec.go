@@ -0,0 +1,266 @@
+package worker
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/MarouaneBouaricha/cube/task"
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+)
+
+// ExecProtocol is the protocol exec requests upgrade their connection to.
+//
+// Once upgraded, both sides exchange frames made of an 8 byte header and a
+// payload. The first header byte is the kind of frame and the last four are
+// the payload length, big endian, as in the stream format of Docker. The
+// client sends stdin frames, an empty one closing stdin. The worker sends
+// stdout and stderr frames followed by a single exit frame holding an
+// ExecResult encoded as JSON.
+const ExecProtocol = "cube-exec"
+
+const (
+	execStdin byte = iota
+	execStdout
+	execStderr
+	execExit
+)
+
+const maxExecFrame = 1 << 20
+
+// ExecRequest is the body of an exec request.
+type ExecRequest struct {
+	Cmd    []string
+	Tty    bool
+	Height uint
+	Width  uint
+}
+
+// ExecResult ends the output of an exec session.
+type ExecResult struct {
+	ExitCode int
+	Error    string `json:",omitempty"`
+}
+
+func writeFrame(w io.Writer, kind byte, p []byte) error {
+	header := make([]byte, 8)
+	header[0] = kind
+	binary.BigEndian.PutUint32(header[4:], uint32(len(p)))
+	if _, err := w.Write(append(header, p...)); err != nil {
+		return err
+	}
+	return nil
+}
+
+func readFrame(r io.Reader) (byte, []byte, error) {
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, err
+	}
+	n := binary.BigEndian.Uint32(header[4:])
+	if n > maxExecFrame {
+		return 0, nil, fmt.Errorf("exec frame of %d bytes is too large", n)
+	}
+	p := make([]byte, n)
+	if _, err := io.ReadFull(r, p); err != nil {
+		return 0, nil, err
+	}
+	return header[0], p, nil
+}
+
+// frameWriter writes everything written to it as frames of one kind. The
+// writers of a connection share mu so that their frames do not interleave.
+type frameWriter struct {
+	mu   *sync.Mutex
+	w    io.Writer
+	kind byte
+}
+
+func (f *frameWriter) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := writeFrame(f.w, f.kind, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// ExecTaskHandler runs a command in the container of a running task. The
+// connection is upgraded to ExecProtocol to stream the command's stdin,
+// stdout and stderr.
+func (a *Api) ExecTaskHandler(w http.ResponseWriter, r *http.Request) {
+	tID, err := uuid.Parse(chi.URLParam(r, "taskID"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid task ID: %v", err))
+		return
+	}
+	if !strings.EqualFold(r.Header.Get("Upgrade"), ExecProtocol) {
+		w.Header().Set("Upgrade", ExecProtocol)
+		writeError(w, http.StatusUpgradeRequired, fmt.Sprintf("exec requests must upgrade to %s", ExecProtocol))
+		return
+	}
+	var req ExecRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.Cmd) == 0 {
+		writeError(w, http.StatusBadRequest, "exec requests need a command")
+		return
+	}
+	result, err := a.Worker.Db.Get(tID.String())
+	if err != nil {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("no task with ID %v found", tID))
+		return
+	}
+	t := result.(*task.Task)
+	if t.State != task.Running {
+		writeError(w, http.StatusConflict, fmt.Sprintf("task %v is %v, not running", tID, t.State))
+		return
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "connection cannot be upgraded")
+		return
+	}
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		log.Printf("Error upgrading exec connection for task %v: %v\n", tID, err)
+		return
+	}
+	defer conn.Close()
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: %s\r\n\r\n", ExecProtocol)
+	if err := rw.Flush(); err != nil {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// stdin is fed from the client's frames. The command is cancelled if
+	// the client goes away.
+	stdin, stdinW := io.Pipe()
+	go func() {
+		for {
+			kind, p, err := readFrame(rw)
+			if err != nil {
+				stdinW.CloseWithError(err)
+				cancel()
+				return
+			}
+			if kind != execStdin {
+				continue
+			}
+			if len(p) == 0 {
+				stdinW.Close()
+				continue
+			}
+			stdinW.Write(p)
+		}
+	}()
+
+	var mu sync.Mutex
+	stdout := &frameWriter{mu: &mu, w: conn, kind: execStdout}
+	stderr := &frameWriter{mu: &mu, w: conn, kind: execStderr}
+	log.Printf("[worker] running %v in task %v\n", req.Cmd, tID)
+	code, err := a.Worker.ContainerRuntime.ExecAttach(ctx, t.ContainerID, task.ExecConfig{
+		Cmd:    req.Cmd,
+		Tty:    req.Tty,
+		Height: req.Height,
+		Width:  req.Width,
+	}, stdin, stdout, stderr)
+	stdin.Close()
+
+	res := ExecResult{ExitCode: code}
+	if err != nil {
+		res.Error = err.Error()
+	}
+	data, _ := json.Marshal(res)
+	mu.Lock()
+	writeFrame(conn, execExit, data)
+	mu.Unlock()
+}
+
+// ExecTask runs req.Cmd in the container of the task through the API at
+// address, which may be the manager or the worker running the task. The
+// command's streams are connected to stdin, stdout and stderr, and its exit
+// code is returned once it exits.
+func ExecTask(ctx context.Context, address string, taskID string, req ExecRequest, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return 0, err
+	}
+	url := fmt.Sprintf("http://%s/tasks/%s/exec", address, taskID)
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("Connection", "Upgrade")
+	r.Header.Set("Upgrade", ExecProtocol)
+
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		e := ErrResponse{}
+		if err := json.NewDecoder(resp.Body).Decode(&e); err != nil || e.Message == "" {
+			return 0, fmt.Errorf("exec in task %s: %s", taskID, resp.Status)
+		}
+		return 0, fmt.Errorf("exec in task %s: %s", taskID, e.Message)
+	}
+	conn, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok {
+		return 0, errors.New("exec connection was not upgraded")
+	}
+
+	if stdin != nil {
+		go func() {
+			buf := make([]byte, 32*1024)
+			for {
+				n, err := stdin.Read(buf)
+				if n > 0 {
+					if writeFrame(conn, execStdin, buf[:n]) != nil {
+						return
+					}
+				}
+				if err != nil {
+					writeFrame(conn, execStdin, nil)
+					return
+				}
+			}
+		}()
+	}
+
+	br := bufio.NewReader(conn)
+	for {
+		kind, p, err := readFrame(br)
+		if err != nil {
+			return 0, fmt.Errorf("exec in task %s: %v", taskID, err)
+		}
+		switch kind {
+		case execStdout:
+			stdout.Write(p)
+		case execStderr:
+			stderr.Write(p)
+		case execExit:
+			var res ExecResult
+			if err := json.Unmarshal(p, &res); err != nil {
+				return 0, err
+			}
+			if res.Error != "" {
+				return res.ExitCode, fmt.Errorf("exec in task %s: %s", taskID, res.Error)
+			}
+			return res.ExitCode, nil
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package worker
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/MarouaneBouaricha/cube/task"
+	"github.com/google/uuid"
+)
+
+func TestWorkerExecTask(t *testing.T) {
+	w, f := newTestWorker(t)
+	f.Script("failing", task.FakeBehavior{Exec: func(cmd []string) (int, string) { return 2, "no such file\n" }})
+	api := Api{Worker: w}
+	srv := httptest.NewServer(api.Handler())
+	defer srv.Close()
+	addr := strings.TrimPrefix(srv.URL, "http://")
+
+	// Commands in the fake runtime copy their stdin to stdout by default.
+	echo := task.Task{ID: uuid.New(), Name: "echo", Image: "server", State: task.Scheduled}
+	failing := task.Task{ID: uuid.New(), Name: "failing", Image: "failing", State: task.Scheduled}
+	stopped := task.Task{ID: uuid.New(), Name: "stopped", Image: "server", State: task.Scheduled}
+	for _, tk := range []task.Task{echo, failing, stopped} {
+		w.runTask(tk)
+	}
+	stopped.State = task.Completed
+	w.runTask(stopped)
+
+	tests := []struct {
+		name    string
+		task    uuid.UUID
+		stdin   string
+		stdout  string
+		code    int
+		wantErr bool
+	}{
+		{"stdin is streamed", echo.ID, "hello\nworld\n", "hello\nworld\n", 0, false},
+		{"exit code", failing.ID, "", "no such file\n", 2, false},
+		{"stopped task", stopped.ID, "", "", 0, true},
+		{"unknown task", uuid.New(), "", "", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stdout, stderr strings.Builder
+			req := ExecRequest{Cmd: []string{"sh"}, Tty: true}
+			code, err := ExecTask(context.Background(), addr, tt.task.String(), req, strings.NewReader(tt.stdin), &stdout, &stderr)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ExecTask() error = %v; wantErr %v", err, tt.wantErr)
+			}
+			if code != tt.code || stdout.String() != tt.stdout {
+				t.Errorf("ExecTask() = %d with output %q; want %d with %q", code, stdout.String(), tt.code, tt.stdout)
+			}
+		})
+	}
+
+	// Requests that do not upgrade the connection are refused.
+	resp, err := http.Post(srv.URL+"/tasks/"+echo.ID.String()+"/exec", "application/json", strings.NewReader(`{"Cmd":["sh"]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUpgradeRequired {
+		t.Errorf("exec without upgrade returned %d; want %d", resp.StatusCode, http.StatusUpgradeRequired)
+	}
+}
@@ -3,8 +3,12 @@ package worker
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"net/url"
+	"strconv"
+	"time"
 
 	"github.com/MarouaneBouaricha/cube/stats"
 	"github.com/MarouaneBouaricha/cube/task"
@@ -37,14 +41,16 @@ func (a *Api) StartTaskHandler(w http.ResponseWriter, r *http.Request) {
 
 func (a *Api) GetStatsHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
-	if a.Worker.Stats != nil {
+	if s := a.Worker.GetStats(); s != nil {
 		w.WriteHeader(200)
-		json.NewEncoder(w).Encode(*a.Worker.Stats)
+		json.NewEncoder(w).Encode(*s)
 		return
 	}
 
 	w.WriteHeader(200)
 	stats := stats.GetStats()
+	stats.Labels = a.Worker.Labels
+	stats.Taints = a.Worker.Taints
 	json.NewEncoder(w).Encode(stats)
 }
 
@@ -69,7 +75,7 @@ func (a *Api) InspectTaskHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	resp := a.Worker.InspectTask(t.(task.Task))
+	resp := a.Worker.InspectTask(*t.(*task.Task))
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(200)
@@ -89,6 +95,7 @@ func (a *Api) StopTaskHandler(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		log.Printf("No task with ID %v found", tID)
 		w.WriteHeader(404)
+		return
 	}
 
 	taskCopy := *taskToStop.(*task.Task)
@@ -98,3 +105,97 @@ func (a *Api) StopTaskHandler(w http.ResponseWriter, r *http.Request) {
 	log.Printf("Added task %v to stop container %v\n", taskCopy.ID.String(), taskCopy.ContainerID)
 	w.WriteHeader(204)
 }
+
+// GetTaskLogsHandler streams the output of a task's container. The follow,
+// tail, since and timestamps query parameters select what is returned; since
+// is either a time in RFC 3339 format or a duration before now.
+func (a *Api) GetTaskLogsHandler(w http.ResponseWriter, r *http.Request) {
+	tID, err := uuid.Parse(chi.URLParam(r, "taskID"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid task ID: %v", err))
+		return
+	}
+	result, err := a.Worker.Db.Get(tID.String())
+	if err != nil {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("no task with ID %v found", tID))
+		return
+	}
+	t := result.(*task.Task)
+	if t.ContainerID == "" {
+		writeError(w, http.StatusConflict, fmt.Sprintf("task %v has no container", tID))
+		return
+	}
+
+	opts, err := parseLogsOptions(r.URL.Query())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	logs, err := a.Worker.ContainerRuntime.Logs(r.Context(), t.ContainerID, opts)
+	if err != nil {
+		log.Printf("Error getting logs of task %v: %v\n", tID, err)
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("unable to get logs of task %v: %v", tID, err))
+		return
+	}
+	defer logs.Close()
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	// Flush the headers and every read so that clients following the logs
+	// get them as they are written.
+	flush := func() {}
+	if f, ok := w.(http.Flusher); ok {
+		flush = f.Flush
+	}
+	flush()
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := logs.Read(buf)
+		if n > 0 {
+			if _, err := w.Write(buf[:n]); err != nil {
+				return
+			}
+			flush()
+		}
+		if err != nil {
+			if err != io.EOF && r.Context().Err() == nil {
+				log.Printf("Error streaming logs of task %v: %v\n", tID, err)
+			}
+			return
+		}
+	}
+}
+
+func parseLogsOptions(q url.Values) (task.LogsOptions, error) {
+	opts := task.LogsOptions{Tail: q.Get("tail")}
+	if opts.Tail != "" && opts.Tail != "all" {
+		if n, err := strconv.Atoi(opts.Tail); err != nil || n < 0 {
+			return opts, fmt.Errorf("tail must be a number of lines or \"all\", got %q", opts.Tail)
+		}
+	}
+
+	var err error
+	for name, dst := range map[string]*bool{"follow": &opts.Follow, "timestamps": &opts.Timestamps} {
+		if v := q.Get(name); v != "" {
+			if *dst, err = strconv.ParseBool(v); err != nil {
+				return opts, fmt.Errorf("invalid %s value %q", name, v)
+			}
+		}
+	}
+
+	if since := q.Get("since"); since != "" {
+		if d, err := time.ParseDuration(since); err == nil {
+			opts.Since = time.Now().Add(-d)
+		} else if opts.Since, err = time.Parse(time.RFC3339Nano, since); err != nil {
+			return opts, fmt.Errorf("since must be a time in RFC 3339 format or a duration, got %q", since)
+		}
+	}
+	return opts, nil
+}
+
+func writeError(w http.ResponseWriter, code int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(ErrResponse{HTTPStatusCode: code, Message: msg})
+}
@@ -0,0 +1,232 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/MarouaneBouaricha/cube/task"
+	"github.com/docker/go-connections/nat"
+	"github.com/google/uuid"
+)
+
+// DefaultHealthCheckInterval is how often a worker looks for health checks
+// that are due unless configured otherwise. Each task sets how often its
+// own checks run.
+const DefaultHealthCheckInterval = time.Second
+
+// errNotPublished is returned by checks of ports the worker has not learnt
+// the host port of yet. Such checks are retried without counting as failed.
+var errNotPublished = errors.New("port not published yet")
+
+// healthProbe tracks the checks of the container currently running a task.
+type healthProbe struct {
+	containerID string
+	next        time.Time
+	running     bool
+}
+
+// CheckHealth runs the health checks of running tasks until ctx is
+// cancelled, recording the outcome in each task's HealthStatus.
+func (w *Worker) CheckHealth(ctx context.Context) {
+	ticker := time.NewTicker(w.HealthCheckInterval)
+	defer ticker.Stop()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		w.checkHealth(ctx, &wg)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// checkHealth starts the checks that are due. A task has at most one check
+// in flight.
+func (w *Worker) checkHealth(ctx context.Context, wg *sync.WaitGroup) {
+	now := time.Now().UTC()
+	active := make(map[uuid.UUID]bool)
+	for _, t := range w.GetTasks() {
+		spec := t.HealthCheckSpec()
+		if t.State != task.Running || spec == nil {
+			continue
+		}
+		active[t.ID] = true
+		s := spec.WithDefaults()
+
+		w.healthMu.Lock()
+		p := w.probes[t.ID]
+		if p == nil || p.containerID != t.ContainerID {
+			p = &healthProbe{containerID: t.ContainerID, next: t.StartTime.Add(time.Duration(s.InitialDelay))}
+			w.probes[t.ID] = p
+		}
+		due := !p.running && !now.Before(p.next)
+		if due {
+			p.running = true
+			p.next = now.Add(time.Duration(s.Interval))
+		}
+		w.healthMu.Unlock()
+		if !due {
+			continue
+		}
+
+		wg.Add(1)
+		go func(t task.Task, p *healthProbe) {
+			defer wg.Done()
+			err := w.probe(ctx, t, s)
+			if !errors.Is(err, errNotPublished) {
+				w.recordHealth(t, s, err)
+			}
+			w.healthMu.Lock()
+			p.running = false
+			w.healthMu.Unlock()
+		}(*t, p)
+	}
+
+	w.healthMu.Lock()
+	for id := range w.probes {
+		if !active[id] {
+			delete(w.probes, id)
+		}
+	}
+	w.healthMu.Unlock()
+}
+
+// probe runs a single check of t, returning why it failed.
+func (w *Worker) probe(ctx context.Context, t task.Task, s task.HealthCheckSpec) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(s.Timeout))
+	defer cancel()
+
+	switch {
+	case s.HTTP != nil:
+		addr, err := hostAddress(t, s.HTTP.Port)
+		if err != nil {
+			return err
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("http://%s%s", addr, s.HTTP.Path), nil)
+		if err != nil {
+			return err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+
+		if s.HTTP.ExpectedStatus != 0 && resp.StatusCode != s.HTTP.ExpectedStatus {
+			return fmt.Errorf("status %d, expected %d", resp.StatusCode, s.HTTP.ExpectedStatus)
+		}
+		if s.HTTP.ExpectedStatus == 0 && (resp.StatusCode < 200 || resp.StatusCode >= 400) {
+			return fmt.Errorf("status %d", resp.StatusCode)
+		}
+		for k, v := range s.HTTP.ExpectedHeaders {
+			if got := resp.Header.Get(k); got != v {
+				return fmt.Errorf("header %s is %q, expected %q", k, got, v)
+			}
+		}
+		return nil
+	case s.TCP != nil:
+		addr, err := hostAddress(t, s.TCP.Port)
+		if err != nil {
+			return err
+		}
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	case s.Exec != nil:
+		result := w.ContainerRuntime.Exec(ctx, t.ContainerID, s.Exec.Command)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.ExitCode != 0 {
+			return fmt.Errorf("exit code %d: %s", result.ExitCode, strings.TrimSpace(result.Output))
+		}
+		return nil
+	default:
+		return fmt.Errorf("no health check configured")
+	}
+}
+
+// hostAddress returns the address the container port is published at on
+// this host, using the first published port if port is empty.
+func hostAddress(t task.Task, port nat.Port) (string, error) {
+	if port == "" {
+		var ports []string
+		for p, bindings := range t.HostPorts {
+			if len(bindings) > 0 {
+				ports = append(ports, string(p))
+			}
+		}
+		if len(ports) == 0 {
+			return "", errNotPublished
+		}
+		sort.Strings(ports)
+		port = nat.Port(ports[0])
+	} else if !strings.Contains(string(port), "/") {
+		port = nat.Port(string(port) + "/tcp")
+	}
+
+	bindings := t.HostPorts[port]
+	if len(bindings) == 0 {
+		return "", fmt.Errorf("%s: %w", port, errNotPublished)
+	}
+	ip := bindings[0].HostIP
+	switch ip {
+	case "", "0.0.0.0":
+		ip = "127.0.0.1"
+	case "::":
+		ip = "::1"
+	}
+	return net.JoinHostPort(ip, bindings[0].HostPort), nil
+}
+
+// recordHealth adds the outcome of a check to the task's HealthStatus,
+// unless the container it checked has been replaced since.
+func (w *Worker) recordHealth(t task.Task, s task.HealthCheckSpec, checkErr error) {
+	err := w.updateTask(t.ID.String(), func(current *task.Task) bool {
+		if current.State != task.Running || current.ContainerID != t.ContainerID {
+			return false
+		}
+
+		h := &current.HealthStatus
+		h.LastCheck = time.Now().UTC()
+		if h.Status == "" {
+			h.Status = task.HealthStarting
+		}
+		if checkErr == nil {
+			h.Successes++
+			h.Failures = 0
+			h.Message = "ok"
+			if h.Successes >= s.SuccessThreshold && h.Status != task.HealthHealthy {
+				log.Printf("[worker] task %s is healthy\n", t.ID)
+				h.Status = task.HealthHealthy
+			}
+		} else {
+			h.Failures++
+			h.Successes = 0
+			h.Message = checkErr.Error()
+			if h.Failures >= s.FailureThreshold && h.Status != task.HealthUnhealthy {
+				log.Printf("[worker] task %s is unhealthy: %v\n", t.ID, checkErr)
+				h.Status = task.HealthUnhealthy
+			}
+		}
+		return true
+	})
+	if err != nil {
+		log.Printf("error recording health of task %s: %v\n", t.ID, err)
+	}
+}
@@ -0,0 +1,119 @@
+package worker
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/MarouaneBouaricha/cube/task"
+	"github.com/docker/go-connections/nat"
+	"github.com/google/uuid"
+)
+
+func TestWorkerProbe(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/health" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("X-Ready", "yes")
+	}))
+	defer srv.Close()
+	_, srvPort, _ := net.SplitHostPort(srv.Listener.Addr().String())
+
+	// A listener that is closed right away leaves a port nothing listens on.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, closedPort, _ := net.SplitHostPort(l.Addr().String())
+	l.Close()
+
+	w, f := newTestWorker(t)
+	f.Script("checked", task.FakeBehavior{Exec: func(cmd []string) (int, string) {
+		if cmd[0] == "false" {
+			return 1, "not ready\n"
+		}
+		return 0, ""
+	}})
+	result := f.Run(&task.Config{Image: "checked"})
+
+	hostPorts := nat.PortMap{
+		"80/tcp": {{HostIP: "0.0.0.0", HostPort: srvPort}},
+		"81/tcp": {{HostIP: "127.0.0.1", HostPort: closedPort}},
+	}
+	tests := []struct {
+		name    string
+		spec    task.HealthCheckSpec
+		wantErr bool
+	}{
+		{"http", task.HealthCheckSpec{HTTP: &task.HTTPHealthCheck{Port: "80", Path: "/health"}}, false},
+		{"http on first published port", task.HealthCheckSpec{HTTP: &task.HTTPHealthCheck{Path: "/health"}}, false},
+		{"http unexpected status", task.HealthCheckSpec{HTTP: &task.HTTPHealthCheck{Port: "80/tcp", Path: "/"}}, true},
+		{"http expected status", task.HealthCheckSpec{HTTP: &task.HTTPHealthCheck{Port: "80/tcp", Path: "/", ExpectedStatus: 404}}, false},
+		{"http expected header", task.HealthCheckSpec{HTTP: &task.HTTPHealthCheck{Port: "80", Path: "/health", ExpectedHeaders: map[string]string{"X-Ready": "yes"}}}, false},
+		{"http header mismatch", task.HealthCheckSpec{HTTP: &task.HTTPHealthCheck{Port: "80", Path: "/health", ExpectedHeaders: map[string]string{"X-Ready": "no"}}}, true},
+		{"tcp", task.HealthCheckSpec{TCP: &task.TCPHealthCheck{Port: "80"}}, false},
+		{"tcp closed port", task.HealthCheckSpec{TCP: &task.TCPHealthCheck{Port: "81"}}, true},
+		{"tcp unpublished port", task.HealthCheckSpec{TCP: &task.TCPHealthCheck{Port: "82"}}, true},
+		{"exec", task.HealthCheckSpec{Exec: &task.ExecHealthCheck{Command: []string{"true"}}}, false},
+		{"exec non-zero exit", task.HealthCheckSpec{Exec: &task.ExecHealthCheck{Command: []string{"false"}}}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tk := task.Task{ID: uuid.New(), ContainerID: result.ContainerId, HostPorts: hostPorts}
+			err := w.probe(context.Background(), tk, tt.spec.WithDefaults())
+			if (err != nil) != tt.wantErr {
+				t.Errorf("probe() error = %v; wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestWorkerHealthThresholds(t *testing.T) {
+	w, f := newTestWorker(t)
+	exitCode := 0
+	f.Script("checked", task.FakeBehavior{Exec: func(cmd []string) (int, string) { return exitCode, "" }})
+
+	tk := task.Task{
+		ID:    uuid.New(),
+		Name:  "checked",
+		Image: "checked",
+		State: task.Scheduled,
+		Health: &task.HealthCheckSpec{
+			Exec:             &task.ExecHealthCheck{Command: []string{"check"}},
+			Interval:         task.Duration(time.Millisecond),
+			FailureThreshold: 2,
+		},
+	}
+	w.runTask(tk)
+	if got := getTask(t, w, tk.ID).HealthStatus.Status; got != task.HealthStarting {
+		t.Fatalf("health = %q after starting; want %q", got, task.HealthStarting)
+	}
+
+	// check runs the checks that are due and waits for them to finish.
+	check := func() task.HealthStatus {
+		t.Helper()
+		time.Sleep(2 * time.Millisecond)
+		var wg sync.WaitGroup
+		w.checkHealth(context.Background(), &wg)
+		wg.Wait()
+		return getTask(t, w, tk.ID).HealthStatus
+	}
+
+	if got := check(); got.Status != task.HealthHealthy || got.Successes != 1 {
+		t.Errorf("health after a successful check = %+v; want healthy", got)
+	}
+	exitCode = 1
+	if got := check(); got.Status != task.HealthHealthy || got.Failures != 1 {
+		t.Errorf("health after one failed check = %+v; want healthy", got)
+	}
+	if got := check(); got.Status != task.HealthUnhealthy || got.Failures != 2 {
+		t.Errorf("health after two failed checks = %+v; want unhealthy", got)
+	}
+}
@@ -0,0 +1,54 @@
+package worker
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+
+	"github.com/MarouaneBouaricha/cube/task"
+)
+
+// checkMounts reports the mounts of t the worker does not allow: bind mounts
+// of host paths outside of w.BindPaths.
+func (w *Worker) checkMounts(t *task.Task) error {
+	for _, m := range t.Mounts {
+		if m.Type == task.MountBind && !w.bindAllowed(m.Source) {
+			return fmt.Errorf("bind mounts of %s are not allowed on worker %s", m.Source, w.Name)
+		}
+	}
+	return nil
+}
+
+// bindAllowed reports whether source is one of w.BindPaths or below one.
+// Symbolic links are resolved first, so that links inside an allowed path
+// cannot expose the rest of the host.
+func (w *Worker) bindAllowed(source string) bool {
+	source = resolvePath(source)
+	for _, allowed := range w.BindPaths {
+		rel, err := filepath.Rel(resolvePath(allowed), source)
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, "../") {
+			return true
+		}
+	}
+	return false
+}
+
+func resolvePath(p string) string {
+	if resolved, err := filepath.EvalSymlinks(p); err == nil {
+		return resolved
+	}
+	return filepath.Clean(p)
+}
+
+// releaseVolumes applies the volume retention policy of a stopped task.
+func (w *Worker) releaseVolumes(t *task.Task) {
+	if t.VolumeRetention != task.DeleteVolumes {
+		return
+	}
+	for _, name := range t.Volumes() {
+		if err := w.ContainerRuntime.RemoveVolume(name); err != nil {
+			log.Printf("[worker] unable to delete volume %s of task %s: %v\n", name, t.ID, err)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package worker
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/MarouaneBouaricha/cube/task"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/uuid"
+)
+
+func TestWorkerBindMounts(t *testing.T) {
+	allowed := t.TempDir()
+	outside := t.TempDir()
+	if err := os.Mkdir(filepath.Join(allowed, "data"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(allowed, "escape")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		bindPaths []string
+		source    string
+		want      task.State
+	}{
+		{"allowed path", []string{allowed}, allowed, task.Running},
+		{"path below allowed path", []string{allowed}, filepath.Join(allowed, "data"), task.Running},
+		{"path outside allowed paths", []string{allowed}, outside, task.Failed},
+		{"path with allowed prefix", []string{allowed}, allowed + "-other", task.Failed},
+		{"parent of allowed path", []string{filepath.Join(allowed, "data")}, allowed, task.Failed},
+		{"link out of allowed path", []string{allowed}, filepath.Join(allowed, "escape"), task.Failed},
+		{"no allowed paths", nil, allowed, task.Failed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, f := newTestWorker(t)
+			w.BindPaths = tt.bindPaths
+
+			tk := task.Task{ID: uuid.New(), Name: "db", Image: "server", State: task.Scheduled,
+				Mounts: []task.Mount{{Type: task.MountBind, Source: tt.source, Target: "/data"}}}
+			w.runTask(tk)
+
+			if got := getTask(t, w, tk.ID).State; got != tt.want {
+				t.Errorf("task state = %v; want %v", got, tt.want)
+			}
+			if tt.want == task.Failed && len(f.Containers()) != 0 {
+				t.Errorf("container started with a bind mount that is not allowed")
+			}
+		})
+	}
+}
+
+func TestWorkerStopTaskVolumeRetention(t *testing.T) {
+	tests := []struct {
+		name      string
+		retention task.VolumeRetention
+		want      []string
+	}{
+		{"retained by default", "", []string{"cache", "shared"}},
+		{"retained", task.RetainVolumes, []string{"cache", "shared"}},
+		{"deleted", task.DeleteVolumes, []string{"shared"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, f := newTestWorker(t)
+
+			// Volumes still used by another task are left in place.
+			other := task.Task{ID: uuid.New(), Name: "other", Image: "server", State: task.Scheduled,
+				Mounts: []task.Mount{{Type: task.MountVolume, Source: "shared", Target: "/shared"}}}
+			w.runTask(other)
+
+			tk := task.Task{ID: uuid.New(), Name: "db", Image: "server", State: task.Scheduled, VolumeRetention: tt.retention,
+				Mounts: []task.Mount{
+					{Type: task.MountVolume, Source: "cache", Target: "/cache"},
+					{Type: task.MountVolume, Source: "shared", Target: "/shared", ReadOnly: true},
+					{Type: task.MountTmpfs, Target: "/tmp", TmpfsSize: 1 << 20},
+				}}
+			w.runTask(tk)
+			if got := getTask(t, w, tk.ID).State; got != task.Running {
+				t.Fatalf("task state = %v; want %v", got, task.Running)
+			}
+
+			// Restarts keep the volumes whatever the policy.
+			restart := *getTask(t, w, tk.ID)
+			restart.State = task.Restarting
+			f.Crash(restart.ContainerID, 1)
+			w.updateTasks()
+			w.runTask(restart)
+			if diff := cmp.Diff([]string{"cache", "shared"}, f.Volumes()); diff != "" {
+				t.Errorf("volumes after a restart mismatch (-want +got):\n%s", diff)
+			}
+
+			stop := *getTask(t, w, tk.ID)
+			stop.State = task.Completed
+			w.runTask(stop)
+			if diff := cmp.Diff(tt.want, f.Volumes()); diff != "" {
+				t.Errorf("volumes after stopping mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,75 @@
+package worker
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/MarouaneBouaricha/cube/node"
+)
+
+// DefaultRegisterInterval is how often a worker renews its registration with
+// the manager.
+const DefaultRegisterInterval = 30 * time.Second
+
+// errDeregistered is returned by register when the manager refuses the
+// registration of a worker it removed.
+var errDeregistered = errors.New("deregistered by the manager")
+
+// Register joins the cluster of the manager at managerAddr, advertising
+// address as the host:port the manager should reach the worker at. The
+// registration is renewed every w.RegisterInterval so that a manager that
+// restarted learns about the worker again. Register returns once ctx is
+// cancelled, or once the manager removed the worker from its cluster.
+func (w *Worker) Register(ctx context.Context, managerAddr string, address string) {
+	ticker := time.NewTicker(w.RegisterInterval)
+	defer ticker.Stop()
+	for {
+		err := register(managerAddr, node.Registration{Address: address, Labels: w.Labels, Taints: w.Taints, BootID: w.BootID})
+		if errors.Is(err, errDeregistered) {
+			log.Printf("[worker] deregistered by manager %s, no longer renewing the registration\n", managerAddr)
+			return
+		}
+		if err != nil {
+			log.Printf("[worker] unable to register with manager %s: %v\n", managerAddr, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func register(managerAddr string, reg node.Registration) error {
+	data, err := json.Marshal(reg)
+	if err != nil {
+		return err
+	}
+
+	url := fmt.Sprintf("http://%s/nodes", managerAddr)
+	resp, err := http.Post(url, "application/json", bytes.NewBuffer(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusCreated:
+		log.Printf("[worker] registered with manager %s as %s\n", managerAddr, reg.Address)
+	case http.StatusOK:
+	case http.StatusGone:
+		return errDeregistered
+	default:
+		e := ErrResponse{}
+		json.NewDecoder(resp.Body).Decode(&e)
+		return fmt.Errorf("unexpected response %d: %s", resp.StatusCode, e.Message)
+	}
+	return nil
+}
@@ -1,15 +1,17 @@
 package worker
 
 import (
-	"errors"
+	"context"
 	"fmt"
 	"log"
+	"sync"
 	"time"
 
 	"github.com/MarouaneBouaricha/cube/stats"
 	"github.com/MarouaneBouaricha/cube/store"
 	"github.com/MarouaneBouaricha/cube/task"
 	"github.com/golang-collections/collections/queue"
+	"github.com/google/uuid"
 )
 
 type Status int
@@ -19,6 +21,16 @@ const (
 	NotReady
 )
 
+const (
+	// DefaultExecutors is the number of tasks a worker runs concurrently
+	// unless configured otherwise.
+	DefaultExecutors = 4
+	// DefaultUpdateInterval is how often a worker inspects its running tasks.
+	DefaultUpdateInterval = 15 * time.Second
+	// DefaultStatsInterval is how often a worker collects host stats.
+	DefaultStatsInterval = 15 * time.Second
+)
+
 type Worker struct {
 	Name             string
 	Queue            queue.Queue
@@ -27,12 +39,60 @@ type Worker struct {
 	TaskCount        int
 	Status           Status
 	ContainerRuntime task.ContainerRuntime
+	// Executors is the number of tasks run concurrently by RunTasks.
+	Executors        int
+	UpdateInterval   time.Duration
+	StatsInterval    time.Duration
+	RegisterInterval time.Duration
+	// HealthCheckInterval is how often CheckHealth looks for checks that
+	// are due.
+	HealthCheckInterval time.Duration
+	// BindPaths are the host paths tasks may bind mount, along with the
+	// paths below them. Bind mounts are refused if it is empty.
+	BindPaths []string
+	// Labels are advertised to the manager, for tasks to select workers
+	// by.
+	Labels map[string]string
+	// Taints, in key=value form, are advertised to the manager to keep
+	// tasks that do not tolerate them off the worker.
+	Taints []string
+	// BootID identifies this run of the worker when it registers.
+	BootID string
+
+	// queueMu guards Queue, which is written by the API and read by RunTasks.
+	queueMu sync.Mutex
+	// statsMu guards Stats, TaskCount and samples.
+	statsMu sync.RWMutex
+	// samples holds the last resource sample of each running container,
+	// to measure CPU use between samples.
+	samples map[string]task.ContainerStats
+	// taskMu serializes read-modify-write cycles on Db.
+	taskMu sync.Mutex
+	// queued is signalled by AddTask to wake up RunTasks.
+	queued chan struct{}
+	// started is signalled when a container starts so that UpdateTasks
+	// picks up its published ports without waiting for the next tick.
+	started chan struct{}
+	// healthMu guards probes, the health checks of running tasks.
+	healthMu sync.Mutex
+	probes   map[uuid.UUID]*healthProbe
 }
 
-func New(name string, taskDbType string, containerRuntime string) *Worker {
+func New(name string, taskDbType string, runtime task.ContainerRuntime) *Worker {
 	w := Worker{
-		Name:  name,
-		Queue: *queue.New(),
+		Name:                name,
+		Queue:               *queue.New(),
+		ContainerRuntime:    runtime,
+		Executors:           DefaultExecutors,
+		UpdateInterval:      DefaultUpdateInterval,
+		StatsInterval:       DefaultStatsInterval,
+		RegisterInterval:    DefaultRegisterInterval,
+		HealthCheckInterval: DefaultHealthCheckInterval,
+		BootID:              uuid.NewString(),
+		probes:              make(map[uuid.UUID]*healthProbe),
+		samples:             make(map[string]task.ContainerStats),
+		queued:              make(chan struct{}, 1),
+		started:             make(chan struct{}, 1),
 	}
 
 	var s store.Store
@@ -47,15 +107,6 @@ func New(name string, taskDbType string, containerRuntime string) *Worker {
 	if err != nil {
 		log.Printf("unable to create new task store: %v", err)
 	}
-
-	switch containerRuntime {
-	case "docker":
-		err = task.DaemonHealthCheck()
-		if err != nil {
-			log.Fatal(err)
-		}
-		log.Printf("Docker is Running!")
-	}
 	w.Db = s
 	return &w
 }
@@ -70,142 +121,306 @@ func (w *Worker) GetTasks() []*task.Task {
 	return taskList.([]*task.Task)
 }
 
-func (w *Worker) CollectStats() {
+func (w *Worker) CollectStats(ctx context.Context) {
+	ticker := time.NewTicker(w.StatsInterval)
+	defer ticker.Stop()
 	for {
 		log.Println("Collecting stats")
-		w.Stats = stats.GetStats()
-		w.TaskCount = w.Stats.TaskCount
-		time.Sleep(15 * time.Second)
+		s := stats.GetStats()
+		s.Labels = w.Labels
+		s.Taints = w.Taints
+		w.statsMu.Lock()
+		w.Stats = s
+		w.TaskCount = s.TaskCount
+		w.statsMu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
 	}
 }
 
-func (w *Worker) AddTask(t task.Task) {
-	w.Queue.Enqueue(t)
+// GetStats returns the most recently collected stats, or nil if none have
+// been collected yet.
+func (w *Worker) GetStats() *stats.Stats {
+	w.statsMu.RLock()
+	defer w.statsMu.RUnlock()
+	return w.Stats
 }
 
-func (w *Worker) RunTasks() {
-	for {
-		if w.Queue.Len() != 0 {
-			result := w.runTask()
-			if result.Error != nil {
-				log.Printf("Error running task: %v\n", result.Error)
-			}
-		} else {
-			log.Printf("No tasks to process currently.\n")
-		}
-		log.Println("Sleeping for 10 seconds.")
-		time.Sleep(10 * time.Second)
+// putTask saves t, serialized with updateTask.
+func (w *Worker) putTask(t *task.Task) error {
+	w.taskMu.Lock()
+	defer w.taskMu.Unlock()
+	return w.Db.Put(t.ID.String(), t)
+}
+
+// updateTask applies f to the stored task with the given ID and saves it
+// unless f returns false.
+func (w *Worker) updateTask(id string, f func(t *task.Task) bool) error {
+	w.taskMu.Lock()
+	defer w.taskMu.Unlock()
+
+	result, err := w.Db.Get(id)
+	if err != nil {
+		return err
+	}
+	t := result.(*task.Task)
+	if !f(t) {
+		return nil
 	}
+	return w.Db.Put(id, t)
+}
 
+func (w *Worker) AddTask(t task.Task) {
+	w.queueMu.Lock()
+	w.Queue.Enqueue(t)
+	w.queueMu.Unlock()
+	notify(w.queued)
 }
 
-func (w *Worker) runTask() task.ContainerResult {
-	t := w.Queue.Dequeue()
-	if t == nil {
-		log.Println("[worker] No tasks in the queue")
-		return task.ContainerResult{Error: nil}
+func (w *Worker) nextTask() (task.Task, bool) {
+	w.queueMu.Lock()
+	defer w.queueMu.Unlock()
+	if w.Queue.Len() == 0 {
+		return task.Task{}, false
 	}
+	return w.Queue.Dequeue().(task.Task), true
+}
 
-	taskQueued := t.(task.Task)
-	fmt.Printf("[worker] Found task in queue: %v:\n", taskQueued)
+// notify wakes up the loop waiting on c without blocking if it is already
+// due to run.
+func notify(c chan struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
 
-	err := w.Db.Put(taskQueued.ID.String(), &taskQueued)
-	if err != nil {
-		msg := fmt.Errorf("error storing task %s: %v", taskQueued.ID.String(), err)
-		log.Println(msg)
-		return task.ContainerResult{Error: msg}
+// RunTasks runs queued tasks as soon as they are added, using up to
+// w.Executors goroutines. Events for the same task are always handled by the
+// same executor so that they are applied in the order they were queued.
+// RunTasks returns once ctx is cancelled and in-flight tasks have finished.
+func (w *Worker) RunTasks(ctx context.Context) {
+	n := w.Executors
+	if n < 1 {
+		n = 1
 	}
 
-	queuedTask, err := w.Db.Get(taskQueued.ID.String())
-	if err != nil {
-		msg := fmt.Errorf("error getting task %s from database: %v", taskQueued.ID.String(), err)
-		log.Println(msg)
-		return task.ContainerResult{Error: msg}
+	var wg sync.WaitGroup
+	executors := make([]chan task.Task, n)
+	for i := range executors {
+		executors[i] = make(chan task.Task, 16)
+		wg.Add(1)
+		go func(tasks <-chan task.Task) {
+			defer wg.Done()
+			for t := range tasks {
+				result := w.runTask(t)
+				if result.Error != nil {
+					log.Printf("Error running task: %v\n", result.Error)
+				}
+			}
+		}(executors[i])
 	}
+	defer func() {
+		for _, e := range executors {
+			close(e)
+		}
+		wg.Wait()
+	}()
 
-	taskPersisted := *queuedTask.(*task.Task)
+	for {
+		for t, ok := w.nextTask(); ok; t, ok = w.nextTask() {
+			select {
+			case executors[executorFor(t, n)] <- t:
+			case <-ctx.Done():
+				log.Printf("[worker] Shutting down, dropping task %v\n", t.ID)
+				return
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-w.queued:
+		}
+	}
+}
 
-	if taskPersisted.State == task.Completed {
-		return w.StopTask(taskPersisted)
+func executorFor(t task.Task, n int) int {
+	sum := 0
+	for _, b := range t.ID {
+		sum += int(b)
 	}
+	return sum % n
+}
 
-	var containerResult task.ContainerResult
-	if task.ValidStateTransition(taskPersisted.State, taskQueued.State) {
-		switch taskQueued.State {
-		case task.Scheduled:
-			if taskQueued.ContainerID != "" {
-				containerResult = w.StopTask(taskQueued)
-				if containerResult.Error != nil {
-					log.Printf("%v\n", containerResult.Error)
-				}
+// runTask applies a queued task to the stored one. The state of the queued
+// task is the state it should reach: Scheduled and Restarting start a
+// container for the task, Completed stops it. The stored task is checked
+// and moved under w.taskMu, so that updates made meanwhile are not lost.
+func (w *Worker) runTask(taskQueued task.Task) task.ContainerResult {
+	fmt.Printf("[worker] Found task in queue: %v:\n", taskQueued)
+
+	var known bool
+	var transitionErr error
+	switch taskQueued.State {
+	case task.Scheduled, task.Restarting:
+		var previous string
+		err := w.updateTask(taskQueued.ID.String(), func(t *task.Task) bool {
+			known = true
+			if transitionErr = t.Transition(taskQueued.State); transitionErr != nil {
+				return false
 			}
-			containerResult = w.StartTask(taskQueued)
-		case task.Completed:
-			containerResult = w.StopTask(taskQueued)
-		default:
-			fmt.Printf("This is a mistake. taskPersisted: %v, taskQueued: %v\n", taskPersisted, taskQueued)
-			containerResult.Error = errors.New("we should not get here")
+			previous = t.ContainerID
+			t.ContainerID = ""
+			return true
+		})
+		if !known {
+			taskQueued.State = task.Scheduled
+			return w.StartTask(taskQueued)
 		}
-	} else {
-		err := fmt.Errorf("invalid transition from %v to %v", taskPersisted.State, taskQueued.State)
-		containerResult.Error = err
-		return containerResult
+		if transitionErr != nil {
+			return task.ContainerResult{Error: transitionErr}
+		}
+		if err != nil {
+			return task.ContainerResult{Error: err}
+		}
+		// The container of a previous run is replaced.
+		if previous != "" {
+			w.removeContainer(previous)
+		}
+		taskQueued.ContainerID = ""
+		return w.StartTask(taskQueued)
+	case task.Completed:
+		var stopped bool
+		var stopping task.Task
+		err := w.updateTask(taskQueued.ID.String(), func(t *task.Task) bool {
+			known = true
+			if t.State == task.Completed {
+				stopped = true
+				return false
+			}
+			// The stored task, rather than the queued one, knows the
+			// container if the stop was requested before it started.
+			if transitionErr = t.Transition(task.Stopping); transitionErr != nil {
+				return false
+			}
+			stopping = *t
+			return true
+		})
+		switch {
+		case !known:
+			return task.ContainerResult{Error: fmt.Errorf("unable to stop unknown task %s", taskQueued.ID)}
+		case stopped:
+			log.Printf("[worker] task %s is already stopped\n", taskQueued.ID)
+			return task.ContainerResult{}
+		case transitionErr != nil:
+			return task.ContainerResult{Error: transitionErr}
+		case err != nil:
+			return task.ContainerResult{Error: err}
+		}
+		return w.StopTask(stopping)
+	default:
+		return task.ContainerResult{Error: fmt.Errorf("unable to move task %s to state %v", taskQueued.ID, taskQueued.State)}
 	}
-	return containerResult
 }
 
+// StartTask runs a container for a Scheduled or Restarting task.
 func (w *Worker) StartTask(t task.Task) task.ContainerResult {
-	config := task.NewConfig(&t)
-	w.ContainerRuntime = task.NewDocker(config)
-	result := w.ContainerRuntime.Run()
+	w.putTask(&t)
+
+	var result task.ContainerResult
+	if err := w.checkMounts(&t); err != nil {
+		result.Error = err
+	} else {
+		result = w.ContainerRuntime.Run(task.NewConfig(&t))
+	}
 	if result.Error != nil {
 		log.Printf("Err running task %v: %v\n", t.ID, result.Error)
-		t.State = task.Failed
-		w.Db.Put(t.ID.String(), &t)
+		t.Transition(task.Failed)
+		w.putTask(&t)
 		return result
 	}
 
 	t.ContainerID = result.ContainerId
-	t.State = task.Running
-	w.Db.Put(t.ID.String(), &t)
+	t.StartTime = time.Now().UTC()
+	t.FinishTime = time.Time{}
+	t.HealthStatus = task.HealthStatus{}
+	if t.HealthCheckSpec() != nil {
+		t.HealthStatus.Status = task.HealthStarting
+	}
+	t.Transition(task.Running)
+	w.putTask(&t)
+	notify(w.started)
 
 	return result
 }
 
+// StopTask stops and removes the container of a Stopping task, and deletes
+// its volumes if its VolumeRetention says so.
 func (w *Worker) StopTask(t task.Task) task.ContainerResult {
-	config := task.NewConfig(&t)
-	w.ContainerRuntime = task.NewDocker(config)
+	removeResult := w.removeContainer(t.ContainerID)
+	w.releaseVolumes(&t)
+
+	t.FinishTime = time.Now().UTC()
+	t.Transition(task.Completed)
+	w.putTask(&t)
+	log.Printf("Stopped and removed container %v for task %v\n", t.ContainerID, t.ID)
+
+	return removeResult
+}
+
+// sampleUsage measures the resources used by the container of a running
+// task.
+func (w *Worker) sampleUsage(containerID string) (task.ResourceUsage, error) {
+	cur, err := w.ContainerRuntime.Stats(containerID)
+	if err != nil {
+		return task.ResourceUsage{}, err
+	}
+	w.statsMu.Lock()
+	defer w.statsMu.Unlock()
+	prev := w.samples[containerID]
+	w.samples[containerID] = cur
+	return task.Usage(prev, cur), nil
+}
 
-	stopResult := w.ContainerRuntime.Stop(t.ContainerID)
+func (w *Worker) removeContainer(id string) task.ContainerResult {
+	w.statsMu.Lock()
+	delete(w.samples, id)
+	w.statsMu.Unlock()
+
+	stopResult := w.ContainerRuntime.Stop(id)
 	if stopResult.Error != nil {
 		log.Printf("%v\n", stopResult.Error)
 	}
-	removeResult := w.ContainerRuntime.Remove(t.ContainerID)
+	removeResult := w.ContainerRuntime.Remove(id)
 	if removeResult.Error != nil {
 		log.Printf("%v\n", removeResult.Error)
 	}
-
-	t.FinishTime = time.Now().UTC()
-	t.State = task.Completed
-	w.Db.Put(t.ID.String(), &t)
-	log.Printf("Stopped and removed container %v for task %v\n", t.ContainerID, t.ID)
-
 	return removeResult
 }
 
 func (w *Worker) InspectTask(t task.Task) task.ContainerInspectResponse {
-	config := task.NewConfig(&t)
-	w.ContainerRuntime = task.NewDocker(config)
 	return w.ContainerRuntime.Inspect(t.ContainerID)
 }
 
-func (w *Worker) UpdateTasks() {
+func (w *Worker) UpdateTasks(ctx context.Context) {
+	ticker := time.NewTicker(w.UpdateInterval)
+	defer ticker.Stop()
 	for {
 		log.Println("Checking status of tasks")
 		w.updateTasks()
 		log.Println("Task updates completed")
-		log.Println("Sleeping for 15 seconds")
-		time.Sleep(15 * time.Second)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-w.started:
+		}
 	}
 }
 
@@ -221,22 +436,50 @@ func (w *Worker) updateTasks() {
 			if resp.Error != nil {
 				fmt.Printf("ERROR: %v\n", resp.Error)
 			}
-
-			if resp.Container == nil {
-				log.Printf("No container for running task %s\n", t.ID)
-				t.State = task.Failed
-				w.Db.Put(t.ID.String(), t)
+			var usage *task.ResourceUsage
+			if resp.Container != nil && resp.Container.State.Running {
+				if u, err := w.sampleUsage(t.ContainerID); err != nil {
+					log.Printf("[worker] unable to measure usage of task %s: %v\n", t.ID, err)
+				} else {
+					usage = &u
+				}
 			}
 
-			if resp.Container.State.Status == "exited" {
-				log.Printf("Container for task %s in non-running state %s\n", t.ID, resp.Container.State.Status)
-				t.State = task.Failed
-				w.Db.Put(t.ID.String(), t)
-			}
+			// The task may have been stopped or restarted while the
+			// container was being inspected, in which case the result is
+			// stale.
+			err := w.updateTask(t.ID.String(), func(current *task.Task) bool {
+				if current.State != task.Running || current.ContainerID != t.ContainerID {
+					return false
+				}
+
+				if resp.Container == nil {
+					log.Printf("No container for running task %s\n", t.ID)
+					current.Transition(task.Failed)
+					return true
+				}
+
+				if resp.Container.State.Status == "exited" {
+					log.Printf("Container for task %s exited with code %d\n", t.ID, resp.Container.State.ExitCode)
+					if resp.Container.State.ExitCode == 0 {
+						current.Transition(task.Succeeded)
+					} else {
+						current.Transition(task.Failed)
+					}
+					current.FinishTime = time.Now().UTC()
+					return true
+				}
 
-			// task is running, update exposed ports
-			t.HostPorts = resp.Container.NetworkSettings.NetworkSettingsBase.Ports
-			w.Db.Put(t.ID.String(), t)
+				// task is running, update exposed ports
+				current.HostPorts = resp.Container.NetworkSettings.NetworkSettingsBase.Ports
+				if usage != nil {
+					current.Usage = *usage
+				}
+				return true
+			})
+			if err != nil {
+				log.Printf("error updating task %s: %v\n", t.ID, err)
+			}
 		}
 	}
 }
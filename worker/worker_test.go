@@ -0,0 +1,199 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/MarouaneBouaricha/cube/task"
+	"github.com/docker/go-connections/nat"
+	"github.com/google/uuid"
+)
+
+func newTestWorker(t *testing.T) (*Worker, *task.Fake) {
+	log.SetOutput(io.Discard)
+
+	f := task.NewFake()
+	return New("test-worker", "memory", f), f
+}
+
+func getTask(t *testing.T, w *Worker, id uuid.UUID) *task.Task {
+	result, err := w.Db.Get(id.String())
+	if err != nil {
+		t.Fatalf("task %s not found: %v", id, err)
+	}
+	return result.(*task.Task)
+}
+
+func TestWorkerRunTask(t *testing.T) {
+	tests := []struct {
+		name     string
+		behavior task.FakeBehavior
+		want     task.State
+	}{
+		{"container starts", task.FakeBehavior{}, task.Running},
+		{"container starts after a delay", task.FakeBehavior{StartDelay: 20 * time.Millisecond}, task.Running},
+		{"container fails to start", task.FakeBehavior{RunError: errors.New("no such image")}, task.Failed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, f := newTestWorker(t)
+			f.Script("test-image", tt.behavior)
+
+			tk := task.Task{ID: uuid.New(), Name: "test", Image: "test-image", State: task.Scheduled}
+			w.runTask(tk)
+
+			if got := getTask(t, w, tk.ID).State; got != tt.want {
+				t.Errorf("task state = %v; want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWorkerUpdateTasks(t *testing.T) {
+	w, f := newTestWorker(t)
+	f.Script("short-lived", task.FakeBehavior{ExitAfter: 10 * time.Millisecond, ExitCode: 1})
+	f.Script("server", task.FakeBehavior{Memory: 16 << 20})
+
+	web := task.Task{
+		ID:           uuid.New(),
+		Name:         "web",
+		Image:        "server",
+		State:        task.Scheduled,
+		ExposedPorts: nat.PortSet{"80/tcp": struct{}{}},
+	}
+	f.Script("batch", task.FakeBehavior{ExitAfter: 10 * time.Millisecond})
+
+	job := task.Task{ID: uuid.New(), Name: "job", Image: "short-lived", State: task.Scheduled}
+	batch := task.Task{ID: uuid.New(), Name: "batch", Image: "batch", State: task.Scheduled}
+	w.runTask(web)
+	w.runTask(job)
+	w.runTask(batch)
+
+	time.Sleep(20 * time.Millisecond)
+	w.updateTasks()
+
+	got := getTask(t, w, web.ID)
+	if got.State != task.Running {
+		t.Errorf("web task state = %v; want %v", got.State, task.Running)
+	}
+	if got.Usage.Memory != 16<<20 || got.Usage.UpdatedAt.IsZero() {
+		t.Errorf("usage of web task = %+v; want 16 MiB of memory", got.Usage)
+	}
+	if len(got.HostPorts["80/tcp"]) != 1 {
+		t.Errorf("expected host port for 80/tcp, got %v", got.HostPorts)
+	}
+	if got := getTask(t, w, job.ID).State; got != task.Failed {
+		t.Errorf("job task state = %v; want %v", got, task.Failed)
+	}
+	if got := getTask(t, w, batch.ID).State; got != task.Succeeded {
+		t.Errorf("batch task state = %v; want %v", got, task.Succeeded)
+	}
+
+	if err := f.Crash(getTask(t, w, web.ID).ContainerID, 137); err != nil {
+		t.Fatal(err)
+	}
+	w.updateTasks()
+	if got := getTask(t, w, web.ID).State; got != task.Failed {
+		t.Errorf("crashed task state = %v; want %v", got, task.Failed)
+	}
+}
+
+func TestWorkerRestartTask(t *testing.T) {
+	w, f := newTestWorker(t)
+
+	tk := task.Task{ID: uuid.New(), Name: "web", Image: "server", State: task.Scheduled}
+	w.runTask(tk)
+	first := getTask(t, w, tk.ID).ContainerID
+	f.Crash(first, 1)
+	w.updateTasks()
+
+	restart := *getTask(t, w, tk.ID)
+	restart.State = task.Restarting
+	if result := w.runTask(restart); result.Error != nil {
+		t.Fatalf("restarting a failed task: %v", result.Error)
+	}
+	got := getTask(t, w, tk.ID)
+	if got.State != task.Running || got.ContainerID == first {
+		t.Errorf("restarted task is %v in container %s; want Running in a new container", got.State, got.ContainerID)
+	}
+	if containers := f.Containers(); len(containers) != 1 {
+		t.Errorf("expected the old container to be removed, got %v", containers)
+	}
+
+	stop := *got
+	stop.State = task.Completed
+	w.runTask(stop)
+
+	// A stopped task cannot be started again.
+	restart.State = task.Scheduled
+	if result := w.runTask(restart); !errors.Is(result.Error, task.ErrInvalidTransition) {
+		t.Errorf("starting a completed task: error = %v; want ErrInvalidTransition", result.Error)
+	}
+}
+
+func TestWorkerStopTask(t *testing.T) {
+	w, f := newTestWorker(t)
+
+	tk := task.Task{ID: uuid.New(), Name: "web", Image: "server", State: task.Scheduled}
+	w.runTask(tk)
+
+	stop := *getTask(t, w, tk.ID)
+	stop.State = task.Completed
+	w.runTask(stop)
+
+	if got := getTask(t, w, tk.ID).State; got != task.Completed {
+		t.Errorf("task state = %v; want %v", got, task.Completed)
+	}
+	if len(f.Containers()) != 0 {
+		t.Errorf("expected container to be removed, got %v", f.Containers())
+	}
+}
+
+func TestWorkerRunTasks(t *testing.T) {
+	w, f := newTestWorker(t)
+	f.Script("slow", task.FakeBehavior{StartDelay: 50 * time.Millisecond})
+	w.Executors = 10
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		w.RunTasks(ctx)
+		close(done)
+	}()
+
+	var tasks []task.Task
+	for i := 0; i < 50; i++ {
+		tk := task.Task{ID: uuid.New(), Name: "burst", Image: "slow", State: task.Scheduled}
+		tasks = append(tasks, tk)
+		w.AddTask(tk)
+	}
+
+	// The stop event for a task must be applied after its start event.
+	stop := tasks[0]
+	stop.State = task.Completed
+	w.AddTask(stop)
+
+	waitFor(t, func() bool { return len(f.Containers()) == 49 })
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("RunTasks did not return after the context was cancelled")
+	}
+
+	for i, tk := range tasks {
+		want := task.Running
+		if i == 0 {
+			want = task.Completed
+		}
+		if got := getTask(t, w, tk.ID).State; got != want {
+			t.Errorf("task %d state = %v; want %v", i, got, want)
+		}
+	}
+}